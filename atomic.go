@@ -0,0 +1,102 @@
+package cdb
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// CreateAtomic creates a 64-bit CDB database that replaces path only once it
+// is complete. Records are written to a temporary file in the same
+// directory, which Close or Freeze syncs and renames over path before
+// syncing the directory. Until then, an existing database at path is left
+// untouched, and a crash leaves at most a stray temporary file. Abort removes
+// the temporary file.
+func CreateAtomic(path string) (*Writer, error) {
+	return createAtomic(path, Format64)
+}
+
+func createAtomic(path string, format Format) (*Writer, error) {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+
+	f, err := os.CreateTemp(dir, "."+base+".tmp-*")
+	if err != nil {
+		return nil, fmt.Errorf("os.CreateTemp(%q): %w", dir, err)
+	}
+
+	// Keep the permissions of the database being replaced, or use the
+	// usual mode for a new file rather than CreateTemp's 0600.
+	var mode fs.FileMode = 0o644
+	if stat, err := os.Stat(path); err == nil {
+		mode = stat.Mode().Perm()
+	}
+	if err := f.Chmod(mode); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return nil, fmt.Errorf("file.Chmod: %w", err)
+	}
+
+	w, err := newWriter(f, format)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return nil, err
+	}
+	w.file = f
+	w.target = path
+	return w, nil
+}
+
+// prepare finalizes a database created with CreateAtomic and makes its
+// temporary file durable without renaming it, so that a later Close only has
+// to rename it. This lets several databases be built completely before any
+// of them replaces its target.
+func (cdb *Writer) prepare() error {
+	if cdb.state == stateClosed {
+		return ErrWriterClosed
+	}
+	if _, err := cdb.finalize(context.Background()); err != nil {
+		return fmt.Errorf("finalize: %w", err)
+	}
+	if err := cdb.file.Sync(); err != nil {
+		return fmt.Errorf("file.Sync: %w", err)
+	}
+	return nil
+}
+
+// commit makes the finalized temporary file durable and renames it over the
+// target path.
+func (cdb *Writer) commit() error {
+	if err := cdb.file.Sync(); err != nil {
+		return fmt.Errorf("file.Sync: %w", err)
+	}
+
+	if err := os.Rename(cdb.file.Name(), cdb.target); err != nil {
+		return fmt.Errorf("os.Rename(%q, %q): %w", cdb.file.Name(), cdb.target, err)
+	}
+	// The file now lives at the target path; Abort must not remove it.
+	dir := filepath.Dir(cdb.target)
+	cdb.file = nil
+	cdb.target = ""
+
+	return syncDir(dir)
+}
+
+// syncDir fsyncs a directory so that a rename within it is durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("os.Open(%q): %w", dir, err)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("dir.Sync(%q): %w", dir, err)
+	}
+	return nil
+}
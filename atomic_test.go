@@ -0,0 +1,172 @@
+package cdb_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/perbu/cdb"
+)
+
+// assertOnlyFile checks that dir holds no leftover temporary files.
+func assertOnlyFile(t *testing.T, dir, name string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() != name {
+			t.Errorf("unexpected file left in directory: %s", e.Name())
+		}
+	}
+}
+
+func TestCreateAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.cdb")
+
+	// An existing database must stay readable until the new one is complete.
+	filename, cleanup := createTestDB(t, "test-atomic", map[string]string{"version": "1"})
+	defer cleanup()
+	old, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, old, 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	writer, err := cdb.CreateAtomic(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Put([]byte("version"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := cdb.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, _ := db.Get([]byte("version"))
+	if string(value) != "1" {
+		t.Errorf("expected old database before Close, got %q", value)
+	}
+	db.Close()
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = cdb.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	value, _ = db.Get([]byte("version"))
+	if string(value) != "2" {
+		t.Errorf("expected new database after Close, got %q", value)
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode().Perm() != 0o640 {
+		t.Errorf("expected permissions of replaced file, got %v", stat.Mode().Perm())
+	}
+	assertOnlyFile(t, dir, "test.cdb")
+}
+
+func TestCreateAtomicFreeze(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.cdb")
+
+	writer, err := cdb.CreateAtomic(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	db, err := writer.Freeze()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	value, _ := db.Get([]byte("key"))
+	if string(value) != "value" {
+		t.Errorf("expected %q, got %q", "value", value)
+	}
+	assertOnlyFile(t, dir, "test.cdb")
+
+	if err := writer.Abort(); !errors.Is(err, cdb.ErrWriterClosed) {
+		t.Errorf("expected ErrWriterClosed from Abort after Freeze, got %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Abort after Freeze must not remove the database: %v", err)
+	}
+}
+
+func TestCreateAtomicAbort(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.cdb")
+
+	writer, err := cdb.CreateAtomic(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Abort(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected no database after Abort, got %v", err)
+	}
+	assertOnlyFile(t, dir, "")
+
+	if err := writer.Put([]byte("key"), []byte("value")); !errors.Is(err, cdb.ErrFinalized) {
+		t.Errorf("expected ErrFinalized from Put after Abort, got %v", err)
+	}
+}
+
+func TestWriterState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.cdb")
+	writer, err := cdb.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writer.Put([]byte("late"), []byte("value")); !errors.Is(err, cdb.ErrFinalized) {
+		t.Errorf("expected ErrFinalized from Put after Close, got %v", err)
+	}
+	if err := writer.Close(); !errors.Is(err, cdb.ErrWriterClosed) {
+		t.Errorf("expected ErrWriterClosed from second Close, got %v", err)
+	}
+	if _, err := writer.Freeze(); !errors.Is(err, cdb.ErrWriterClosed) {
+		t.Errorf("expected ErrWriterClosed from Freeze after Close, got %v", err)
+	}
+
+	db, err := cdb.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for key := range db.Keys() {
+		if string(key) != "key" {
+			t.Errorf("unexpected record %q written after Close", key)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package cdb
+
+import (
+	"fmt"
+	"io"
+)
+
+// Builder creates a CDB database entirely in memory. It embeds a
+// Writer, so records are added with Put; Bytes or InMemory finalize the
+// database and return it. Freeze returns an *InMemoryCDB.
+type Builder struct {
+	*Writer
+	buf *memFile
+}
+
+// NewBuilder returns a Builder with an empty in-memory database.
+func NewBuilder() *Builder {
+	return newBuilder(Format64)
+}
+
+// NewBuilder32 returns a Builder with an empty in-memory 32-bit database.
+func NewBuilder32() *Builder {
+	return newBuilder(Format32)
+}
+
+func newBuilder(format Format) *Builder {
+	buf := &memFile{}
+	// Writing and seeking in memory cannot fail.
+	w, _ := newWriter(buf, format)
+	return &Builder{Writer: w, buf: buf}
+}
+
+// Bytes finalizes the database and returns its contents. The Builder must
+// not be used to add records afterwards.
+func (b *Builder) Bytes() ([]byte, error) {
+	if err := b.Finish(); err != nil {
+		return nil, err
+	}
+	return b.buf.data, nil
+}
+
+// InMemory finalizes the database and returns an InMemoryCDB for reading it.
+func (b *Builder) InMemory() (*InMemoryCDB, error) {
+	data, err := b.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return newInMemoryFormat(data, b.format, false)
+}
+
+// memFile is a growable in-memory io.WriteSeeker.
+type memFile struct {
+	data []byte
+	pos  int64
+}
+
+func (m *memFile) Write(p []byte) (int, error) {
+	end := m.pos + int64(len(p))
+	if end > int64(len(m.data)) {
+		if end > int64(cap(m.data)) {
+			grown := make([]byte, end, max(end, 2*int64(cap(m.data))))
+			copy(grown, m.data)
+			m.data = grown
+		}
+		m.data = m.data[:end]
+	}
+	copy(m.data[m.pos:], p)
+	m.pos = end
+	return len(p), nil
+}
+
+func (m *memFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += m.pos
+	case io.SeekEnd:
+		offset += int64(len(m.data))
+	default:
+		return 0, fmt.Errorf("memFile.Seek: invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("memFile.Seek: negative position %d", offset)
+	}
+	m.pos = offset
+	return offset, nil
+}
@@ -0,0 +1,140 @@
+package cdb_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/perbu/cdb"
+)
+
+func TestBuilder(t *testing.T) {
+	testData := map[string]string{
+		"foo":   "bar",
+		"baz":   "quuuux",
+		"empty": "",
+		"":      "empty_key",
+	}
+
+	builder := cdb.NewBuilder()
+	for key, value := range testData {
+		if err := builder.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := builder.InMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, expectedValue := range testData {
+		value, err := db.Get([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != expectedValue {
+			t.Errorf("Key: %s: expected %q, got %q", key, expectedValue, value)
+		}
+	}
+
+	if err := builder.Put([]byte("late"), nil); !errors.Is(err, cdb.ErrFinalized) {
+		t.Errorf("expected ErrFinalized after InMemory, got %v", err)
+	}
+
+	frozen, err := builder.Freeze()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := frozen.(*cdb.InMemoryCDB); !ok {
+		t.Errorf("expected Freeze on a Builder to return *InMemoryCDB, got %T", frozen)
+	}
+	if frozen.Size() != db.Size() {
+		t.Errorf("expected Freeze and InMemory to return the same database")
+	}
+}
+
+func TestBuilderMatchesFile(t *testing.T) {
+	f, err := os.CreateTemp("", "test-builder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	writer, err := cdb.NewWriter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder := cdb.NewBuilder()
+	for _, record := range expectedRecords[:len(expectedRecords)-1] {
+		if err := writer.Put(record[0], record[1]); err != nil {
+			t.Fatal(err)
+		}
+		if err := builder.Put(record[0], record[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Finish leaves the file open and positioned at the end.
+	if err := writer.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("trailer")); err != nil {
+		t.Fatal(err)
+	}
+
+	fileData, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	built, err := builder.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(append(built, "trailer"...), fileData) {
+		t.Error("Builder output differs from file output")
+	}
+}
+
+// readSeekBuffer is a seekBuffer that can also be read back.
+type readSeekBuffer struct {
+	seekBuffer
+}
+
+func (b *readSeekBuffer) Read(p []byte) (int, error) {
+	if b.pos >= len(b.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, b.data[b.pos:])
+	b.pos += n
+	return n, nil
+}
+
+func TestFreezeNonFileDestination(t *testing.T) {
+	readable := &readSeekBuffer{}
+	writer, err := cdb.NewWriter(readable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	db, err := writer.Freeze()
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, _ := db.Get([]byte("key"))
+	if string(value) != "value" {
+		t.Errorf("expected %q, got %q", "value", value)
+	}
+
+	writer, err = cdb.NewWriter(&seekBuffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Freeze(); err == nil {
+		t.Error("expected Freeze to fail for a write-only destination")
+	}
+}
@@ -0,0 +1,296 @@
+package cdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"math"
+	"os"
+)
+
+// ErrTooMuchData32 is returned when a 32-bit CDB database would exceed 4GB.
+var ErrTooMuchData32 = errors.New("32-bit CDB files are limited to 4GB of data")
+
+// Format is the on-disk layout of a CDB database.
+type Format int
+
+const (
+	// Format64 is this package's layout: a 4096-byte index and 64-bit
+	// lengths, offsets and slots.
+	Format64 Format = iota
+	// Format32 is the classic djb layout used by cdbmake, tinydns, qmail and
+	// postfix: a 2048-byte index and 32-bit lengths, offsets and slots,
+	// limiting the file to 4GB.
+	Format32
+)
+
+func (f Format) String() string {
+	switch f {
+	case Format64:
+		return "64-bit"
+	case Format32:
+		return "32-bit"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+const indexSize32 = 256 * 8
+
+// layout describes the sizes of the integers in a format. Index entries,
+// record headers and hash table slots are all pairs of such integers.
+type layout struct {
+	indexSize uint64
+	tupleSize uint64
+	maxSize   int64
+	tooMuch   error
+}
+
+var (
+	layout64 = layout{indexSize: indexSize, tupleSize: 16, maxSize: math.MaxInt64, tooMuch: ErrTooMuchData}
+	layout32 = layout{indexSize: indexSize32, tupleSize: 8, maxSize: math.MaxUint32, tooMuch: ErrTooMuchData32}
+)
+
+func (f Format) layout() layout {
+	if f == Format32 {
+		return layout32
+	}
+	return layout64
+}
+
+// tuple reads the pair of integers at offset, or zeros if it is out of range.
+func (l layout) tuple(data []byte, offset uint64) (uint64, uint64) {
+	if l.tupleSize == 16 {
+		return readTupleMmap(data, offset)
+	}
+	if offset > uint64(len(data)) || uint64(len(data))-offset < 8 {
+		return 0, 0
+	}
+	return uint64(binary.LittleEndian.Uint32(data[offset:])), uint64(binary.LittleEndian.Uint32(data[offset+4:]))
+}
+
+// putTuple encodes a pair of integers at the start of buf.
+func (l layout) putTuple(buf []byte, first, second uint64) {
+	if l.tupleSize == 16 {
+		binary.LittleEndian.PutUint64(buf[:8], first)
+		binary.LittleEndian.PutUint64(buf[8:16], second)
+		return
+	}
+	binary.LittleEndian.PutUint32(buf[:4], uint32(first))
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(second))
+}
+
+// table reads the index entry of hash table i.
+func (l layout) table(data []byte, i uint8) table {
+	offset, length := l.tuple(data, uint64(i)*l.tupleSize)
+	return table{offset: offset, length: length}
+}
+
+// dataEnd returns the offset where the data section ends. Empty tables are
+// ignored, as the 32-bit format gives them the offset of the next table.
+func (l layout) dataEnd(data []byte) uint64 {
+	endPos := uint64(len(data))
+	for i := 0; i < 256; i++ {
+		t := l.table(data, uint8(i))
+		if t.length > 0 && t.offset < endPos {
+			endPos = t.offset
+		}
+	}
+	return endPos
+}
+
+// valid reports whether data looks like a complete database in this layout:
+// every hash table is in bounds and the last one ends the file.
+func (l layout) valid(data []byte) bool {
+	size := uint64(len(data))
+	if size < l.indexSize {
+		return false
+	}
+
+	end := l.indexSize
+	for i := 0; i < 256; i++ {
+		t := l.table(data, uint8(i))
+		if t.length == 0 {
+			continue
+		}
+		if t.offset < l.indexSize || t.offset > size || t.length > (size-t.offset)/l.tupleSize {
+			return false
+		}
+		end = max(end, t.offset+t.length*l.tupleSize)
+	}
+	return end == size
+}
+
+// detectFormat returns Format32 if data is a valid 32-bit database and not
+// a valid 64-bit one, and Format64 otherwise.
+func detectFormat(data []byte) Format {
+	if layout32.valid(data) && !layout64.valid(data) {
+		return Format32
+	}
+	return Format64
+}
+
+// get returns the value of the first record of key in data.
+func (l layout) get(data []byte, key []byte) []byte {
+	for value := range l.values(data, key) {
+		return value
+	}
+	return nil
+}
+
+// values returns an iterator over the values of all records of key in data,
+// in the order they were written.
+func (l layout) values(data []byte, key []byte) iter.Seq[[]byte] {
+	return func(yield func([]byte) bool) {
+		hash := cdbHash(key)
+		t := l.table(data, uint8(hash&0xff))
+		if t.length == 0 {
+			return
+		}
+
+		startingSlot := t.startSlot(hash)
+		slot := startingSlot
+		for {
+			slotHash, offset := l.tuple(data, t.offset+l.tupleSize*slot)
+			// An empty slot has offset 0, the index, while a key may
+			// hash to 0.
+			if offset == 0 {
+				return
+			}
+			if slotHash == uint64(hash) {
+				if value := l.valueAt(data, offset, key); value != nil && !yield(value) {
+					return
+				}
+			}
+
+			slot++
+			if slot == t.length {
+				slot = 0
+			}
+			if slot == startingSlot {
+				return
+			}
+		}
+	}
+}
+
+// valueAt returns the value of the record at offset if its key is key.
+func (l layout) valueAt(data []byte, offset uint64, key []byte) []byte {
+	keyLength, valueLength := l.tuple(data, offset)
+	if keyLength != uint64(len(key)) {
+		return nil
+	}
+	start := offset + l.tupleSize
+	end := start + keyLength + valueLength
+	if end < start || end > uint64(len(data)) {
+		return nil
+	}
+	if !bytes.Equal(data[start:start+keyLength], key) {
+		return nil
+	}
+	return data[start+keyLength : end]
+}
+
+// records returns an iterator over the records of data in write order.
+func (l layout) records(data []byte) iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		endPos := l.dataEnd(data)
+		pos := l.indexSize
+		for pos < endPos {
+			keyLength, valueLength := l.tuple(data, pos)
+			keyEnd := pos + l.tupleSize + keyLength
+			valueEnd := keyEnd + valueLength
+			if pos+l.tupleSize > endPos || keyEnd < pos || valueEnd < keyEnd || valueEnd > endPos {
+				return
+			}
+			if !yield(data[pos+l.tupleSize:keyEnd], data[keyEnd:valueEnd]) {
+				return
+			}
+			pos = valueEnd
+		}
+	}
+}
+
+// Format returns the layout of the database.
+func (cdb *MmapCDB) Format() Format {
+	return cdb.format
+}
+
+// Format returns the layout of the database.
+func (cdb *InMemoryCDB) Format() Format {
+	return cdb.format
+}
+
+// Open32 opens a 32-bit CDB file at the given path without autodetection.
+func Open32(path string) (*MmapCDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.Open(%q): %w", path, err)
+	}
+	return mmapFormat(f, Format32, false)
+}
+
+// NewInMemory32 creates an in-memory CDB from a byte slice containing a
+// complete 32-bit CDB database, without autodetection.
+func NewInMemory32(data []byte) (*InMemoryCDB, error) {
+	return newInMemoryFormat(data, Format32, false)
+}
+
+// Create32 opens a 32-bit CDB database at the given path. See Create.
+func Create32(path string) (*Writer, error) {
+	return create(path, Format32)
+}
+
+// NewWriter32 opens a 32-bit CDB database for the given io.WriteSeeker.
+// Records and hash tables are written in the classic djb layout, and Put
+// returns ErrTooMuchData32 once the database would not fit in 4GB.
+func NewWriter32(writer io.WriteSeeker) (*Writer, error) {
+	return newWriter(writer, Format32)
+}
+
+// CreateAtomic32 creates a 32-bit CDB database that replaces path only once
+// it is complete. See CreateAtomic.
+func CreateAtomic32(path string) (*Writer, error) {
+	return createAtomic(path, Format32)
+}
+
+// Convert copies every record of src, including duplicates, to dst in write
+// order. The layout of the result is that of dst, so a 64-bit database is
+// converted to the 32-bit layout by passing a Writer from NewWriter32, in
+// which case Convert fails with ErrTooMuchData32 if the records do not fit.
+// Dst is not finalized.
+func Convert(dst *Writer, src Reader) error {
+	for key, value := range src.All() {
+		if err := dst.Put(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConvertFile converts the database at src, in either format, to a database
+// in the given format at dst, which is replaced atomically. On failure, dst
+// is left untouched.
+func ConvertFile(dst, src string, format Format) error {
+	r, err := Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := createAtomic(dst, format)
+	if err != nil {
+		return err
+	}
+	if err := Convert(w, r); err != nil {
+		_ = w.Abort()
+		return fmt.Errorf("convert %q: %w", src, err)
+	}
+	if err := w.Close(); err != nil {
+		_ = w.Abort()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package cdb_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/perbu/cdb"
+)
+
+const testFile32 = "./test/test.cdb"
+
+func TestOpen32(t *testing.T) {
+	db, err := cdb.Open(testFile32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.Format() != cdb.Format32 {
+		t.Fatalf("Format = %v, want %v", db.Format(), cdb.Format32)
+	}
+
+	for _, record := range expectedRecords {
+		value, err := db.Get(record[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(value, record[1]) {
+			t.Errorf("Get(%q) = %q, want %q", record[0], value, record[1])
+		}
+	}
+
+	var n int
+	for range db.All() {
+		n++
+	}
+	if n != 20 {
+		t.Errorf("All yielded %d records, want 20", n)
+	}
+	if err := db.Verify(); err != nil {
+		t.Error(err)
+	}
+	if stats := db.Stats(); stats.Records != 20 || stats.Slots != 40 {
+		t.Errorf("Stats = %+v, want 20 records in 40 slots", stats)
+	}
+
+	db64, err := cdb.Open(testFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db64.Close()
+	if db64.Format() != cdb.Format64 {
+		t.Errorf("Format of %s = %v, want %v", testFile, db64.Format(), cdb.Format64)
+	}
+}
+
+func TestWriter32MatchesCdbmake(t *testing.T) {
+	want, err := os.ReadFile(testFile32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := cdb.Open(testFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	builder := cdb.NewBuilder32()
+	if err := cdb.Convert(builder.Writer, src); err != nil {
+		t.Fatal(err)
+	}
+	got, err := builder.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("32-bit writer output differs from cdbmake")
+	}
+
+	// Merge appends raw 64-bit records, which are re-encoded.
+	merged := cdb.NewBuilder32()
+	if err := cdb.Merge(merged.Writer, cdb.MergeKeepAll, src); err != nil {
+		t.Fatal(err)
+	}
+	got, err = merged.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("32-bit merge output differs from cdbmake")
+	}
+}
+
+func TestConvertFile(t *testing.T) {
+	dir := t.TempDir()
+	path32 := filepath.Join(dir, "test.cdb")
+	path64 := filepath.Join(dir, "test.cdb64")
+	if err := cdb.ConvertFile(path32, testFile, cdb.Format32); err != nil {
+		t.Fatal(err)
+	}
+	if err := cdb.ConvertFile(path64, path32, cdb.Format64); err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := cdb.Open(testFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer want.Close()
+	for _, path := range []string{path32, path64} {
+		got, err := cdb.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := got.Verify(); err != nil {
+			t.Errorf("%s: %v", path, err)
+		}
+		if !slices.Equal(collectPairs(got.All()), collectPairs(want.All())) {
+			t.Errorf("%s: records differ after conversion", path)
+		}
+		got.Close()
+	}
+}
+
+func TestFormat32Empty(t *testing.T) {
+	data, err := cdb.NewBuilder32().Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 2048 {
+		t.Fatalf("empty 32-bit database is %d bytes, want 2048", len(data))
+	}
+	db, err := cdb.NewInMemory(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Format() != cdb.Format32 {
+		t.Errorf("Format = %v, want %v", db.Format(), cdb.Format32)
+	}
+	if value, _ := db.Get([]byte("missing")); value != nil {
+		t.Errorf("Get = %q, want nil", value)
+	}
+}
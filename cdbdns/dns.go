@@ -0,0 +1,193 @@
+// Package cdbdns is a small authoritative DNS server that answers from a CDB
+// database, in the spirit of tinydns and its data.cdb.
+//
+// Compile turns a zone description in a simplified master-file syntax into
+// a database, and a Server answers queries for it over UDP and TCP. The
+// supported record types are A, AAAA, CNAME, MX, TXT, NS and SOA, plus
+// wildcard names. Names below an NS record other than a zone's apex are
+// delegated with a referral. Reloading a rebuilt database, with
+// NewReloading and a cdb.Reloader, updates the server without a restart.
+//
+// # Database layout
+//
+// Each resource record is stored under a key made of its owner name in
+// lowercase wire format followed by its type as a big-endian uint16. The
+// value is the TTL as a big-endian uint32 followed by the record data in
+// wire format, with uncompressed names. A name with several records of a
+// type has several records with the same key. Every name that exists in a
+// zone, including empty non-terminals between a name and its zone's apex,
+// has an empty record of type 0, which tells NXDOMAIN from NODATA and finds
+// the closest encloser of a wildcard.
+package cdbdns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Type is a DNS resource record type.
+type Type uint16
+
+// The record types a database can hold.
+const (
+	TypeA     Type = 1
+	TypeNS    Type = 2
+	TypeCNAME Type = 5
+	TypeSOA   Type = 6
+	TypeMX    Type = 15
+	TypeTXT   Type = 16
+	TypeAAAA  Type = 28
+
+	// typeExists marks a name that exists in a zone.
+	typeExists Type = 0
+	typeOPT    Type = 41
+	typeANY    Type = 255
+)
+
+// types maps the names of the supported types to their values.
+var types = map[string]Type{
+	"A":     TypeA,
+	"NS":    TypeNS,
+	"CNAME": TypeCNAME,
+	"SOA":   TypeSOA,
+	"MX":    TypeMX,
+	"TXT":   TypeTXT,
+	"AAAA":  TypeAAAA,
+}
+
+func (t Type) String() string {
+	for name, v := range types {
+		if v == t {
+			return name
+		}
+	}
+	return fmt.Sprintf("TYPE%d", uint16(t))
+}
+
+// classIN is the Internet class, the only one served.
+const classIN = 1
+
+// Response codes.
+const (
+	rcodeSuccess  = 0
+	rcodeFormErr  = 1
+	rcodeServFail = 2
+	rcodeNXDomain = 3
+	rcodeNotImp   = 4
+	rcodeRefused  = 5
+)
+
+const (
+	maxNameLength  = 255
+	maxLabelLength = 63
+)
+
+var (
+	errNameTooLong  = errors.New("name is longer than 255 bytes")
+	errLabelTooLong = errors.New("label is longer than 63 bytes")
+	errEmptyLabel   = errors.New("empty label")
+	errBadName      = errors.New("malformed name")
+)
+
+// encodeName converts a fully qualified name such as "www.example.com." to
+// lowercase wire format.
+func encodeName(name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return []byte{0}, nil
+	}
+	wire := make([]byte, 0, len(name)+2)
+	for _, label := range strings.Split(name, ".") {
+		if label == "" {
+			return nil, errEmptyLabel
+		}
+		if len(label) > maxLabelLength {
+			return nil, errLabelTooLong
+		}
+		wire = append(wire, byte(len(label)))
+		wire = append(wire, strings.ToLower(label)...)
+	}
+	wire = append(wire, 0)
+	if len(wire) > maxNameLength {
+		return nil, errNameTooLong
+	}
+	return wire, nil
+}
+
+// readName reads an uncompressed wire-format name at the start of b and
+// returns it and its length.
+func readName(b []byte) ([]byte, int, error) {
+	i := 0
+	for {
+		if i >= len(b) {
+			return nil, 0, errBadName
+		}
+		n := int(b[i])
+		if n == 0 {
+			i++
+			break
+		}
+		if n > maxLabelLength {
+			return nil, 0, errBadName
+		}
+		i += 1 + n
+		if i > maxNameLength {
+			return nil, 0, errNameTooLong
+		}
+	}
+	return b[:i], i, nil
+}
+
+// lowerName returns a lowercase copy of a wire-format name.
+func lowerName(name []byte) []byte {
+	lower := make([]byte, len(name))
+	for i := 0; i < len(name); {
+		n := int(name[i])
+		lower[i] = name[i]
+		for j := i + 1; j <= i+n && j < len(name); j++ {
+			c := name[j]
+			if 'A' <= c && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			lower[j] = c
+		}
+		i += 1 + n
+	}
+	return lower
+}
+
+// parent returns the name without its first label, or nil for the root.
+func parent(name []byte) []byte {
+	if len(name) <= 1 {
+		return nil
+	}
+	return name[1+int(name[0]):]
+}
+
+// wildcard returns the name *.name.
+func wildcard(name []byte) []byte {
+	return append([]byte{1, '*'}, name...)
+}
+
+// key returns the database key of the records of a type at a name.
+func key(name []byte, t Type) []byte {
+	k := make([]byte, len(name)+2)
+	copy(k, name)
+	binary.BigEndian.PutUint16(k[len(name):], uint16(t))
+	return k
+}
+
+// nameString converts a wire-format name to its presentation format.
+func nameString(name []byte) string {
+	if len(name) <= 1 {
+		return "."
+	}
+	var b strings.Builder
+	for i := 0; i < len(name) && name[i] != 0; i += 1 + int(name[i]) {
+		b.Write(name[i+1 : i+1+int(name[i])])
+		b.WriteByte('.')
+	}
+	return b.String()
+}
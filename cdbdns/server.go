@@ -0,0 +1,466 @@
+package cdbdns
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"net"
+	"time"
+
+	"github.com/perbu/cdb"
+	"github.com/perbu/cdb/internal/netserver"
+)
+
+// ErrServerClosed is returned by the Serve methods and ListenAndServe after
+// Close.
+var ErrServerClosed = netserver.ErrServerClosed
+
+const (
+	// maxUDPSize is the largest UDP response sent to EDNS clients, the size
+	// recommended to avoid fragmentation.
+	maxUDPSize = 1232
+	// maxCNAMEChain limits how many CNAME records are followed.
+	maxCNAMEChain = 8
+)
+
+// Reader is the read API a Server needs. *cdb.MmapCDB and *cdb.InMemoryCDB
+// implement it.
+type Reader interface {
+	// GetAll returns an iterator over the values of all records with the
+	// given key.
+	GetAll(key []byte) iter.Seq[[]byte]
+}
+
+// Server answers DNS queries from a database written by Compile. Configure
+// it by setting the exported fields before calling a Serve method.
+type Server struct {
+	// IdleTimeout closes TCP connections that have not sent a query for
+	// this long. If zero, 10 seconds are used.
+	IdleTimeout time.Duration
+
+	acquire func() (Reader, func(), error)
+	srv     netserver.Server
+}
+
+// New returns a Server for r. The server does not close r.
+func New(r Reader) *Server {
+	return &Server{acquire: func() (Reader, func(), error) {
+		return r, func() {}, nil
+	}}
+}
+
+// NewReloading returns a Server for the current database of r. Each query is
+// answered from the database that was current when it arrived.
+func NewReloading(r *cdb.Reloader) *Server {
+	return &Server{acquire: func() (Reader, func(), error) {
+		db, release, err := r.Acquire()
+		if err != nil {
+			return nil, nil, err
+		}
+		return db, release, nil
+	}}
+}
+
+// ListenAndServe serves queries over both UDP and TCP on address, returning
+// when either fails or after Close.
+func (s *Server) ListenAndServe(address string) error {
+	pc, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return fmt.Errorf("net.ListenPacket(%q): %w", address, err)
+	}
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		_ = pc.Close()
+		return fmt.Errorf("net.Listen(%q): %w", address, err)
+	}
+
+	errc := make(chan error, 2)
+	go func() { errc <- s.ServeUDP(pc) }()
+	go func() { errc <- s.ServeTCP(l) }()
+	err = <-errc
+	if !errors.Is(err, ErrServerClosed) {
+		_ = pc.Close()
+		_ = l.Close()
+	}
+	<-errc
+	return err
+}
+
+// ServeUDP answers queries received on pc until Close is called, after which
+// it returns ErrServerClosed. Responses that do not fit in 512 bytes, or in
+// the size announced with EDNS up to 1232 bytes, are truncated so that the
+// client retries over TCP. ServeUDP closes pc.
+func (s *Server) ServeUDP(pc net.PacketConn) error {
+	return s.srv.ServePacket(pc, func(packet []byte, addr net.Addr) {
+		if resp := s.respond(packet, false); resp != nil {
+			_, _ = pc.WriteTo(resp, addr)
+		}
+	})
+}
+
+// ServeTCP answers queries on connections accepted from l until Close is
+// called, after which it returns ErrServerClosed. ServeTCP closes l.
+func (s *Server) ServeTCP(l net.Listener) error {
+	return s.srv.Serve(l, s.serveConn)
+}
+
+// Close stops all listeners, closes all connections and waits for their
+// goroutines to return.
+func (s *Server) Close() error {
+	return s.srv.Close()
+}
+
+// serveConn answers length-prefixed queries on a TCP connection.
+func (s *Server) serveConn(nc net.Conn) {
+	timeout := s.IdleTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	r := bufio.NewReader(nc)
+	var buf []byte
+	for {
+		_ = nc.SetReadDeadline(time.Now().Add(timeout))
+		var length [2]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return
+		}
+		msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return
+		}
+		resp := s.respond(msg, true)
+		if resp == nil {
+			return
+		}
+		buf = binary.BigEndian.AppendUint16(buf[:0], uint16(len(resp)))
+		buf = append(buf, resp...)
+		if _, err := nc.Write(buf); err != nil {
+			return
+		}
+	}
+}
+
+// query is a parsed DNS query.
+type query struct {
+	id       uint16
+	flags    uint16
+	question []byte
+	qname    []byte
+	qtype    Type
+	qclass   uint16
+	edns     bool
+	udpSize  int
+}
+
+// rr is a resource record in a response.
+type rr struct {
+	name  []byte
+	typ   Type
+	ttl   uint32
+	rdata []byte
+}
+
+// response is the content of a response before it is encoded.
+type response struct {
+	rcode      int
+	aa         bool
+	answer     []rr
+	authority  []rr
+	additional []rr
+}
+
+// parseQuery parses the header and question of msg and the EDNS OPT record
+// that may follow. It returns false if msg is not a query worth answering.
+func parseQuery(msg []byte) (query, int, bool) {
+	var q query
+	if len(msg) < 12 {
+		return q, 0, false
+	}
+	q.id = binary.BigEndian.Uint16(msg)
+	q.flags = binary.BigEndian.Uint16(msg[2:])
+	if q.flags&0x8000 != 0 {
+		return q, 0, false
+	}
+	qdcount := binary.BigEndian.Uint16(msg[4:])
+	ancount := binary.BigEndian.Uint16(msg[6:])
+	nscount := binary.BigEndian.Uint16(msg[8:])
+	arcount := binary.BigEndian.Uint16(msg[10:])
+
+	if opcode := q.flags >> 11 & 0xf; opcode != 0 {
+		return q, rcodeNotImp, true
+	}
+	if qdcount != 1 {
+		return q, rcodeFormErr, true
+	}
+	name, n, err := readName(msg[12:])
+	if err != nil || len(msg) < 12+n+4 {
+		return q, rcodeFormErr, true
+	}
+	q.qname = name
+	q.qtype = Type(binary.BigEndian.Uint16(msg[12+n:]))
+	q.qclass = binary.BigEndian.Uint16(msg[14+n:])
+	q.question = msg[12 : 16+n]
+
+	// An OPT record is the only additional record a query has.
+	rest := msg[16+n:]
+	if arcount == 1 && ancount == 0 && nscount == 0 && len(rest) >= 11 &&
+		rest[0] == 0 && Type(binary.BigEndian.Uint16(rest[1:])) == typeOPT {
+		q.edns = true
+		q.udpSize = int(binary.BigEndian.Uint16(rest[3:]))
+	}
+	return q, rcodeSuccess, true
+}
+
+// respond returns the response to msg, or nil if it is not answered.
+func (s *Server) respond(msg []byte, tcp bool) []byte {
+	q, rcode, ok := parseQuery(msg)
+	if !ok {
+		return nil
+	}
+
+	var resp response
+	switch {
+	case rcode != rcodeSuccess:
+		resp.rcode = rcode
+	case q.qclass != classIN:
+		resp.rcode = rcodeRefused
+	case q.qtype == typeOPT || q.qtype == typeExists:
+		resp.rcode = rcodeFormErr
+	default:
+		db, release, err := s.acquire()
+		if err != nil {
+			resp.rcode = rcodeServFail
+			break
+		}
+		// The records point into the database, which must stay open
+		// until they have been encoded.
+		defer release()
+		resp = resolve(db, q.qname, q.qtype)
+	}
+
+	limit := 65535
+	if !tcp {
+		limit = 512
+		if q.edns {
+			limit = min(max(q.udpSize, 512), maxUDPSize)
+		}
+	}
+	return encode(q, resp, limit)
+}
+
+// encode encodes a response to q, truncating it to fit in limit bytes.
+func encode(q query, resp response, limit int) []byte {
+	flags := uint16(0x8000) | q.flags&0x7900 | uint16(resp.rcode)
+	if resp.aa {
+		flags |= 0x0400
+	}
+
+	build := func(flags uint16, sections ...[]rr) []byte {
+		b := make([]byte, 12, 512)
+		binary.BigEndian.PutUint16(b, q.id)
+		binary.BigEndian.PutUint16(b[2:], flags)
+		if q.question != nil {
+			binary.BigEndian.PutUint16(b[4:], 1)
+			b = append(b, q.question...)
+		}
+		for i, section := range sections {
+			binary.BigEndian.PutUint16(b[6+2*i:], uint16(len(section)))
+			for _, r := range section {
+				b = appendRR(b, r, q.qname)
+			}
+		}
+		if q.edns {
+			binary.BigEndian.PutUint16(b[10:], binary.BigEndian.Uint16(b[10:])+1)
+			b = append(b, 0, 0, byte(typeOPT), maxUDPSize>>8, maxUDPSize&0xff, 0, 0, 0, 0, 0, 0)
+		}
+		return b
+	}
+
+	b := build(flags, resp.answer, resp.authority, resp.additional)
+	if len(b) > limit {
+		b = build(flags, resp.answer, resp.authority)
+	}
+	if len(b) > limit {
+		b = build(flags | 0x0200)
+	}
+	return b
+}
+
+// appendRR appends r to b, with its name compressed to a pointer to the
+// question if it is qname.
+func appendRR(b []byte, r rr, qname []byte) []byte {
+	if qname != nil && bytes.Equal(r.name, qname) {
+		b = append(b, 0xc0, 12)
+	} else {
+		b = append(b, r.name...)
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(r.typ))
+	b = binary.BigEndian.AppendUint16(b, classIN)
+	b = binary.BigEndian.AppendUint32(b, r.ttl)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(r.rdata)))
+	return append(b, r.rdata...)
+}
+
+// records returns the records of type t at name, with owner as their name.
+func records(db Reader, name []byte, t Type, owner []byte) []rr {
+	var rrs []rr
+	for value := range db.GetAll(key(name, t)) {
+		if len(value) < 4 {
+			continue
+		}
+		rrs = append(rrs, rr{name: owner, typ: t, ttl: binary.BigEndian.Uint32(value), rdata: value[4:]})
+	}
+	return rrs
+}
+
+func exists(db Reader, name []byte) bool {
+	for range db.GetAll(key(name, typeExists)) {
+		return true
+	}
+	return false
+}
+
+// resolve answers a query for qname, whose case is kept in the answer, and
+// qtype.
+func resolve(db Reader, qname []byte, qtype Type) response {
+	var resp response
+	owner := qname
+	name := lowerName(qname)
+	for chain := 0; ; chain++ {
+		apex, soa := zoneOf(db, name)
+		if soa == nil {
+			if chain == 0 {
+				resp.rcode = rcodeRefused
+			}
+			return resp
+		}
+		resp.aa = true
+
+		if ns := delegation(db, name, apex); ns != nil {
+			if chain == 0 {
+				resp.aa = false
+			}
+			resp.authority = ns
+			resp.additional = glue(db, ns)
+			return resp
+		}
+
+		source := name
+		if !exists(db, name) {
+			source = wildcardFor(db, name, apex)
+			if source == nil {
+				resp.rcode = rcodeNXDomain
+				resp.authority = negative(soa)
+				return resp
+			}
+		}
+
+		if qtype != TypeCNAME {
+			if cname := records(db, source, TypeCNAME, owner); cname != nil {
+				resp.answer = append(resp.answer, cname[0])
+				if chain == maxCNAMEChain {
+					return resp
+				}
+				target, _, err := readName(cname[0].rdata)
+				if err != nil {
+					return resp
+				}
+				owner, name = target, target
+				continue
+			}
+		}
+
+		var answer []rr
+		if qtype == typeANY {
+			for _, t := range []Type{TypeSOA, TypeNS, TypeA, TypeAAAA, TypeMX, TypeTXT, TypeCNAME} {
+				answer = append(answer, records(db, source, t, owner)...)
+			}
+		} else {
+			answer = records(db, source, qtype, owner)
+		}
+		if answer == nil {
+			resp.authority = negative(soa)
+			return resp
+		}
+		resp.answer = append(resp.answer, answer...)
+		resp.additional = glue(db, answer)
+		return resp
+	}
+}
+
+// zoneOf returns the apex and SOA record of the zone holding name.
+func zoneOf(db Reader, name []byte) ([]byte, []rr) {
+	for n := name; n != nil; n = parent(n) {
+		if soa := records(db, n, TypeSOA, n); soa != nil {
+			return n, soa
+		}
+	}
+	return nil, nil
+}
+
+// delegation returns the NS records of the highest name between the apex,
+// exclusive, and name, inclusive, that has any.
+func delegation(db Reader, name, apex []byte) []rr {
+	var ns []rr
+	for n := name; n != nil && len(n) > len(apex); n = parent(n) {
+		if cut := records(db, n, TypeNS, n); cut != nil {
+			ns = cut
+		}
+	}
+	return ns
+}
+
+// wildcardFor returns the wildcard name that synthesizes records for name,
+// which does not exist: *.ce where ce is its closest existing ancestor.
+func wildcardFor(db Reader, name, apex []byte) []byte {
+	for n := parent(name); n != nil && len(n) >= len(apex); n = parent(n) {
+		if exists(db, n) {
+			w := wildcard(n)
+			if exists(db, w) {
+				return w
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// negative returns the SOA record for the authority section of a negative
+// answer, with the TTL capped by its minimum field as in RFC 2308.
+func negative(soa []rr) []rr {
+	r := soa[0]
+	if len(r.rdata) >= 4 {
+		r.ttl = min(r.ttl, binary.BigEndian.Uint32(r.rdata[len(r.rdata)-4:]))
+	}
+	return []rr{r}
+}
+
+// glue returns the A and AAAA records of the targets of the NS and MX
+// records among rrs that are in the database.
+func glue(db Reader, rrs []rr) []rr {
+	var additional []rr
+	for _, r := range rrs {
+		var target []byte
+		switch r.typ {
+		case TypeNS:
+			target = r.rdata
+		case TypeMX:
+			if len(r.rdata) > 2 {
+				target = r.rdata[2:]
+			}
+		default:
+			continue
+		}
+		target, _, err := readName(target)
+		if err != nil {
+			continue
+		}
+		additional = append(additional, records(db, target, TypeA, target)...)
+		additional = append(additional, records(db, target, TypeAAAA, target)...)
+	}
+	return additional
+}
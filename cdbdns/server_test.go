@@ -0,0 +1,345 @@
+package cdbdns_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/perbu/cdb"
+	"github.com/perbu/cdb/cdbdns"
+)
+
+const testZone = `$ORIGIN example.com.
+$TTL 3600
+@       SOA   ns1 hostmaster 2024010101 7200 3600 1209600 300
+@       NS    ns1
+@       MX    10 mail
+ns1     A     192.0.2.53
+www 300 A     192.0.2.1
+    300 A     192.0.2.2
+        AAAA  2001:db8::1
+mail    A     192.0.2.25
+alias   CNAME www
+ext     CNAME www.example.org.
+txt     TXT   "v=spf1 -all" second
+*.dev   A     192.0.2.99
+sub     NS    ns.sub
+ns.sub  A     192.0.2.54
+a.b.c   A     192.0.2.3 ; b.c is an empty non-terminal
+`
+
+func compile(t *testing.T, zone string) *cdb.InMemoryCDB {
+	t.Helper()
+	b := cdb.NewBuilder()
+	if err := cdbdns.Compile(strings.NewReader(zone), b.Writer); err != nil {
+		t.Fatal(err)
+	}
+	db, err := b.InMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// startServer serves zone over UDP and TCP on loopback.
+func startServer(t *testing.T, zone string) (udp, tcp string) {
+	t.Helper()
+	s := cdbdns.New(compile(t, zone))
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 2)
+	go func() { errc <- s.ServeUDP(pc) }()
+	go func() { errc <- s.ServeTCP(l) }()
+	t.Cleanup(func() {
+		if err := s.Close(); err != nil {
+			t.Error(err)
+		}
+		for range 2 {
+			if err := <-errc; !errors.Is(err, cdbdns.ErrServerClosed) {
+				t.Errorf("Serve = %v, want ErrServerClosed", err)
+			}
+		}
+	})
+	return pc.LocalAddr().String(), l.Addr().String()
+}
+
+func buildQuery(name string, qtype uint16, edns bool) []byte {
+	q := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		q = append(q, byte(len(label)))
+		q = append(q, label...)
+	}
+	q = append(q, 0)
+	q = binary.BigEndian.AppendUint16(q, qtype)
+	q = binary.BigEndian.AppendUint16(q, 1)
+	if edns {
+		q[11] = 1
+		q = append(q, 0, 0, 41, 0x10, 0x00, 0, 0, 0, 0, 0, 0)
+	}
+	return q
+}
+
+// reply is a decoded response, with records as "name TYPE ttl data".
+type reply struct {
+	rcode      int
+	aa, tc     bool
+	answer     []string
+	authority  []string
+	additional []string
+}
+
+// readName reads the name at msg[i], following a compression pointer, and
+// returns it and the offset after it.
+func readName(msg []byte, i int) (string, int) {
+	var labels []string
+	for msg[i] != 0 {
+		if msg[i]&0xc0 == 0xc0 {
+			rest, _ := readName(msg, int(binary.BigEndian.Uint16(msg[i:])&0x3fff))
+			return strings.Join(append(labels, rest), "."), i + 2
+		}
+		n := int(msg[i])
+		labels = append(labels, string(msg[i+1:i+1+n]))
+		i += 1 + n
+	}
+	return strings.Join(labels, ".") + ".", i + 1
+}
+
+func parseReply(t *testing.T, msg []byte) reply {
+	t.Helper()
+	if binary.BigEndian.Uint16(msg) != 0x1234 {
+		t.Fatalf("reply has ID %x", msg[:2])
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	r := reply{rcode: int(flags & 0xf), aa: flags&0x0400 != 0, tc: flags&0x0200 != 0}
+	_, i := readName(msg, 12)
+	i += 4
+	for s, section := range []*[]string{&r.answer, &r.authority, &r.additional} {
+		for range binary.BigEndian.Uint16(msg[6+2*s:]) {
+			name, j := readName(msg, i)
+			typ := binary.BigEndian.Uint16(msg[j:])
+			ttl := binary.BigEndian.Uint32(msg[j+4:])
+			rdata := msg[j+10 : j+10+int(binary.BigEndian.Uint16(msg[j+8:]))]
+			i = j + 10 + len(rdata)
+			if typ == 41 {
+				continue
+			}
+			var data string
+			switch typ {
+			case 1, 28:
+				addr, _ := netip.AddrFromSlice(rdata)
+				data = addr.String()
+			case 2, 5:
+				data, _ = readName(rdata, 0)
+			case 6:
+				data, _ = readName(rdata, 0)
+			case 15:
+				target, _ := readName(rdata, 2)
+				data = fmt.Sprintf("%d %s", binary.BigEndian.Uint16(rdata), target)
+			case 16:
+				data = fmt.Sprintf("%q", rdata)
+			}
+			*section = append(*section, fmt.Sprintf("%s %s %d %s", name, cdbdns.Type(typ), ttl, data))
+		}
+	}
+	return r
+}
+
+func exchangeUDP(t *testing.T, addr string, query []byte) reply {
+	t.Helper()
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(query); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 65536)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parseReply(t, buf[:n])
+}
+
+func exchangeTCP(t *testing.T, addr string, query []byte) reply {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)); err != nil {
+		t.Fatal(err)
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		t.Fatal(err)
+	}
+	return parseReply(t, msg)
+}
+
+func TestServer(t *testing.T) {
+	udp, tcp := startServer(t, testZone)
+	soa := []string{"example.com. SOA 300 ns1.example.com."}
+
+	tests := []struct {
+		name  string
+		qtype cdbdns.Type
+		want  reply
+	}{
+		{"www.example.com", cdbdns.TypeA, reply{aa: true, answer: []string{
+			"www.example.com. A 300 192.0.2.1",
+			"www.example.com. A 300 192.0.2.2",
+		}}},
+		{"WWW.Example.COM", cdbdns.TypeAAAA, reply{aa: true, answer: []string{
+			"WWW.Example.COM. AAAA 3600 2001:db8::1",
+		}}},
+		{"www.example.com", cdbdns.TypeMX, reply{aa: true, authority: soa}},
+		{"nope.example.com", cdbdns.TypeA, reply{rcode: 3, aa: true, authority: soa}},
+		{"alias.example.com", cdbdns.TypeA, reply{aa: true, answer: []string{
+			"alias.example.com. CNAME 3600 www.example.com.",
+			"www.example.com. A 300 192.0.2.1",
+			"www.example.com. A 300 192.0.2.2",
+		}}},
+		{"alias.example.com", cdbdns.TypeCNAME, reply{aa: true, answer: []string{
+			"alias.example.com. CNAME 3600 www.example.com.",
+		}}},
+		{"ext.example.com", cdbdns.TypeA, reply{aa: true, answer: []string{
+			"ext.example.com. CNAME 3600 www.example.org.",
+		}}},
+		{"example.com", cdbdns.TypeMX, reply{aa: true,
+			answer:     []string{"example.com. MX 3600 10 mail.example.com."},
+			additional: []string{"mail.example.com. A 3600 192.0.2.25"},
+		}},
+		{"example.com", cdbdns.TypeNS, reply{aa: true,
+			answer:     []string{"example.com. NS 3600 ns1.example.com."},
+			additional: []string{"ns1.example.com. A 3600 192.0.2.53"},
+		}},
+		{"txt.example.com", cdbdns.TypeTXT, reply{aa: true, answer: []string{
+			`txt.example.com. TXT 3600 "\vv=spf1 -all\x06second"`,
+		}}},
+		{"host.dev.example.com", cdbdns.TypeA, reply{aa: true, answer: []string{
+			"host.dev.example.com. A 3600 192.0.2.99",
+		}}},
+		{"a.b.dev.example.com", cdbdns.TypeA, reply{aa: true, answer: []string{
+			"a.b.dev.example.com. A 3600 192.0.2.99",
+		}}},
+		{"host.dev.example.com", cdbdns.TypeAAAA, reply{aa: true, authority: soa}},
+		{"dev.example.com", cdbdns.TypeA, reply{aa: true, authority: soa}},
+		{"b.c.example.com", cdbdns.TypeA, reply{aa: true, authority: soa}},
+		{"x.b.c.example.com", cdbdns.TypeA, reply{rcode: 3, aa: true, authority: soa}},
+		{"host.sub.example.com", cdbdns.TypeA, reply{
+			authority:  []string{"sub.example.com. NS 3600 ns.sub.example.com."},
+			additional: []string{"ns.sub.example.com. A 3600 192.0.2.54"},
+		}},
+		{"www.example.org", cdbdns.TypeA, reply{rcode: 5}},
+	}
+	transports := []struct {
+		name     string
+		addr     string
+		exchange func(*testing.T, string, []byte) reply
+	}{
+		{"udp", udp, exchangeUDP},
+		{"tcp", tcp, exchangeTCP},
+	}
+	for _, tt := range tests {
+		for _, tr := range transports {
+			got := tr.exchange(t, tr.addr, buildQuery(tt.name, uint16(tt.qtype), false))
+			// The SOA data is checked up to its first name only.
+			for i, r := range got.authority {
+				if strings.Contains(r, " SOA ") {
+					got.authority[i] = r[:strings.Index(r, "ns1.example.com.")+len("ns1.example.com.")]
+				}
+			}
+			if !equal(got, tt.want) {
+				t.Errorf("%s %s over %s = %+v, want %+v", tt.name, tt.qtype, tr.name, got, tt.want)
+			}
+		}
+	}
+}
+
+func equal(a, b reply) bool {
+	return a.rcode == b.rcode && a.aa == b.aa && a.tc == b.tc &&
+		slices.Equal(a.answer, b.answer) && slices.Equal(a.authority, b.authority) &&
+		slices.Equal(a.additional, b.additional)
+}
+
+func TestServerTruncation(t *testing.T) {
+	var zone strings.Builder
+	zone.WriteString("example.com. SOA ns.example.com. hostmaster.example.com. 1 2 3 4 5\n")
+	for i := range 40 {
+		fmt.Fprintf(&zone, "big.example.com. A 10.0.0.%d\n", i)
+	}
+	udp, tcp := startServer(t, zone.String())
+
+	if r := exchangeUDP(t, udp, buildQuery("big.example.com", 1, false)); !r.tc || len(r.answer) != 0 {
+		t.Errorf("UDP reply has TC=%v and %d answers, want a truncated reply", r.tc, len(r.answer))
+	}
+	if r := exchangeUDP(t, udp, buildQuery("big.example.com", 1, true)); r.tc || len(r.answer) != 40 {
+		t.Errorf("UDP reply with EDNS has TC=%v and %d answers, want 40", r.tc, len(r.answer))
+	}
+	if r := exchangeTCP(t, tcp, buildQuery("big.example.com", 1, false)); r.tc || len(r.answer) != 40 {
+		t.Errorf("TCP reply has TC=%v and %d answers, want 40", r.tc, len(r.answer))
+	}
+}
+
+func TestServerRootOrigin(t *testing.T) {
+	zone := "$ORIGIN .\n" +
+		"example.com SOA ns1.example.com hostmaster.example.com 1 2 3 4 5\n" +
+		"www.example.com A 192.0.2.1\n" +
+		"$ORIGIN example.com.\n" +
+		"alias CNAME www\n"
+	udp, _ := startServer(t, zone)
+
+	r := exchangeUDP(t, udp, buildQuery("alias.example.com", 1, false))
+	want := reply{aa: true, answer: []string{
+		"alias.example.com. CNAME 86400 www.example.com.",
+		"www.example.com. A 86400 192.0.2.1",
+	}}
+	if !equal(r, want) {
+		t.Errorf("alias.example.com A: got %+v, want %+v", r, want)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		zone string
+		line int
+	}{
+		{"example.com. SOA ns.example.com. hm.example.com. 1 2 3 4 5\nwww.example.com. A 192.0.2.300\n", 2},
+		{"example.com. SOA ns.example.com. hm.example.com. 1 2 3 4 5\nwww.example.com. A 2001:db8::1\n", 2},
+		{"www A 192.0.2.1\n", 1},
+		{"example.com. SOA ns.example.com. hm.example.com. 1 2 3 4 5\nwww.example.com. CNAME x.example.com.\nwww.example.com. A 192.0.2.1\n", 2},
+		{"example.com. SOA ns.example.com. hm.example.com. 1 2 3 4 5\nwww.example.org. A 192.0.2.1\n", 2},
+		{"example.com. SOA ns.example.com. hm.example.com. 1 2 3 4 5\nexample.com. SOA ns.example.com. hm.example.com. 1 2 3 4 5\n", 2},
+		{"$ORIGIN example.com.\n@ SOA ns hm 1 2 3 4 5\n@ SRV 1 2 3 x\n", 3},
+		{"$ORIGIN example.com.\n@ SOA ( ns hm 1 2 3 4 5 )\n", 2},
+	}
+	for _, tt := range tests {
+		err := cdbdns.Compile(strings.NewReader(tt.zone), cdb.NewBuilder().Writer)
+		var importErr *cdb.ImportError
+		if !errors.As(err, &importErr) || importErr.Line != tt.line {
+			t.Errorf("Compile(%q) = %v, want an error on line %d", tt.zone, err, tt.line)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package cdbdns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/perbu/cdb"
+)
+
+// DefaultTTL is the TTL of records that have none, before any $TTL
+// directive.
+const DefaultTTL = 86400
+
+// record is a resource record parsed from a zone description.
+type record struct {
+	name   []byte
+	typ    Type
+	ttl    uint32
+	rdata  []byte
+	line   int
+	offset int64
+}
+
+// Compile reads a zone description from r and adds its records, and the
+// markers of the names that exist, to w, which is not finalized.
+//
+// The description is a simplified master file: one record per line, as
+//
+//	name [ttl] [IN] type rdata...
+//
+// where type is A, AAAA, CNAME, MX, NS, SOA or TXT and rdata is written as
+// in a master file, for example "10 mail" for MX and the seven fields of
+// SOA on one line. A name ending in a dot is absolute, @ stands for the
+// origin set by $ORIGIN, other names are relative to it, and a line starting
+// with white space continues the previous name. $TTL sets the TTL of the
+// records that follow. TXT strings may be quoted, and strings longer than
+// 255 bytes are split. Comments start with a semicolon; parentheses and
+// $INCLUDE are not supported.
+//
+// Every record must be in a zone, that is at or below a name with an SOA
+// record, and a name with a CNAME record can have no other records. Errors
+// are reported as *cdb.ImportError, whose Offset is the start of the line.
+func Compile(r io.Reader, w *cdb.Writer) error {
+	p := &zoneParser{ttl: DefaultTTL}
+	br := bufio.NewReader(r)
+	var offset int64
+	for {
+		line, err := br.ReadString('\n')
+		if len(line) > 0 {
+			p.line++
+			p.offset = offset
+			if perr := p.parseLine(line); perr != nil {
+				return &cdb.ImportError{Line: p.line, Offset: offset, Err: perr}
+			}
+			offset += int64(len(line))
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read: %w", err)
+		}
+	}
+
+	names, err := p.check()
+	if err != nil {
+		return err
+	}
+	for _, rr := range p.records {
+		value := make([]byte, 4+len(rr.rdata))
+		binary.BigEndian.PutUint32(value, rr.ttl)
+		copy(value[4:], rr.rdata)
+		if err := w.Put(key(rr.name, rr.typ), value); err != nil {
+			return err
+		}
+	}
+	for _, name := range names {
+		if err := w.Put(key([]byte(name), typeExists), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type zoneParser struct {
+	origin  []byte
+	ttl     uint32
+	owner   []byte
+	line    int
+	offset  int64
+	records []record
+}
+
+func (p *zoneParser) parseLine(line string) error {
+	fields, err := tokenize(line)
+	if err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	switch fields[0] {
+	case "$ORIGIN":
+		if len(fields) != 2 || !strings.HasSuffix(fields[1], ".") {
+			return errors.New("$ORIGIN needs one absolute name")
+		}
+		origin, err := encodeName(fields[1])
+		if err != nil {
+			return fmt.Errorf("$ORIGIN %s: %w", fields[1], err)
+		}
+		p.origin = origin
+		return nil
+	case "$TTL":
+		if len(fields) != 2 {
+			return errors.New("$TTL needs one value")
+		}
+		ttl, err := strconv.ParseUint(fields[1], 10, 31)
+		if err != nil {
+			return fmt.Errorf("invalid TTL %q", fields[1])
+		}
+		p.ttl = uint32(ttl)
+		return nil
+	}
+	if strings.HasPrefix(fields[0], "$") {
+		return fmt.Errorf("unsupported directive %s", fields[0])
+	}
+
+	owner := p.owner
+	if line[0] != ' ' && line[0] != '\t' {
+		if owner, err = p.name(fields[0]); err != nil {
+			return err
+		}
+		fields = fields[1:]
+	} else if owner == nil {
+		return errors.New("no previous name to continue")
+	}
+	p.owner = owner
+
+	ttl := p.ttl
+	for len(fields) > 0 {
+		if strings.EqualFold(fields[0], "IN") {
+			fields = fields[1:]
+			continue
+		}
+		n, err := strconv.ParseUint(fields[0], 10, 31)
+		if err != nil {
+			break
+		}
+		ttl = uint32(n)
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return errors.New("missing type")
+	}
+	typ, ok := types[strings.ToUpper(fields[0])]
+	if !ok {
+		return fmt.Errorf("unsupported type %s", fields[0])
+	}
+	rdata, err := p.rdata(typ, fields[1:])
+	if err != nil {
+		return fmt.Errorf("%s: %w", typ, err)
+	}
+
+	p.records = append(p.records, record{
+		name:   owner,
+		typ:    typ,
+		ttl:    ttl,
+		rdata:  rdata,
+		line:   p.line,
+		offset: p.offset,
+	})
+	return nil
+}
+
+// name resolves a name relative to the origin.
+func (p *zoneParser) name(s string) ([]byte, error) {
+	var name []byte
+	var err error
+	switch {
+	case s == "@":
+		name = p.origin
+	case strings.HasSuffix(s, "."):
+		name, err = encodeName(s)
+	case len(p.origin) == 1:
+		// The root origin; nameString would add a second dot.
+		name, err = encodeName(s + ".")
+	case p.origin != nil:
+		name, err = encodeName(s + "." + nameString(p.origin))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("name %q: %w", s, err)
+	}
+	if name == nil {
+		return nil, fmt.Errorf("relative name %q without $ORIGIN", s)
+	}
+	return name, nil
+}
+
+// rdata encodes the data of a record of type typ.
+func (p *zoneParser) rdata(typ Type, fields []string) ([]byte, error) {
+	want := map[Type]int{TypeA: 1, TypeAAAA: 1, TypeCNAME: 1, TypeNS: 1, TypeMX: 2, TypeSOA: 7}[typ]
+	if typ == TypeTXT {
+		if len(fields) == 0 {
+			return nil, errors.New("missing text")
+		}
+	} else if len(fields) != want {
+		return nil, fmt.Errorf("want %d fields, got %d", want, len(fields))
+	}
+
+	switch typ {
+	case TypeA, TypeAAAA:
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil || addr.Is4() != (typ == TypeA) || addr.Zone() != "" {
+			return nil, fmt.Errorf("invalid address %q", fields[0])
+		}
+		return addr.AsSlice(), nil
+	case TypeCNAME, TypeNS:
+		return p.name(fields[0])
+	case TypeMX:
+		pref, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid preference %q", fields[0])
+		}
+		target, err := p.name(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		return append(binary.BigEndian.AppendUint16(nil, uint16(pref)), target...), nil
+	case TypeSOA:
+		mname, err := p.name(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		rname, err := p.name(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		rdata := append(slices.Clone(mname), rname...)
+		for _, f := range fields[2:] {
+			n, err := strconv.ParseUint(f, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q", f)
+			}
+			rdata = binary.BigEndian.AppendUint32(rdata, uint32(n))
+		}
+		return rdata, nil
+	case TypeTXT:
+		var rdata []byte
+		for _, f := range fields {
+			for {
+				chunk := f[:min(len(f), 255)]
+				rdata = append(rdata, byte(len(chunk)))
+				rdata = append(rdata, chunk...)
+				f = f[len(chunk):]
+				if len(f) == 0 {
+					break
+				}
+			}
+		}
+		if len(rdata) > 65535 {
+			return nil, errors.New("text too long")
+		}
+		return rdata, nil
+	}
+	return nil, fmt.Errorf("unsupported type %s", typ)
+}
+
+// tokenize splits a line into fields, honoring double quotes with \" and \\
+// escapes, and drops comments.
+func tokenize(line string) ([]string, error) {
+	var fields []string
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch {
+		case c == ';':
+			return fields, nil
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '(' || c == ')':
+			return nil, errors.New("parentheses are not supported")
+		case c == '"':
+			var b strings.Builder
+			i++
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+				}
+				b.WriteByte(line[i])
+			}
+			if i == len(line) {
+				return nil, errors.New("unterminated string")
+			}
+			i++
+			fields = append(fields, b.String())
+		default:
+			start := i
+			for i < len(line) && !strings.ContainsRune(" \t\r\n;", rune(line[i])) {
+				i++
+			}
+			fields = append(fields, line[start:i])
+		}
+	}
+	return fields, nil
+}
+
+// check validates the records and returns the names that exist, in order.
+func (p *zoneParser) check() ([]string, error) {
+	apexes := make(map[string]bool)
+	for _, rr := range p.records {
+		if rr.typ == TypeSOA {
+			if apexes[string(rr.name)] {
+				return nil, p.errorf(rr, "second SOA record for %s", nameString(rr.name))
+			}
+			apexes[string(rr.name)] = true
+		}
+	}
+
+	typesAt := make(map[string][]Type)
+	for _, rr := range p.records {
+		typesAt[string(rr.name)] = append(typesAt[string(rr.name)], rr.typ)
+	}
+
+	exists := make(map[string]bool)
+	for _, rr := range p.records {
+		at := typesAt[string(rr.name)]
+		if slices.Contains(at, TypeCNAME) && (rr.typ != TypeCNAME || len(at) > 1) {
+			return nil, p.errorf(rr, "%s has a CNAME record and other records", nameString(rr.name))
+		}
+
+		var names []string
+		inZone := false
+		for name := rr.name; name != nil; name = parent(name) {
+			names = append(names, string(name))
+			if apexes[string(name)] {
+				inZone = true
+				break
+			}
+		}
+		if !inZone {
+			return nil, p.errorf(rr, "%s is not in a zone with an SOA record", nameString(rr.name))
+		}
+		for _, name := range names {
+			exists[name] = true
+		}
+	}
+
+	names := make([]string, 0, len(exists))
+	for name := range exists {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+func (p *zoneParser) errorf(rr record, format string, args ...any) error {
+	return &cdb.ImportError{Line: rr.line, Offset: rr.offset, Err: fmt.Errorf(format, args...)}
+}
@@ -0,0 +1,345 @@
+// Package cdbhttp serves a CDB database over HTTP, read-only.
+//
+// A Handler serves these endpoints:
+//
+//	GET|HEAD /kv/{key}             the value of key, or 404
+//	GET      /mget?key=a&key=b     the values of several keys as a JSON array
+//	POST     /mget                 the same, for a JSON array of keys
+//	GET      /dump[?limit=n]       the records as JSON Lines, a page at a time
+//
+// Values are written straight from the memory-mapped file. Responses carry an
+// ETag derived from the identity of the file, so that clients can revalidate
+// with If-None-Match and detect with If-Match that the database was reloaded
+// while they were paging through /dump.
+package cdbhttp
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"unicode/utf8"
+
+	"github.com/perbu/cdb"
+)
+
+// DefaultMaxKeys is the number of keys a multi-get request may ask for if
+// Handler.MaxKeys is zero.
+const DefaultMaxKeys = 1000
+
+// NextCursorTrailer is the trailer holding the cursor of the next page of a
+// /dump request, if there is one.
+const NextCursorTrailer = "Cdb-Next-Cursor"
+
+// Handler is an http.Handler for a database. Configure it by setting the
+// exported fields before serving the first request.
+type Handler struct {
+	// MaxKeys limits the number of keys in a multi-get request. If zero,
+	// DefaultMaxKeys is used.
+	MaxKeys int
+	// DisableDump makes /dump return 404.
+	DisableDump bool
+
+	acquire func() (cdb.Reader, string, func(), error)
+	mux     *http.ServeMux
+}
+
+// New returns a Handler for r. If r is a *cdb.MmapCDB, responses carry an
+// ETag; other readers are served without one. The handler does not close r.
+func New(r cdb.Reader) *Handler {
+	etag := ""
+	if db, ok := r.(*cdb.MmapCDB); ok {
+		etag = etagOf(db)
+	}
+	return newHandler(func() (cdb.Reader, string, func(), error) {
+		return r, etag, func() {}, nil
+	})
+}
+
+// NewReloading returns a Handler for the current database of r. Each request
+// is served from the database that was current when it started, which stays
+// open until the response has been written.
+func NewReloading(r *cdb.Reloader) *Handler {
+	return newHandler(func() (cdb.Reader, string, func(), error) {
+		db, release, err := r.Acquire()
+		if err != nil {
+			return nil, "", nil, err
+		}
+		return db, etagOf(db), release, nil
+	})
+}
+
+func newHandler(acquire func() (cdb.Reader, string, func(), error)) *Handler {
+	h := &Handler{acquire: acquire, mux: http.NewServeMux()}
+	h.mux.HandleFunc("GET /kv/{key...}", h.get)
+	h.mux.HandleFunc("GET /mget", h.mget)
+	h.mux.HandleFunc("POST /mget", h.mget)
+	h.mux.HandleFunc("GET /dump", h.dump)
+	return h
+}
+
+// ServeHTTP dispatches the request to the endpoint matching its path.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.mux.ServeHTTP(w, req)
+}
+
+// etagOf returns a strong ETag from the device, inode, size and modification
+// time of the file of db, which change whenever a new version is renamed
+// over it.
+func etagOf(db *cdb.MmapCDB) string {
+	info, err := db.Stat()
+	if err != nil {
+		return ""
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return fmt.Sprintf(`"%x-%x-%x-%x"`, st.Dev, st.Ino, info.Size(), info.ModTime().UnixNano())
+	}
+	return fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano())
+}
+
+// matches reports whether an If-None-Match or If-Match header lists etag.
+func matches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Handler) get(w http.ResponseWriter, req *http.Request) {
+	db, etag, release, err := h.acquire()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	value, err := db.Get([]byte(req.PathValue("key")))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if value == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	header := w.Header()
+	if etag != "" {
+		header.Set("ETag", etag)
+		if inm := req.Header.Get("If-None-Match"); inm != "" && matches(inm, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Content-Length", strconv.Itoa(len(value)))
+	if req.Method == http.MethodHead {
+		return
+	}
+	_, _ = w.Write(value)
+}
+
+// record is a key and, if it was found, its value, encoded like
+// cdb.ExportJSONL encodes records.
+type record struct {
+	Key         *string `json:"key,omitempty"`
+	KeyBase64   *string `json:"key_base64,omitempty"`
+	Value       *string `json:"value,omitempty"`
+	ValueBase64 *string `json:"value_base64,omitempty"`
+}
+
+func newRecord(key, value []byte, found bool) record {
+	var rec record
+	rec.Key, rec.KeyBase64 = encode(key)
+	if found {
+		rec.Value, rec.ValueBase64 = encode(value)
+	}
+	return rec
+}
+
+// encode returns b as a string if it is valid UTF-8, or as base64 otherwise.
+func encode(b []byte) (*string, *string) {
+	s := string(b)
+	if utf8.ValidString(s) {
+		return &s, nil
+	}
+	s = base64.StdEncoding.EncodeToString(b)
+	return nil, &s
+}
+
+// mget looks up the keys given as repeated key parameters or, for POST, as
+// a JSON array of strings, and responds with a JSON array holding a record
+// for each key in the same order. Keys that were not found have no value.
+func (h *Handler) mget(w http.ResponseWriter, req *http.Request) {
+	maxKeys := h.MaxKeys
+	if maxKeys == 0 {
+		maxKeys = DefaultMaxKeys
+	}
+
+	var keys []string
+	if req.Method == http.MethodPost {
+		dec := json.NewDecoder(http.MaxBytesReader(w, req.Body, 1<<20))
+		if err := dec.Decode(&keys); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+	} else {
+		keys = req.URL.Query()["key"]
+	}
+	if len(keys) > maxKeys {
+		http.Error(w, fmt.Sprintf("too many keys: %d > %d", len(keys), maxKeys), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	db, etag, release, err := h.acquire()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	records := make([]record, 0, len(keys))
+	for _, key := range keys {
+		value, err := db.Get([]byte(key))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		records = append(records, newRecord([]byte(key), value, value != nil))
+	}
+
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(records)
+}
+
+// recordReader is implemented by readers whose records can be addressed by
+// offset, which /dump uses as its cursor.
+type recordReader interface {
+	RecordAt(offset uint64) (key, value []byte, next uint64, err error)
+}
+
+// dump streams the records in write order as JSON Lines. With a limit, at
+// most limit records are written, starting at the opaque cursor parameter,
+// and the NextCursorTrailer trailer holds the cursor of the next page, or is
+// empty after the last one. Clients paging through a database that may be
+// reloaded send the ETag of the first page in If-Match, and get 412 once
+// the database has changed.
+//
+// For readers with RecordAt, the cursor is the offset of the next record, so
+// each page resumes where the last one ended. Other readers count the
+// records to skip.
+func (h *Handler) dump(w http.ResponseWriter, req *http.Request) {
+	if h.DisableDump {
+		http.NotFound(w, req)
+		return
+	}
+
+	query := req.URL.Query()
+	var cursor uint64
+	var limit int
+	var err error
+	if s := query.Get("cursor"); s != "" {
+		if cursor, err = strconv.ParseUint(s, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("invalid cursor %q", s), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := query.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			http.Error(w, fmt.Sprintf("invalid limit %q", s), http.StatusBadRequest)
+			return
+		}
+	}
+
+	db, etag, release, err := h.acquire()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	header := w.Header()
+	if etag != "" {
+		header.Set("ETag", etag)
+	}
+	if im := req.Header.Get("If-Match"); im != "" && (etag == "" || !matches(im, etag)) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	rr, ok := db.(recordReader)
+	if ok && cursor != 0 {
+		// Check the cursor before the response is committed.
+		if _, _, _, err := rr.RecordAt(cursor); err != nil {
+			http.Error(w, fmt.Sprintf("invalid cursor %q", query.Get("cursor")), http.StatusBadRequest)
+			return
+		}
+	}
+
+	header.Set("Content-Type", "application/jsonl")
+	if limit > 0 {
+		header.Set("Trailer", NextCursorTrailer)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	var next string
+	if ok {
+		next = dumpRecords(enc, rr, cursor, limit)
+	} else {
+		next = dumpAll(enc, db, cursor, limit)
+	}
+	if limit > 0 {
+		header.Set(NextCursorTrailer, next)
+	}
+}
+
+// dumpRecords writes up to limit records, or all if limit is 0, starting
+// at offset, and returns the cursor of the next page.
+func dumpRecords(enc *json.Encoder, rr recordReader, offset uint64, limit int) string {
+	for written := 0; limit == 0 || written < limit; written++ {
+		key, value, next, err := rr.RecordAt(offset)
+		if err != nil {
+			// io.EOF for an empty database; the cursor was checked.
+			return ""
+		}
+		if err := enc.Encode(newRecord(key, value, true)); err != nil || next == 0 {
+			return ""
+		}
+		offset = next
+	}
+	return strconv.FormatUint(offset, 10)
+}
+
+// dumpAll writes up to limit records, or all if limit is 0, after skipping
+// skip records, and returns the cursor of the next page.
+func dumpAll(enc *json.Encoder, db cdb.Reader, skip uint64, limit int) string {
+	var i uint64
+	written := 0
+	for key, value := range db.All() {
+		if i < skip {
+			i++
+			continue
+		}
+		if limit > 0 && written == limit {
+			return strconv.FormatUint(i, 10)
+		}
+		if err := enc.Encode(newRecord(key, value, true)); err != nil {
+			return ""
+		}
+		i++
+		written++
+	}
+	return ""
+}
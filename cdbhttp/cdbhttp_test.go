@@ -0,0 +1,210 @@
+package cdbhttp_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/perbu/cdb"
+	"github.com/perbu/cdb/cdbhttp"
+)
+
+func writeDB(t *testing.T, path string, records ...string) {
+	t.Helper()
+	w, err := cdb.CreateAtomic(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(records); i += 2 {
+		if err := w.Put([]byte(records[i]), []byte(records[i+1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func do(t *testing.T, srv *httptest.Server, method, path, body string, header ...string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(b)
+}
+
+func TestHandler(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.cdb")
+	writeDB(t, path, "a", "1", "dir/b", "two", "bin", "\xff", "empty", "")
+	db, err := cdb.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	srv := httptest.NewServer(cdbhttp.New(db))
+	defer srv.Close()
+
+	tests := []struct {
+		method, path string
+		status       int
+		body         string
+	}{
+		{"GET", "/kv/a", http.StatusOK, "1"},
+		{"GET", "/kv/dir/b", http.StatusOK, "two"},
+		{"GET", "/kv/dir%2Fb", http.StatusOK, "two"},
+		{"GET", "/kv/empty", http.StatusOK, ""},
+		{"HEAD", "/kv/a", http.StatusOK, ""},
+		{"GET", "/kv/missing", http.StatusNotFound, "404 page not found\n"},
+		{"PUT", "/kv/a", http.StatusMethodNotAllowed, "Method Not Allowed\n"},
+		{"GET", "/mget?key=a&key=missing&key=bin", http.StatusOK,
+			`[{"key":"a","value":"1"},{"key":"missing"},{"key":"bin","value_base64":"/w=="}]` + "\n"},
+		{"GET", "/dump?limit=0", http.StatusBadRequest, "invalid limit \"0\"\n"},
+	}
+	for _, tt := range tests {
+		resp, body := do(t, srv, tt.method, tt.path, "")
+		if resp.StatusCode != tt.status || body != tt.body {
+			t.Errorf("%s %s = %d %q, want %d %q", tt.method, tt.path, resp.StatusCode, body, tt.status, tt.body)
+		}
+	}
+
+	resp, _ := do(t, srv, "HEAD", "/kv/dir/b", "")
+	etag := resp.Header.Get("ETag")
+	if etag == "" || resp.ContentLength != 3 {
+		t.Fatalf("HEAD has ETag %q and length %d", etag, resp.ContentLength)
+	}
+	if resp, _ := do(t, srv, "GET", "/kv/a", "", "If-None-Match", etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("GET with matching If-None-Match = %d, want 304", resp.StatusCode)
+	}
+
+	_, body := do(t, srv, "POST", "/mget", `["dir/b", "a"]`)
+	if want := `[{"key":"dir/b","value":"two"},{"key":"a","value":"1"}]` + "\n"; body != want {
+		t.Errorf("POST /mget = %q, want %q", body, want)
+	}
+	h := cdbhttp.New(db)
+	h.MaxKeys = 1
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/mget?key=a&key=b", nil))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("mget over MaxKeys = %d, want 413", rec.Code)
+	}
+}
+
+func TestHandlerDump(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.cdb")
+	writeDB(t, path, "a", "1", "b", "2", "c", "3")
+	db, err := cdb.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	srv := httptest.NewServer(cdbhttp.New(db))
+	defer srv.Close()
+
+	want := `{"key":"a","value":"1"}
+{"key":"b","value":"2"}
+{"key":"c","value":"3"}
+`
+	if _, all := do(t, srv, "GET", "/dump", ""); all != want {
+		t.Errorf("dump = %q, want %q", all, want)
+	}
+	// The cursor of the second page is the offset of its first record.
+	_, _, second, _ := db.RecordAt(0)
+	_, _, third, _ := db.RecordAt(second)
+	paged, cursors := dumpPages(t, srv)
+	if paged != want {
+		t.Errorf("paged dump = %q, want %q", paged, want)
+	}
+	if want := []string{"", strconv.FormatUint(third, 10)}; !slices.Equal(cursors, want) {
+		t.Errorf("dump cursors = %q, want %q", cursors, want)
+	}
+
+	// An offset inside a record is not a cursor.
+	for _, cursor := range []string{strconv.FormatUint(second+1, 10), "1", "-1", "x"} {
+		resp, body := do(t, srv, "GET", "/dump?limit=2&cursor="+cursor, "")
+		if resp.StatusCode != http.StatusBadRequest || body != fmt.Sprintf("invalid cursor %q\n", cursor) {
+			t.Errorf("dump with cursor %s = %d %q, want 400", cursor, resp.StatusCode, body)
+		}
+	}
+
+	if resp, _ := do(t, srv, "GET", "/dump", "", "If-Match", `"stale"`); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("dump with a stale If-Match = %d, want 412", resp.StatusCode)
+	}
+
+	// Readers without RecordAt are paged by counting records.
+	srv = httptest.NewServer(cdbhttp.New(struct{ cdb.Reader }{db}))
+	defer srv.Close()
+	if paged, _ := dumpPages(t, srv); paged != want {
+		t.Errorf("paged dump without RecordAt = %q, want %q", paged, want)
+	}
+}
+
+// dumpPages reads /dump two records at a time and returns the records and
+// the cursors of the pages.
+func dumpPages(t *testing.T, srv *httptest.Server) (string, []string) {
+	t.Helper()
+	var pages strings.Builder
+	cursors := []string{""}
+	for {
+		resp, body := do(t, srv, "GET", "/dump?limit=2&cursor="+cursors[len(cursors)-1], "")
+		pages.WriteString(body)
+		cursor := resp.Trailer.Get(cdbhttp.NextCursorTrailer)
+		if cursor == "" {
+			return pages.String(), cursors
+		}
+		cursors = append(cursors, cursor)
+		if len(cursors) > 3 {
+			t.Fatal("dump does not terminate")
+		}
+	}
+}
+
+func TestHandlerReloading(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.cdb")
+	writeDB(t, path, "version", "1")
+	r, err := cdb.OpenReloader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	srv := httptest.NewServer(cdbhttp.NewReloading(r))
+	defer srv.Close()
+
+	resp, body := do(t, srv, "GET", "/kv/version", "")
+	etag := resp.Header.Get("ETag")
+	if body != "1" || etag == "" {
+		t.Fatalf("GET before reload = %q with ETag %q", body, etag)
+	}
+
+	writeDB(t, path, "version", "2")
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	resp, body = do(t, srv, "GET", "/kv/version", "", "If-None-Match", etag)
+	if resp.StatusCode != http.StatusOK || body != "2" || resp.Header.Get("ETag") == etag {
+		t.Errorf("GET after reload = %d %q with ETag %q, want a new version", resp.StatusCode, body, resp.Header.Get("ETag"))
+	}
+
+	_ = r.Close()
+	if resp, _ := do(t, srv, "GET", "/kv/version", ""); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("GET after Close = %d, want 503", resp.StatusCode)
+	}
+}
@@ -0,0 +1,293 @@
+// Package cdbkey encodes tuples of values into byte keys that keep their
+// order and can be decoded back, for composite keys such as
+// (tenant, user, attribute).
+//
+// The encoding is a subset of the FoundationDB tuple layer. Byte strings and
+// strings are written with a type code and a terminating zero byte, zero
+// bytes inside them escaped as 0x00 0xFF; integers with a type code that
+// holds their length and sign followed by their magnitude; booleans as a
+// single type code; and nested tuples as their elements between a type code
+// and a zero byte. As a result:
+//
+//   - the keys of two tuples compare like the tuples, element by element,
+//     with values of different kinds ordered as byte strings, strings,
+//     tuples, integers and booleans;
+//   - the keys of the tuples that start with the elements of a tuple are
+//     exactly those from its key up to its key followed by 0xff, so prefix
+//     scans with PrefixRange are exact even with binary components;
+//   - every tuple has one key, so decoding a key and encoding the result
+//     gives the key back.
+//
+// A tuple's key is not only a prefix of the keys of longer tuples: ("a")
+// packs to 02 61 00, a prefix of 02 61 00 ff 00, the key of ("a\x00").
+// Scans must use the bounds of PrefixRange rather than bytes.HasPrefix.
+//
+// A Tuple is a cdb.Codec through Codec, for cdb.TypedReader and
+// cdb.TypedWriter, and PrefixRange gives the bounds of cdb.Range and
+// cdb.TypedReader.Range for all tuples that start with given elements.
+package cdbkey
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+
+	"github.com/perbu/cdb"
+)
+
+// Tuple is a sequence of elements, each a []byte, string, bool, Tuple or
+// integer of any size. Decoded tuples hold []byte, string, bool, Tuple,
+// int64, and uint64 for integers above math.MaxInt64.
+type Tuple []any
+
+// ErrInvalidKey is returned for keys that are not tuple encodings.
+var ErrInvalidKey = errors.New("invalid tuple key")
+
+// Type codes.
+const (
+	codeEnd    = 0x00
+	codeBytes  = 0x01
+	codeString = 0x02
+	codeNested = 0x05
+	codeZero   = 0x14 // integers use codeZero-8 to codeZero+8
+	codeFalse  = 0x26
+	codeTrue   = 0x27
+	escape     = 0xff
+)
+
+// Pack returns the key of t.
+func (t Tuple) Pack() ([]byte, error) {
+	return t.Append(nil)
+}
+
+// Append appends the key of t to dst. It fails on elements of other types.
+func (t Tuple) Append(dst []byte) ([]byte, error) {
+	for i, elem := range t {
+		var err error
+		if dst, err = appendElem(dst, elem); err != nil {
+			return dst, fmt.Errorf("element %d: %w", i, err)
+		}
+	}
+	return dst, nil
+}
+
+func appendElem(dst []byte, elem any) ([]byte, error) {
+	switch v := elem.(type) {
+	case []byte:
+		return appendEscaped(append(dst, codeBytes), v), nil
+	case string:
+		return appendEscaped(append(dst, codeString), []byte(v)), nil
+	case bool:
+		if v {
+			return append(dst, codeTrue), nil
+		}
+		return append(dst, codeFalse), nil
+	case Tuple:
+		dst = append(dst, codeNested)
+		dst, err := v.Append(dst)
+		if err != nil {
+			return dst, err
+		}
+		return append(dst, codeEnd), nil
+	case int:
+		return appendInt(dst, int64(v)), nil
+	case int8:
+		return appendInt(dst, int64(v)), nil
+	case int16:
+		return appendInt(dst, int64(v)), nil
+	case int32:
+		return appendInt(dst, int64(v)), nil
+	case int64:
+		return appendInt(dst, v), nil
+	case uint:
+		return appendUint(dst, uint64(v)), nil
+	case uint8:
+		return appendUint(dst, uint64(v)), nil
+	case uint16:
+		return appendUint(dst, uint64(v)), nil
+	case uint32:
+		return appendUint(dst, uint64(v)), nil
+	case uint64:
+		return appendUint(dst, v), nil
+	}
+	return dst, fmt.Errorf("unsupported type %T", elem)
+}
+
+// appendEscaped appends b with its zero bytes escaped, and the terminator.
+func appendEscaped(dst, b []byte) []byte {
+	for {
+		i := bytes.IndexByte(b, 0)
+		if i < 0 {
+			break
+		}
+		dst = append(dst, b[:i+1]...)
+		dst = append(dst, escape)
+		b = b[i+1:]
+	}
+	dst = append(dst, b...)
+	return append(dst, codeEnd)
+}
+
+func appendInt(dst []byte, v int64) []byte {
+	if v >= 0 {
+		return appendUint(dst, uint64(v))
+	}
+	// A negative integer is its magnitude in n bytes, complemented so that
+	// larger magnitudes sort first, after a code below codeZero.
+	m := uint64(-v) // -math.MinInt64 wraps to its magnitude, 1<<63
+	n := byteLen(m)
+	dst = append(dst, byte(codeZero-n))
+	return appendN(dst, ^m, n)
+}
+
+func appendUint(dst []byte, v uint64) []byte {
+	n := byteLen(v)
+	dst = append(dst, byte(codeZero+n))
+	return appendN(dst, v, n)
+}
+
+// byteLen returns the number of bytes needed for v.
+func byteLen(v uint64) int {
+	return (bits.Len64(v) + 7) / 8
+}
+
+// appendN appends the low n bytes of v, big-endian.
+func appendN(dst []byte, v uint64, n int) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return append(dst, b[8-n:]...)
+}
+
+// Unpack decodes a key made by Pack.
+func Unpack(key []byte) (Tuple, error) {
+	t, _, err := unpack(key, false)
+	return t, err
+}
+
+// unpack decodes elements from the start of key, up to the end of a nested
+// tuple if nested is set, and returns them and the number of bytes read.
+func unpack(key []byte, nested bool) (Tuple, int, error) {
+	t := Tuple{}
+	i := 0
+	for i < len(key) {
+		code := key[i]
+		i++
+		switch {
+		case code == codeEnd && nested:
+			return t, i, nil
+		case code == codeBytes || code == codeString:
+			b, n, ok := unescape(key[i:])
+			if !ok {
+				return nil, i, fmt.Errorf("byte %d: unterminated string: %w", i-1, ErrInvalidKey)
+			}
+			i += n
+			if code == codeBytes {
+				t = append(t, b)
+			} else {
+				t = append(t, string(b))
+			}
+		case code == codeNested:
+			inner, n, err := unpack(key[i:], true)
+			if err != nil {
+				return nil, i, err
+			}
+			i += n
+			t = append(t, inner)
+		case code >= codeZero-8 && code <= codeZero+8:
+			n := int(code) - codeZero
+			neg := n < 0
+			if neg {
+				n = -n
+			}
+			if len(key)-i < n {
+				return nil, i, fmt.Errorf("byte %d: truncated integer: %w", i-1, ErrInvalidKey)
+			}
+			// The magnitude of a canonical integer has no leading zero
+			// byte, which a negative one holds complemented.
+			if n > 0 && (!neg && key[i] == 0 || neg && key[i] == 0xff) {
+				return nil, i, fmt.Errorf("byte %d: non-canonical integer: %w", i-1, ErrInvalidKey)
+			}
+			var m uint64
+			for _, b := range key[i : i+n] {
+				m = m<<8 | uint64(b)
+			}
+			i += n
+			switch {
+			case !neg && m <= math.MaxInt64:
+				t = append(t, int64(m))
+			case !neg:
+				t = append(t, m)
+			default:
+				// The shift is 0 for n == 8, making the mask all ones.
+				m = ^m & (1<<(8*n) - 1)
+				if m > 1<<63 {
+					return nil, i, fmt.Errorf("byte %d: integer out of range: %w", i-n-1, ErrInvalidKey)
+				}
+				t = append(t, -int64(m))
+			}
+		case code == codeFalse:
+			t = append(t, false)
+		case code == codeTrue:
+			t = append(t, true)
+		default:
+			return nil, i, fmt.Errorf("byte %d: unknown type code %#x: %w", i-1, code, ErrInvalidKey)
+		}
+	}
+	if nested {
+		return nil, i, fmt.Errorf("byte %d: unterminated tuple: %w", i, ErrInvalidKey)
+	}
+	return t, i, nil
+}
+
+// unescape decodes an escaped string at the start of b and returns it and
+// the number of bytes read, including the terminator.
+func unescape(b []byte) ([]byte, int, bool) {
+	out := []byte{}
+	i := 0
+	for {
+		j := bytes.IndexByte(b[i:], 0)
+		if j < 0 {
+			return nil, 0, false
+		}
+		out = append(out, b[i:i+j]...)
+		i += j + 1
+		if i < len(b) && b[i] == escape {
+			out = append(out, 0)
+			i++
+			continue
+		}
+		return out, i, true
+	}
+}
+
+// PrefixRange returns the bounds, for cdb.Range and cdb.TypedReader.Range,
+// of the keys of t and of all tuples that start with the elements of t. Keys
+// that merely start with the key of t, such as that of ("a\x00") for ("a"),
+// are outside them.
+func PrefixRange(t Tuple) (begin, end []byte, err error) {
+	begin, err = t.Pack()
+	if err != nil {
+		return nil, nil, err
+	}
+	// Every element starts with a type code below 0xff.
+	end = append(begin[:len(begin):len(begin)], 0xff)
+	return begin, end, nil
+}
+
+// Codec encodes tuples for cdb.TypedReader and cdb.TypedWriter.
+type Codec struct{}
+
+var _ cdb.Codec[Tuple] = Codec{}
+
+// Append appends the key of t to dst.
+func (Codec) Append(dst []byte, t Tuple) ([]byte, error) {
+	return t.Append(dst)
+}
+
+// Decode decodes a key made by Pack.
+func (Codec) Decode(data []byte) (Tuple, error) {
+	return Unpack(data)
+}
@@ -0,0 +1,220 @@
+package cdbkey_test
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/perbu/cdb"
+	"github.com/perbu/cdb/cdbkey"
+)
+
+func pack(t *testing.T, tuple cdbkey.Tuple) []byte {
+	t.Helper()
+	key, err := tuple.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		in, want cdbkey.Tuple
+	}{
+		{cdbkey.Tuple{}, cdbkey.Tuple{}},
+		{cdbkey.Tuple{"tenant", "user", "attr"}, cdbkey.Tuple{"tenant", "user", "attr"}},
+		{cdbkey.Tuple{[]byte{0, 1, 0xff, 0}, "a\x00b", ""}, cdbkey.Tuple{[]byte{0, 1, 0xff, 0}, "a\x00b", ""}},
+		{cdbkey.Tuple{0, 1, -1, 255, -256, 1 << 40}, cdbkey.Tuple{int64(0), int64(1), int64(-1), int64(255), int64(-256), int64(1 << 40)}},
+		{cdbkey.Tuple{int64(math.MinInt64), int64(math.MaxInt64), uint64(math.MaxUint64)},
+			cdbkey.Tuple{int64(math.MinInt64), int64(math.MaxInt64), uint64(math.MaxUint64)}},
+		{cdbkey.Tuple{int8(-3), uint16(7), uint8(0)}, cdbkey.Tuple{int64(-3), int64(7), int64(0)}},
+		{cdbkey.Tuple{true, false}, cdbkey.Tuple{true, false}},
+		{cdbkey.Tuple{"a", cdbkey.Tuple{"b", cdbkey.Tuple{}, 3}, "c"},
+			cdbkey.Tuple{"a", cdbkey.Tuple{"b", cdbkey.Tuple{}, int64(3)}, "c"}},
+	}
+	for _, tt := range tests {
+		got, err := cdbkey.Unpack(pack(t, tt.in))
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Unpack(Pack(%#v)) = %#v, %v; want %#v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestOrder(t *testing.T) {
+	// Tuples in ascending order.
+	tuples := []cdbkey.Tuple{
+		{[]byte{}},
+		{[]byte{0}},
+		{[]byte{0, 0}},
+		{[]byte{1}},
+		{""},
+		{"a"},
+		{"a", "b"},
+		{"a", 1},
+		{"a\x00"},
+		{"ab"},
+		{cdbkey.Tuple{"a"}},
+		{cdbkey.Tuple{"a", "b"}},
+		{cdbkey.Tuple{"b"}},
+		{int64(math.MinInt64)},
+		{-1 << 40},
+		{-257},
+		{-256},
+		{-1},
+		{0},
+		{1},
+		{255},
+		{256},
+		{int64(math.MaxInt64)},
+		{uint64(math.MaxUint64)},
+		{false},
+		{true},
+	}
+	for i := 1; i < len(tuples); i++ {
+		a, b := pack(t, tuples[i-1]), pack(t, tuples[i])
+		if bytes.Compare(a, b) >= 0 {
+			t.Errorf("key of %#v (%x) does not sort before key of %#v (%x)", tuples[i-1], a, tuples[i], b)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	if _, err := (cdbkey.Tuple{1.5}).Pack(); err == nil {
+		t.Error("Pack of a float succeeded")
+	}
+	for _, key := range [][]byte{
+		{0x02, 'a'},                    // unterminated string
+		{0x05, 0x02, 0x00},             // unterminated tuple
+		{0x18, 1, 2},                   // truncated integer
+		{0x0c, 0, 0, 0, 0, 0, 0, 0, 0}, // below math.MinInt64
+		{0x15, 0x00},                   // 0 with a leading zero byte
+		{0x16, 0x00, 0x01},             // 1 with a leading zero byte
+		{0x12, 0xff, 0xfe},             // -1 with a leading zero byte
+		{0x00},
+		{0x30},
+	} {
+		if _, err := cdbkey.Unpack(key); !errors.Is(err, cdbkey.ErrInvalidKey) {
+			t.Errorf("Unpack(%x) = %v, want ErrInvalidKey", key, err)
+		}
+	}
+}
+
+// TestCanonical checks that every integer key of up to two bytes that
+// Unpack accepts is the key Pack makes.
+func TestCanonical(t *testing.T) {
+	for code := byte(0x12); code <= 0x16; code++ {
+		n := max(int(code)-0x14, 0x14-int(code))
+		for v := range 1 << (8 * n) {
+			key := []byte{code, byte(v >> 8), byte(v)}
+			key = append(key[:1], key[3-n:]...)
+			tuple, err := cdbkey.Unpack(key)
+			if err != nil {
+				continue
+			}
+			if got := pack(t, tuple); !bytes.Equal(got, key) {
+				t.Errorf("Pack(Unpack(%x)) = %x", key, got)
+			}
+		}
+	}
+}
+
+func TestPrefixRange(t *testing.T) {
+	begin, end, err := cdbkey.PrefixRange(cdbkey.Tuple{"a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		tuple cdbkey.Tuple
+		in    bool
+	}{
+		{cdbkey.Tuple{"a"}, true},
+		{cdbkey.Tuple{"a", "b"}, true},
+		{cdbkey.Tuple{"a", cdbkey.Tuple{}, true}, true},
+		{cdbkey.Tuple{"a", uint64(math.MaxUint64)}, true},
+		// The key of ("a\x00") starts with the key of ("a").
+		{cdbkey.Tuple{"a\x00"}, false},
+		{cdbkey.Tuple{"a\x00", "b"}, false},
+		{cdbkey.Tuple{"ab"}, false},
+		{cdbkey.Tuple{[]byte("a")}, false},
+	} {
+		key := pack(t, tt.tuple)
+		if in := bytes.Compare(key, begin) >= 0 && bytes.Compare(key, end) < 0; in != tt.in {
+			t.Errorf("key of %q in PrefixRange((a)) = %v, want %v", tt.tuple, in, tt.in)
+		}
+	}
+}
+
+func TestTypedRange(t *testing.T) {
+	b := cdb.NewBuilder()
+	w := cdb.NewTypedWriter(b.Writer, cdbkey.Codec{}, cdb.StringCodec{})
+	records := []struct {
+		key   cdbkey.Tuple
+		value string
+	}{
+		{cdbkey.Tuple{"acme", "alice", "email"}, "alice@acme.example"},
+		{cdbkey.Tuple{"acme", "bob", "email"}, "bob@acme.example"},
+		{cdbkey.Tuple{"acme\x00", "mallory", "email"}, "not acme"},
+		{cdbkey.Tuple{"acme", "alice", "role"}, "admin"},
+		{cdbkey.Tuple{"acmecorp", "carol", "email"}, "carol@acmecorp.example"},
+		{cdbkey.Tuple{[]byte("acme"), "dave", "email"}, "bytes, not a string"},
+	}
+	for _, r := range records {
+		if err := w.Put(r.key, r.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db, err := b.InMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := cdb.NewTypedReader(db, cdbkey.Codec{}, cdb.StringCodec{})
+
+	if v, ok, err := r.Get(cdbkey.Tuple{"acme", "alice", "role"}); err != nil || !ok || v != "admin" {
+		t.Errorf("Get = %q, %v, %v", v, ok, err)
+	}
+
+	for _, tt := range []struct {
+		prefix cdbkey.Tuple
+		want   []string
+	}{
+		{cdbkey.Tuple{"acme"}, []string{"alice@acme.example", "bob@acme.example", "admin"}},
+		{cdbkey.Tuple{"acme", "alice"}, []string{"alice@acme.example", "admin"}},
+		{cdbkey.Tuple{"acme", "alice", "role"}, []string{"admin"}},
+		{cdbkey.Tuple{"acme", "zed"}, nil},
+	} {
+		begin, end, err := cdbkey.PrefixRange(tt.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		var iterErr error
+		for rec, err := range r.Range(begin, end) {
+			if err != nil {
+				iterErr = err
+				break
+			}
+			if !reflect.DeepEqual(rec.Key[:len(tt.prefix)], tt.prefix) {
+				t.Errorf("Range(%q) yielded key %q", tt.prefix, rec.Key)
+			}
+			got = append(got, rec.Value)
+		}
+		if iterErr != nil || !slices.Equal(got, tt.want) {
+			t.Errorf("Range(%q) = %q, %v; want %q", tt.prefix, got, iterErr, tt.want)
+		}
+	}
+
+	// The raw records of a range, through cdb.Range.
+	begin := pack(t, cdbkey.Tuple{"acme", "b"})
+	end := pack(t, cdbkey.Tuple{"acme", "c"})
+	var n int
+	for range cdb.Range(db, begin, end) {
+		n++
+	}
+	if n != 1 {
+		t.Errorf("cdb.Range over (acme, b) to (acme, c) yielded %d records, want 1", n)
+	}
+}
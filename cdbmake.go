@@ -0,0 +1,205 @@
+package cdb
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// ImportError reports malformed input to Import. Line is the 1-based number
+// of the record, counting each record as one line even if its key or value
+// contains newlines, and Offset is the byte offset in the input at which
+// the problem was found.
+type ImportError struct {
+	Line   int
+	Offset int64
+	Err    error
+}
+
+func (e *ImportError) Error() string {
+	return fmt.Sprintf("line %d, byte %d: %v", e.Line, e.Offset, e.Err)
+}
+
+func (e *ImportError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorPolicy decides what ImportJSONL and ImportCSV do with input lines
+// that cannot be imported.
+type ErrorPolicy int
+
+const (
+	// StopOnError makes the import fail with an *ImportError.
+	StopOnError ErrorPolicy = iota
+	// SkipInvalid skips the line and carries on.
+	SkipInvalid
+)
+
+// handle applies the policy to err, calling onSkip, if set, for skipped
+// lines. It returns the error that should end the import, if any.
+func (p ErrorPolicy) handle(err error, onSkip func(error)) error {
+	if p != SkipInvalid {
+		return err
+	}
+	if onSkip != nil {
+		onSkip(err)
+	}
+	return nil
+}
+
+// Import adds the records in r, in the text format read by cdbmake, to w.
+// Each record is "+klen,dlen:key->data" followed by a newline, and the input
+// ends with an empty line; anything after it is ignored, like cdbmake does.
+// Keys and data are binary-safe. Malformed input, including a missing final
+// empty line, is reported as an *ImportError. W is not finalized.
+func Import(r io.Reader, w *Writer) error {
+	p := cdbmakeParser{r: bufio.NewReader(r), line: 1}
+	for {
+		ch, err := p.readByte()
+		if err != nil {
+			return err
+		}
+		if ch == '\n' {
+			return nil
+		}
+		if ch != '+' {
+			p.offset--
+			return p.errorf("expected '+' or empty line, found %q", ch)
+		}
+
+		keyLength, err := p.readNumber(',')
+		if err != nil {
+			return err
+		}
+		valueLength, err := p.readNumber(':')
+		if err != nil {
+			return err
+		}
+		key, err := p.readBytes(&p.key, keyLength)
+		if err != nil {
+			return err
+		}
+		if err := p.expect("->"); err != nil {
+			return err
+		}
+		value, err := p.readBytes(&p.value, valueLength)
+		if err != nil {
+			return err
+		}
+		if err := p.expect("\n"); err != nil {
+			return err
+		}
+
+		if err := w.Put(key, value); err != nil {
+			return fmt.Errorf("line %d: %w", p.line, err)
+		}
+		p.line++
+	}
+}
+
+type cdbmakeParser struct {
+	r          *bufio.Reader
+	line       int
+	offset     int64
+	key, value bytes.Buffer
+}
+
+func (p *cdbmakeParser) errorf(format string, args ...any) error {
+	return &ImportError{Line: p.line, Offset: p.offset, Err: fmt.Errorf(format, args...)}
+}
+
+// readByte reads the next byte, reporting the end of input as an error,
+// since the input must end with an empty line.
+func (p *cdbmakeParser) readByte() (byte, error) {
+	ch, err := p.r.ReadByte()
+	if errors.Is(err, io.EOF) {
+		return 0, &ImportError{Line: p.line, Offset: p.offset, Err: io.ErrUnexpectedEOF}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("read: %w", err)
+	}
+	p.offset++
+	return ch, nil
+}
+
+// readNumber reads a decimal length terminated by end.
+func (p *cdbmakeParser) readNumber(end byte) (int64, error) {
+	var n int64
+	for {
+		ch, err := p.readByte()
+		if err != nil {
+			return 0, err
+		}
+		if ch == end {
+			return n, nil
+		}
+		if ch < '0' || ch > '9' {
+			p.offset--
+			return 0, p.errorf("expected digit or %q, found %q", end, ch)
+		}
+		if n > (1<<63-1-int64(ch-'0'))/10 {
+			p.offset--
+			return 0, p.errorf("length overflows")
+		}
+		n = n*10 + int64(ch-'0')
+	}
+}
+
+// readBytes reads n bytes into buf, which is reused between records.
+func (p *cdbmakeParser) readBytes(buf *bytes.Buffer, n int64) ([]byte, error) {
+	buf.Reset()
+	copied, err := io.CopyN(buf, p.r, n)
+	p.offset += copied
+	if errors.Is(err, io.EOF) {
+		return nil, &ImportError{Line: p.line, Offset: p.offset, Err: io.ErrUnexpectedEOF}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// expect reads the bytes of s.
+func (p *cdbmakeParser) expect(s string) error {
+	for i := 0; i < len(s); i++ {
+		ch, err := p.readByte()
+		if err != nil {
+			return err
+		}
+		if ch != s[i] {
+			p.offset--
+			return p.errorf("expected %q, found %q", s[i], ch)
+		}
+	}
+	return nil
+}
+
+// Export writes every record of r to w in the text format produced by
+// cdbdump, in the order All yields them, followed by the terminating empty
+// line. The output can be read back with Import or by cdbmake.
+func Export(r Reader, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	var header []byte
+	for key, value := range r.All() {
+		header = append(header[:0], '+')
+		header = strconv.AppendInt(header, int64(len(key)), 10)
+		header = append(header, ',')
+		header = strconv.AppendInt(header, int64(len(value)), 10)
+		header = append(header, ':')
+		bw.Write(header)
+		bw.Write(key)
+		bw.WriteString("->")
+		bw.Write(value)
+		if err := bw.WriteByte('\n'); err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+	}
+	bw.WriteByte('\n')
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package cdb_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/perbu/cdb"
+)
+
+func TestExport(t *testing.T) {
+	db := buildInMemory(t, "one", "1", "two", "line\nbreak", "", "empty key", "dup", "a", "dup", "")
+
+	var buf bytes.Buffer
+	if err := cdb.Export(db, &buf); err != nil {
+		t.Fatal(err)
+	}
+	want := "+3,1:one->1\n+3,10:two->line\nbreak\n+0,9:->empty key\n+3,1:dup->a\n+3,0:dup->\n\n"
+	if buf.String() != want {
+		t.Errorf("Export = %q, want %q", buf.String(), want)
+	}
+
+	builder := cdb.NewBuilder()
+	if err := cdb.Import(&buf, builder.Writer); err != nil {
+		t.Fatal(err)
+	}
+	imported, err := builder.InMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := collectPairs(imported.All()), collectPairs(db.All()); !slices.Equal(got, want) {
+		t.Errorf("round trip = %q, want %q", got, want)
+	}
+}
+
+func TestImportFixture(t *testing.T) {
+	src, err := cdb.Open(testFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	var buf bytes.Buffer
+	if err := cdb.Export(src, &buf); err != nil {
+		t.Fatal(err)
+	}
+	builder := cdb.NewBuilder()
+	if err := cdb.Import(&buf, builder.Writer); err != nil {
+		t.Fatal(err)
+	}
+	db, err := builder.InMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := collectPairs(db.All()), collectPairs(src.All()); !slices.Equal(got, want) {
+		t.Errorf("round trip = %q, want %q", got, want)
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	tests := []struct {
+		input  string
+		line   int
+		offset int64
+		err    string
+	}{
+		{"+1,1:a->b\n", 2, 10, "unexpected EOF"},
+		{"+1,1:a->b\n+1,2:c->d", 2, 19, "unexpected EOF"},
+		{"+1,1:a->b\nx", 2, 10, `expected '+' or empty line, found 'x'`},
+		{"+1,1:a->b\n+1x1:c->d\n\n", 2, 12, `expected digit or ',', found 'x'`},
+		{"+1,1:a=>b\n\n", 1, 6, `expected '-', found '='`},
+		{"+1,1:a->bc\n\n", 1, 9, `expected '\n', found 'c'`},
+		{"+99999999999999999999,1:a->b\n\n", 1, 19, "length overflows"},
+	}
+	for _, tt := range tests {
+		err := cdb.Import(strings.NewReader(tt.input), cdb.NewBuilder().Writer)
+		var importErr *cdb.ImportError
+		if !errors.As(err, &importErr) {
+			t.Errorf("Import(%q) = %v, want an ImportError", tt.input, err)
+			continue
+		}
+		if importErr.Line != tt.line || importErr.Offset != tt.offset || importErr.Err.Error() != tt.err {
+			t.Errorf("Import(%q) = line %d, byte %d: %v; want line %d, byte %d: %s",
+				tt.input, importErr.Line, importErr.Offset, importErr.Err, tt.line, tt.offset, tt.err)
+		}
+	}
+
+	err := cdb.Import(strings.NewReader("+1,1:a"), cdb.NewBuilder().Writer)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Import of a truncated record = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
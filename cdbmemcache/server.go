@@ -0,0 +1,476 @@
+// Package cdbmemcache serves a CDB database to memcached clients, read-only.
+//
+// A Server speaks the read side of the memcached text protocol: get and gets
+// with any number of keys, the meta commands mg and mn, version, stats,
+// verbosity and quit. Storage, delete, arithmetic and touch commands are
+// answered with a SERVER_ERROR, after consuming their data block so that
+// pipelined requests stay in sync; with noreply, or the q flag for meta
+// commands, they are discarded silently like any other noreply request.
+//
+// Records are served with zero flags and no expiry. The CAS value of a
+// record is a hash of its value, so it only changes when the value does.
+package cdbmemcache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/perbu/cdb"
+	"github.com/perbu/cdb/internal/netserver"
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Close.
+var ErrServerClosed = netserver.ErrServerClosed
+
+// DefaultVersion is reported by the version command if Server.Version is
+// empty.
+const DefaultVersion = "1.6.0-cdb"
+
+const (
+	// maxKeyLength is memcached's limit on the length of a key.
+	maxKeyLength = 250
+	// maxLineLength limits the length of a command line, which holds up to
+	// a few hundred keys of a multi-key get.
+	maxLineLength = 64 << 10
+)
+
+// Server serves a database over the memcached text protocol. Configure it by
+// setting the exported fields before calling Serve.
+type Server struct {
+	// Version is reported by the version command and in stats. If empty,
+	// DefaultVersion is used.
+	Version string
+	// IdleTimeout closes connections that have not sent a command for this
+	// long. If zero, connections never time out.
+	IdleTimeout time.Duration
+
+	acquire func() (cdb.Reader, func(), error)
+	started time.Time
+	srv     netserver.Server
+
+	currConns  atomic.Int64
+	totalConns atomic.Int64
+	cmdGet     atomic.Int64
+	getHits    atomic.Int64
+	getMisses  atomic.Int64
+}
+
+// New returns a Server for r. The server does not close r.
+func New(r cdb.Reader) *Server {
+	return newServer(func() (cdb.Reader, func(), error) {
+		return r, func() {}, nil
+	})
+}
+
+// NewReloading returns a Server for the current database of r. Each command
+// is answered from the database that was current when it was read.
+func NewReloading(r *cdb.Reloader) *Server {
+	return newServer(func() (cdb.Reader, func(), error) {
+		db, release, err := r.Acquire()
+		if err != nil {
+			return nil, nil, err
+		}
+		return db, release, nil
+	})
+}
+
+func newServer(acquire func() (cdb.Reader, func(), error)) *Server {
+	return &Server{acquire: acquire, started: time.Now()}
+}
+
+// ListenAndServe listens on the given network, "tcp" or "unix", and address
+// and calls Serve.
+func (s *Server) ListenAndServe(network, address string) error {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return fmt.Errorf("net.Listen(%q, %q): %w", network, address, err)
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l and serves each in its own goroutine until
+// Close is called, after which it returns ErrServerClosed. Serve closes l.
+func (s *Server) Serve(l net.Listener) error {
+	return s.srv.Serve(l, s.serveConn)
+}
+
+// Close stops all listeners, closes all connections and waits for their
+// goroutines to return.
+func (s *Server) Close() error {
+	return s.srv.Close()
+}
+
+// errQuit ends a connection after the quit command.
+var errQuit = errors.New("quit")
+
+// conn is the state of one client connection.
+type conn struct {
+	s *Server
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func (s *Server) serveConn(nc net.Conn) {
+	s.currConns.Add(1)
+	s.totalConns.Add(1)
+	defer s.currConns.Add(-1)
+
+	c := &conn{s: s, r: bufio.NewReaderSize(nc, 16<<10), w: bufio.NewWriterSize(nc, 16<<10)}
+	for {
+		if s.IdleTimeout > 0 {
+			_ = nc.SetReadDeadline(time.Now().Add(s.IdleTimeout))
+		}
+		line, err := c.readLine()
+		if err != nil {
+			_ = c.w.Flush()
+			return
+		}
+		if err := c.command(line); err != nil {
+			_ = c.w.Flush()
+			return
+		}
+		// Answer a pipelined batch of commands with as few writes as
+		// possible, flushing once no more input is waiting.
+		if c.r.Buffered() == 0 {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readLine reads a command line without its line ending. Over-long lines
+// are answered with an error and end the connection, since the rest of the
+// line cannot be told apart from the next command.
+func (c *conn) readLine() ([]byte, error) {
+	line, err := c.r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		var buf []byte
+		buf = append(buf, line...)
+		for errors.Is(err, bufio.ErrBufferFull) && len(buf) <= maxLineLength {
+			line, err = c.r.ReadSlice('\n')
+			buf = append(buf, line...)
+		}
+		if len(buf) > maxLineLength {
+			c.clientError("line too long")
+			return nil, errQuit
+		}
+		line = buf
+	}
+	if err != nil {
+		return nil, err
+	}
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+	return line, nil
+}
+
+func (c *conn) clientError(msg string) {
+	c.w.WriteString("CLIENT_ERROR ")
+	c.w.WriteString(msg)
+	c.w.WriteString("\r\n")
+}
+
+func (c *conn) serverError(msg string) {
+	c.w.WriteString("SERVER_ERROR ")
+	c.w.WriteString(msg)
+	c.w.WriteString("\r\n")
+}
+
+// command executes one command line. It returns an error only if the
+// connection must be closed.
+func (c *conn) command(line []byte) error {
+	fields := bytes.Fields(line)
+	if len(fields) == 0 {
+		c.w.WriteString("ERROR\r\n")
+		return nil
+	}
+	args := fields[1:]
+	switch string(fields[0]) {
+	case "get":
+		return c.get(args, false)
+	case "gets":
+		return c.get(args, true)
+	case "mg":
+		return c.metaGet(args)
+	case "mn":
+		c.w.WriteString("MN\r\n")
+	case "version":
+		c.w.WriteString("VERSION " + c.s.version() + "\r\n")
+	case "stats":
+		if len(args) > 0 {
+			c.clientError("unsupported stats group")
+			return nil
+		}
+		return c.stats()
+	case "verbosity":
+		if !noreply(args) {
+			c.w.WriteString("OK\r\n")
+		}
+	case "quit":
+		return errQuit
+	case "set", "add", "replace", "append", "prepend", "cas":
+		// <cmd> <key> <flags> <exptime> <bytes> [<cas>] [noreply]
+		if len(args) < 4 {
+			c.w.WriteString("ERROR\r\n")
+			return nil
+		}
+		// The arguments point into the read buffer, which discardData
+		// refills, so they are inspected first.
+		quiet := noreply(args)
+		if err := c.discardData(args[3]); err != nil {
+			return err
+		}
+		if !quiet {
+			c.serverError("read-only database")
+		}
+	case "ms":
+		// ms <key> <datalen> <flags>*
+		if len(args) < 2 {
+			c.clientError("bad command line format")
+			return nil
+		}
+		quiet := hasFlag(args[2:], 'q')
+		if err := c.discardData(args[1]); err != nil {
+			return err
+		}
+		if !quiet {
+			c.serverError("read-only database")
+		}
+	case "md", "ma":
+		if !hasFlag(args, 'q') {
+			c.serverError("read-only database")
+		}
+	case "delete", "incr", "decr", "touch", "gat", "gats", "flush_all":
+		if !noreply(args) {
+			c.serverError("read-only database")
+		}
+	default:
+		c.w.WriteString("ERROR\r\n")
+	}
+	return nil
+}
+
+// discardData skips the data block of a storage command.
+func (c *conn) discardData(length []byte) error {
+	n, err := strconv.ParseUint(string(length), 10, 31)
+	if err != nil {
+		c.clientError("bad data chunk")
+		return errQuit
+	}
+	if _, err := c.r.Discard(int(n) + 2); err != nil {
+		return err
+	}
+	return nil
+}
+
+func noreply(args [][]byte) bool {
+	return len(args) > 0 && string(args[len(args)-1]) == "noreply"
+}
+
+func hasFlag(flags [][]byte, flag byte) bool {
+	for _, f := range flags {
+		if len(f) > 0 && f[0] == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) version() string {
+	if s.Version != "" {
+		return s.Version
+	}
+	return DefaultVersion
+}
+
+// cas returns the CAS value of a record.
+func cas(value []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(value)
+	return h.Sum64()
+}
+
+// get answers get and gets with a VALUE line for each key that was found.
+func (c *conn) get(keys [][]byte, withCAS bool) error {
+	if len(keys) == 0 {
+		c.w.WriteString("ERROR\r\n")
+		return nil
+	}
+	for _, key := range keys {
+		if len(key) > maxKeyLength {
+			c.clientError("bad command line format")
+			return nil
+		}
+	}
+
+	db, release, err := c.s.acquire()
+	if err != nil {
+		c.serverError(err.Error())
+		return nil
+	}
+	defer release()
+
+	var buf []byte
+	for _, key := range keys {
+		c.s.cmdGet.Add(1)
+		value, err := db.Get(key)
+		if err != nil {
+			c.serverError(err.Error())
+			return nil
+		}
+		if value == nil {
+			c.s.getMisses.Add(1)
+			continue
+		}
+		c.s.getHits.Add(1)
+
+		buf = append(buf[:0], "VALUE "...)
+		buf = append(buf, key...)
+		buf = append(buf, " 0 "...)
+		buf = strconv.AppendInt(buf, int64(len(value)), 10)
+		if withCAS {
+			buf = append(buf, ' ')
+			buf = strconv.AppendUint(buf, cas(value), 10)
+		}
+		buf = append(buf, "\r\n"...)
+		c.w.Write(buf)
+		c.w.Write(value)
+		c.w.WriteString("\r\n")
+	}
+	c.w.WriteString("END\r\n")
+	return nil
+}
+
+// metaGet answers mg <key> <flags>*. The supported flags are b (the key is
+// base64-encoded), c (return the CAS value), f (return the client flags), k
+// (return the key), O (opaque token), q (no reply on a miss), s (return the
+// size), t (return the TTL, always -1) and v (return the value).
+func (c *conn) metaGet(args [][]byte) error {
+	if len(args) == 0 {
+		c.clientError("bad command line format")
+		return nil
+	}
+	key, flags := args[0], args[1:]
+	var quiet, withValue, b64 bool
+	for _, f := range flags {
+		switch f[0] {
+		case 'q':
+			quiet = true
+		case 'v':
+			withValue = true
+		case 'b':
+			b64 = true
+		case 'c', 'f', 'k', 'O', 's', 't':
+		default:
+			c.clientError("invalid flag")
+			return nil
+		}
+	}
+	if b64 {
+		decoded, err := base64.StdEncoding.DecodeString(string(key))
+		if err != nil {
+			c.clientError("error decoding key")
+			return nil
+		}
+		key = decoded
+	}
+	if len(key) > maxKeyLength {
+		c.clientError("bad command line format")
+		return nil
+	}
+
+	db, release, err := c.s.acquire()
+	if err != nil {
+		c.serverError(err.Error())
+		return nil
+	}
+	defer release()
+
+	c.s.cmdGet.Add(1)
+	value, err := db.Get(key)
+	if err != nil {
+		c.serverError(err.Error())
+		return nil
+	}
+	if value == nil {
+		c.s.getMisses.Add(1)
+		if !quiet {
+			c.w.WriteString("EN\r\n")
+		}
+		return nil
+	}
+	c.s.getHits.Add(1)
+
+	var buf []byte
+	if withValue {
+		buf = append(buf, "VA "...)
+		buf = strconv.AppendInt(buf, int64(len(value)), 10)
+	} else {
+		buf = append(buf, "HD"...)
+	}
+	for _, f := range flags {
+		switch f[0] {
+		case 'b':
+			buf = append(buf, " b"...)
+		case 'c':
+			buf = append(buf, " c"...)
+			buf = strconv.AppendUint(buf, cas(value), 10)
+		case 'f':
+			buf = append(buf, " f0"...)
+		case 'k':
+			buf = append(buf, " k"...)
+			buf = append(buf, args[0]...)
+		case 'O':
+			buf = append(buf, ' ')
+			buf = append(buf, f...)
+		case 's':
+			buf = append(buf, " s"...)
+			buf = strconv.AppendInt(buf, int64(len(value)), 10)
+		case 't':
+			buf = append(buf, " t-1"...)
+		}
+	}
+	buf = append(buf, "\r\n"...)
+	c.w.Write(buf)
+	if withValue {
+		c.w.Write(value)
+		c.w.WriteString("\r\n")
+	}
+	return nil
+}
+
+// stats answers the general stats command with the counters that apply to
+// a read-only server.
+func (c *conn) stats() error {
+	s := c.s
+	size := 0
+	if db, release, err := s.acquire(); err == nil {
+		size = db.Size()
+		release()
+	}
+	now := time.Now()
+	stat := func(name string, value any) {
+		fmt.Fprintf(c.w, "STAT %s %v\r\n", name, value)
+	}
+	stat("pid", os.Getpid())
+	stat("uptime", int64(now.Sub(s.started).Seconds()))
+	stat("time", now.Unix())
+	stat("version", s.version())
+	stat("curr_connections", s.currConns.Load())
+	stat("total_connections", s.totalConns.Load())
+	stat("cmd_get", s.cmdGet.Load())
+	stat("get_hits", s.getHits.Load())
+	stat("get_misses", s.getMisses.Load())
+	stat("bytes", size)
+	c.w.WriteString("END\r\n")
+	return nil
+}
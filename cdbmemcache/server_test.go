@@ -0,0 +1,183 @@
+package cdbmemcache_test
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/perbu/cdb"
+	"github.com/perbu/cdb/cdbmemcache"
+)
+
+// startServer serves a small database on a TCP port and returns its address.
+func startServer(t *testing.T) string {
+	t.Helper()
+	b := cdb.NewBuilder()
+	for _, kv := range [][2]string{{"a", "1"}, {"long", "hello world"}, {"bin\x00", "x"}} {
+		if err := b.Put([]byte(kv[0]), []byte(kv[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db, err := b.InMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := cdbmemcache.New(db)
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(l) }()
+	t.Cleanup(func() {
+		if err := s.Close(); err != nil {
+			t.Error(err)
+		}
+		if err := <-done; !errors.Is(err, cdbmemcache.ErrServerClosed) {
+			t.Errorf("Serve = %v, want ErrServerClosed", err)
+		}
+	})
+	return l.Addr().String()
+}
+
+// roundTrip sends request and reads a response of the same length as want,
+// or up to and including END if want is empty.
+func roundTrip(t *testing.T, conn net.Conn, r *bufio.Reader, request, want string) string {
+	t.Helper()
+	if _, err := io.WriteString(conn, request); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if want != "" {
+		buf := make([]byte, len(want))
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatalf("reading response to %q: %v, got %q", request, err, buf)
+		}
+		return string(buf)
+	}
+	var resp strings.Builder
+	for !strings.HasSuffix(resp.String(), "END\r\n") {
+		line, err := r.ReadString('\n')
+		resp.WriteString(line)
+		if err != nil {
+			t.Fatalf("reading response to %q: %v, got %q", request, err, resp.String())
+		}
+	}
+	return resp.String()
+}
+
+func TestServer(t *testing.T) {
+	addr := startServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	tests := []struct {
+		request, response string
+	}{
+		{"get a\r\n", "VALUE a 0 1\r\n1\r\nEND\r\n"},
+		{"get a missing long\r\n", "VALUE a 0 1\r\n1\r\nVALUE long 0 11\r\nhello world\r\nEND\r\n"},
+		{"gets a\r\n", "VALUE a 0 1 12638134423997487868\r\n1\r\nEND\r\n"},
+		{"mg a v k s f t c O123\r\n", "VA 1 ka s1 f0 t-1 c12638134423997487868 O123\r\n1\r\n"},
+		{"mg a\r\n", "HD\r\n"},
+		{"mg missing v\r\n", "EN\r\n"},
+		{"mg missing v q\r\nmg YmluAA== b k v\r\n", "VA 1 b kYmluAA==\r\nx\r\n"},
+		{"mg a x\r\n", "CLIENT_ERROR invalid flag\r\n"},
+		{"mn\r\n", "MN\r\n"},
+		{"version\r\n", "VERSION " + cdbmemcache.DefaultVersion + "\r\n"},
+		{"set a 0 0 5\r\nhello\r\n", "SERVER_ERROR read-only database\r\n"},
+		{"set a 0 0 5 noreply\r\nhello\r\nms a 2 q\r\nhi\r\ndelete a noreply\r\nget a\r\n", "VALUE a 0 1\r\n1\r\nEND\r\n"},
+		{"ms a 2 T0\r\nhi\r\n", "SERVER_ERROR read-only database\r\n"},
+		// Data blocks larger than the read buffer do not lose noreply
+		// and q.
+		{"set k 0 0 100000 noreply\r\n" + strings.Repeat("x", 100000) + "\r\nmn\r\n", "MN\r\n"},
+		{"ms k 100000 T0 q\r\n" + strings.Repeat("x", 100000) + "\r\nmn\r\n", "MN\r\n"},
+		{"delete a\r\nincr a 1\r\n", "SERVER_ERROR read-only database\r\nSERVER_ERROR read-only database\r\n"},
+		{"bogus\r\n", "ERROR\r\n"},
+		{"get " + strings.Repeat("k", 251) + "\r\n", "CLIENT_ERROR bad command line format\r\n"},
+	}
+	for _, tt := range tests {
+		if got := roundTrip(t, conn, r, tt.request, tt.response); got != tt.response {
+			t.Errorf("%q = %q, want %q", tt.request, got, tt.response)
+		}
+	}
+
+	stats := roundTrip(t, conn, r, "stats\r\n", "")
+	for _, want := range []string{"STAT curr_connections 1\r\n", "STAT get_hits 8\r\n", "STAT get_misses 3\r\n"} {
+		if !strings.Contains(stats, want) {
+			t.Errorf("stats = %q, want it to contain %q", stats, want)
+		}
+	}
+
+	if _, err := io.WriteString(conn, "quit\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("read after quit = %v, want EOF", err)
+	}
+}
+
+func TestServerReloading(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.cdb")
+	writeVersion := func(version string) {
+		w, err := cdb.CreateAtomic(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Put([]byte("version"), []byte(version)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeVersion("1")
+	r, err := cdb.OpenReloader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	s := cdbmemcache.NewReloading(r)
+	socket := filepath.Join(dir, "memcache.sock")
+	done := make(chan error, 1)
+	go func() { done <- s.ListenAndServe("unix", socket) }()
+	defer func() {
+		_ = s.Close()
+		<-done
+	}()
+
+	var conn net.Conn
+	for i := 0; ; i++ {
+		if conn, err = net.Dial("unix", socket); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	if got := roundTrip(t, conn, br, "get version\r\n", ""); got != "VALUE version 0 1\r\n1\r\nEND\r\n" {
+		t.Errorf("get before reload = %q", got)
+	}
+	writeVersion("2")
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := roundTrip(t, conn, br, "get version\r\n", ""); got != "VALUE version 0 1\r\n2\r\nEND\r\n" {
+		t.Errorf("get after reload = %q", got)
+	}
+}
@@ -0,0 +1,153 @@
+// Package cdbpostfix serves CDB databases to Postfix as lookup tables.
+//
+// A Server holds any number of named maps and answers the socketmap protocol,
+// whose requests name the map, and the tcp_table protocol, which serves one
+// map per listener. Both are read-only: tcp_table put requests are refused.
+//
+// In main.cf the maps are used as, for example,
+//
+//	transport_maps = socketmap:inet:127.0.0.1:8000:transport
+//	virtual_alias_maps = tcp:127.0.0.1:8001
+//
+// Databases built by postmap can be served as they are: as in Postfix, a key
+// that is not found is looked up again with a terminating null byte, and a
+// null byte ending a value is removed.
+package cdbpostfix
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/perbu/cdb"
+	"github.com/perbu/cdb/internal/netserver"
+)
+
+// ErrServerClosed is returned by the Serve methods after Close.
+var ErrServerClosed = netserver.ErrServerClosed
+
+// errNoMap is returned by lookup for a map name that was not registered.
+var errNoMap = errors.New("no such map")
+
+// Server serves named maps over the socketmap and tcp_table protocols. The
+// zero value is a Server without maps; add them with Handle or
+// HandleReloading, before or while serving.
+type Server struct {
+	// IdleTimeout closes connections that have not sent a request for this
+	// long. If zero, connections never time out.
+	IdleTimeout time.Duration
+
+	mu   sync.RWMutex
+	maps map[string]func() (cdb.Reader, func(), error)
+	srv  netserver.Server
+}
+
+// Handle serves r as the map name, replacing any map of that name. The
+// server does not close r.
+func (s *Server) Handle(name string, r cdb.Reader) {
+	s.handle(name, func() (cdb.Reader, func(), error) {
+		return r, func() {}, nil
+	})
+}
+
+// HandleReloading serves the current database of r as the map name,
+// replacing any map of that name. Each request is answered from the database
+// that was current when it was read.
+func (s *Server) HandleReloading(name string, r *cdb.Reloader) {
+	s.handle(name, func() (cdb.Reader, func(), error) {
+		db, release, err := r.Acquire()
+		if err != nil {
+			return nil, nil, err
+		}
+		return db, release, nil
+	})
+}
+
+func (s *Server) handle(name string, acquire func() (cdb.Reader, func(), error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maps == nil {
+		s.maps = make(map[string]func() (cdb.Reader, func(), error))
+	}
+	s.maps[name] = acquire
+}
+
+// ListenAndServeSocketmap listens on the given network, "tcp" or "unix", and
+// address and calls ServeSocketmap.
+func (s *Server) ListenAndServeSocketmap(network, address string) error {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return fmt.Errorf("net.Listen(%q, %q): %w", network, address, err)
+	}
+	return s.ServeSocketmap(l)
+}
+
+// ServeSocketmap accepts connections on l and answers socketmap requests on
+// each in its own goroutine until Close is called, after which it returns
+// ErrServerClosed. ServeSocketmap closes l.
+func (s *Server) ServeSocketmap(l net.Listener) error {
+	return s.srv.Serve(l, s.serveSocketmap)
+}
+
+// ListenAndServeTCPTable listens on the given network, "tcp" or "unix", and
+// address and calls ServeTCPTable.
+func (s *Server) ListenAndServeTCPTable(network, address, name string) error {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return fmt.Errorf("net.Listen(%q, %q): %w", network, address, err)
+	}
+	return s.ServeTCPTable(l, name)
+}
+
+// ServeTCPTable accepts connections on l and answers tcp_table requests for
+// the map name on each in its own goroutine until Close is called, after
+// which it returns ErrServerClosed. The map need not be registered yet, but
+// requests fail until it is. ServeTCPTable closes l.
+func (s *Server) ServeTCPTable(l net.Listener, name string) error {
+	return s.srv.Serve(l, func(nc net.Conn) { s.serveTCPTable(nc, name) })
+}
+
+// Close stops all listeners, closes all connections and waits for their
+// goroutines to return.
+func (s *Server) Close() error {
+	return s.srv.Close()
+}
+
+// lookup looks key up in the map name. It returns a nil value if the key is
+// not found. The value is only valid until release is called, which must be
+// done unless lookup returns an error.
+func (s *Server) lookup(name string, key []byte) (value []byte, release func(), err error) {
+	s.mu.RLock()
+	acquire := s.maps[name]
+	s.mu.RUnlock()
+	if acquire == nil {
+		return nil, nil, errNoMap
+	}
+	db, release, err := acquire()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	value, err = db.Get(key)
+	if err == nil && value == nil {
+		value, err = db.Get(append(key[:len(key):len(key)], 0))
+	}
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	if value != nil {
+		value = bytes.TrimSuffix(value, []byte{0})
+	}
+	return value, release, nil
+}
+
+// setDeadline applies IdleTimeout to the next request on nc.
+func (s *Server) setDeadline(nc net.Conn) {
+	if s.IdleTimeout > 0 {
+		_ = nc.SetReadDeadline(time.Now().Add(s.IdleTimeout))
+	}
+}
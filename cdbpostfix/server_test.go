@@ -0,0 +1,178 @@
+package cdbpostfix_test
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/perbu/cdb"
+	"github.com/perbu/cdb/cdbpostfix"
+)
+
+func buildDB(t *testing.T, records ...string) *cdb.InMemoryCDB {
+	t.Helper()
+	b := cdb.NewBuilder()
+	for i := 0; i < len(records); i += 2 {
+		if err := b.Put([]byte(records[i]), []byte(records[i+1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db, err := b.InMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// startServer runs serve on a TCP port and returns a connection to it.
+func startServer(t *testing.T, s *cdbpostfix.Server, serve func(net.Listener) error) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- serve(l) }()
+	t.Cleanup(func() {
+		if err := s.Close(); err != nil {
+			t.Error(err)
+		}
+		if err := <-done; !errors.Is(err, cdbpostfix.ErrServerClosed) {
+			t.Errorf("Serve = %v, want ErrServerClosed", err)
+		}
+	})
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, bufio.NewReader(conn)
+}
+
+func netstring(s string) string {
+	return strconv.Itoa(len(s)) + ":" + s + ","
+}
+
+func roundTrip(t *testing.T, conn net.Conn, r *bufio.Reader, request, want string) string {
+	t.Helper()
+	if _, err := io.WriteString(conn, request); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, len(want))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatalf("reading response to %q: %v, got %q", request, err, buf)
+	}
+	return string(buf)
+}
+
+func TestSocketmap(t *testing.T) {
+	s := &cdbpostfix.Server{}
+	s.Handle("transport", buildDB(t, "example.com", "smtp:[mx.example.com]", "empty.com", ""))
+	// postmap -N writes keys and values with a terminating null byte.
+	s.Handle("aliases", buildDB(t, "root\x00", "admin@example.com\x00"))
+	conn, r := startServer(t, s, s.ServeSocketmap)
+
+	tests := []struct {
+		request, response string
+	}{
+		{netstring("transport example.com"), netstring("OK smtp:[mx.example.com]")},
+		{netstring("transport empty.com"), netstring("OK ")},
+		{netstring("transport example.org"), netstring("NOTFOUND ")},
+		{netstring("aliases root"), netstring("OK admin@example.com")},
+		{netstring("aliases example.com"), netstring("NOTFOUND ")},
+		{netstring("virtual example.com"), netstring("PERM no such map")},
+		{netstring("transport"), netstring("PERM malformed request")},
+		// Pipelined requests are answered in order.
+		{netstring("aliases root") + netstring("transport example.com"),
+			netstring("OK admin@example.com") + netstring("OK smtp:[mx.example.com]")},
+	}
+	for _, tt := range tests {
+		if got := roundTrip(t, conn, r, tt.request, tt.response); got != tt.response {
+			t.Errorf("%q = %q, want %q", tt.request, got, tt.response)
+		}
+	}
+
+	// A malformed netstring ends the connection.
+	if _, err := io.WriteString(conn, "5:abc"+netstring("transport example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("read after a malformed netstring = %v, want EOF", err)
+	}
+}
+
+func TestTCPTable(t *testing.T) {
+	s := &cdbpostfix.Server{}
+	s.Handle("virtual", buildDB(t, "user@example.com", "user@example.org", "with space", "a b%c", "postmap\x00", "x\x00"))
+	conn, r := startServer(t, s, func(l net.Listener) error { return s.ServeTCPTable(l, "virtual") })
+
+	tests := []struct {
+		request, response string
+	}{
+		{"get user@example.com\n", "200 user@example.org\n"},
+		{"get with%20space\r\n", "200 a%20b%25c\n"},
+		{"get postmap\n", "200 x\n"},
+		{"get nobody@example.com\n", "500 not found\n"},
+		{"get bad%2\n", "400 malformed key\n"},
+		{"put user@example.com x\n", "500 read-only table\n"},
+		{"delete user@example.com\n", "400 unknown request\n"},
+		{"get user@example.com\nget missing\n", "200 user@example.org\n500 not found\n"},
+	}
+	for _, tt := range tests {
+		if got := roundTrip(t, conn, r, tt.request, tt.response); got != tt.response {
+			t.Errorf("%q = %q, want %q", tt.request, got, tt.response)
+		}
+	}
+
+	// A listener for a map that is not registered fails its requests.
+	conn, r = startServer(t, s, func(l net.Listener) error { return s.ServeTCPTable(l, "missing") })
+	if got := roundTrip(t, conn, r, "get x\n", "400 no%20such%20map\n"); got != "400 no%20such%20map\n" {
+		t.Errorf("get from a missing map = %q", got)
+	}
+}
+
+func TestHandleReloading(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transport.cdb")
+	write := func(value string) {
+		w, err := cdb.CreateAtomic(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Put([]byte("example.com"), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("smtp:[old.example.com]")
+	reloader, err := cdb.OpenReloader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloader.Close()
+
+	s := &cdbpostfix.Server{}
+	s.HandleReloading("transport", reloader)
+	conn, r := startServer(t, s, s.ServeSocketmap)
+
+	lookup := func(want string) {
+		t.Helper()
+		if got := roundTrip(t, conn, r, netstring("transport example.com"), want); got != want {
+			t.Errorf("transport example.com = %q, want %q", got, want)
+		}
+	}
+	lookup(netstring("OK smtp:[old.example.com]"))
+	write("smtp:[new.example.com]")
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	lookup(netstring("OK smtp:[new.example.com]"))
+}
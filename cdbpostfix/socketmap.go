@@ -0,0 +1,107 @@
+package cdbpostfix
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// maxNetstringLength is the longest request or reply, the default of
+// Postfix's socketmap_max_reply_len.
+const maxNetstringLength = 100000
+
+var errBadNetstring = errors.New("malformed netstring")
+
+// serveSocketmap answers socketmap requests, netstrings holding a map name
+// and a key separated by a space, with netstrings holding "OK" and the value,
+// "NOTFOUND", "TEMP" and a reason for errors that may go away, or "PERM" and
+// a reason for those that will not. A request that is not a netstring ends
+// the connection, since the next one cannot be found.
+func (s *Server) serveSocketmap(nc net.Conn) {
+	r := bufio.NewReaderSize(nc, 16<<10)
+	w := bufio.NewWriterSize(nc, 16<<10)
+	for {
+		s.setDeadline(nc)
+		request, err := readNetstring(r)
+		if err != nil {
+			_ = w.Flush()
+			return
+		}
+		s.socketmapRequest(w, request)
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) socketmapRequest(w *bufio.Writer, request []byte) {
+	name, key, ok := bytes.Cut(request, []byte(" "))
+	if !ok || len(name) == 0 {
+		writeNetstring(w, "PERM malformed request", nil)
+		return
+	}
+	value, release, err := s.lookup(string(name), key)
+	switch {
+	case errors.Is(err, errNoMap):
+		writeNetstring(w, "PERM no such map", nil)
+	case err != nil:
+		writeNetstring(w, "TEMP "+err.Error(), nil)
+	case value == nil:
+		release()
+		writeNetstring(w, "NOTFOUND ", nil)
+	case len("OK ")+len(value) > maxNetstringLength:
+		release()
+		writeNetstring(w, "PERM value too long", nil)
+	default:
+		writeNetstring(w, "OK ", value)
+		release()
+	}
+}
+
+// readNetstring reads a netstring, "length:data,", and returns its data,
+// which is only valid until the next read from r.
+func readNetstring(r *bufio.Reader) ([]byte, error) {
+	prefix, err := r.ReadSlice(':')
+	if err != nil {
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return nil, errBadNetstring
+		}
+		return nil, err
+	}
+	n, err := strconv.Atoi(string(prefix[:len(prefix)-1]))
+	if err != nil || n < 0 || n > maxNetstringLength {
+		return nil, errBadNetstring
+	}
+
+	var data []byte
+	if n+1 <= r.Size() {
+		data, err = r.Peek(n + 1)
+		if err == nil {
+			_, _ = r.Discard(n + 1)
+		}
+	} else {
+		data = make([]byte, n+1)
+		_, err = io.ReadFull(r, data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if data[n] != ',' {
+		return nil, errBadNetstring
+	}
+	return data[:n], nil
+}
+
+// writeNetstring writes the concatenation of prefix and data as a netstring.
+func writeNetstring(w *bufio.Writer, prefix string, data []byte) {
+	fmt.Fprintf(w, "%d:", len(prefix)+len(data))
+	w.WriteString(prefix)
+	w.Write(data)
+	w.WriteByte(',')
+}
@@ -0,0 +1,120 @@
+package cdbpostfix
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+)
+
+// serveTCPTable answers tcp_table requests for the map name: lines "get key"
+// are answered with "200 value" if the key is found, "500" if it is not, and
+// "400" on errors. Keys and values are encoded with %XX escapes for white
+// space, control characters, '%' and bytes above 0x7e.
+func (s *Server) serveTCPTable(nc net.Conn, name string) {
+	r := bufio.NewReaderSize(nc, 16<<10)
+	w := bufio.NewWriterSize(nc, 16<<10)
+	for {
+		s.setDeadline(nc)
+		line, err := r.ReadSlice('\n')
+		if err != nil {
+			if errors.Is(err, bufio.ErrBufferFull) {
+				// The rest of a line longer than the buffer cannot be
+				// told apart from the next request.
+				w.WriteString("400 line too long\n")
+			}
+			_ = w.Flush()
+			return
+		}
+		line = bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+		s.tcpTableRequest(w, name, line)
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) tcpTableRequest(w *bufio.Writer, name string, line []byte) {
+	cmd, arg, _ := bytes.Cut(line, []byte(" "))
+	switch string(cmd) {
+	case "get":
+	case "put":
+		w.WriteString("500 read-only table\n")
+		return
+	default:
+		w.WriteString("400 unknown request\n")
+		return
+	}
+	key, ok := unescape(arg)
+	if !ok {
+		w.WriteString("400 malformed key\n")
+		return
+	}
+
+	value, release, err := s.lookup(name, key)
+	switch {
+	case err != nil:
+		w.WriteString("400 ")
+		w.Write(escape(nil, []byte(err.Error())))
+	case value == nil:
+		release()
+		w.WriteString("500 not found")
+	default:
+		w.WriteString("200 ")
+		w.Write(escape(w.AvailableBuffer(), value))
+		release()
+	}
+	w.WriteByte('\n')
+}
+
+const hexDigits = "0123456789ABCDEF"
+
+// escape appends s to b with %XX escapes.
+func escape(b, s []byte) []byte {
+	for _, c := range s {
+		if c <= ' ' || c > '~' || c == '%' {
+			b = append(b, '%', hexDigits[c>>4], hexDigits[c&0xf])
+		} else {
+			b = append(b, c)
+		}
+	}
+	return b
+}
+
+// unescape decodes %XX escapes in s.
+func unescape(s []byte) ([]byte, bool) {
+	if bytes.IndexByte(s, '%') < 0 {
+		return s, true
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b = append(b, s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return nil, false
+		}
+		hi, lo := unhex(s[i+1]), unhex(s[i+2])
+		if hi < 0 || lo < 0 {
+			return nil, false
+		}
+		b = append(b, byte(hi<<4|lo))
+		i += 2
+	}
+	return b, true
+}
+
+func unhex(c byte) int {
+	switch {
+	case '0' <= c && c <= '9':
+		return int(c - '0')
+	case 'a' <= c && c <= 'f':
+		return int(c-'a') + 10
+	case 'A' <= c && c <= 'F':
+		return int(c-'A') + 10
+	}
+	return -1
+}
@@ -0,0 +1,435 @@
+package cdbredis
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/perbu/cdb"
+)
+
+// recordReader is implemented by readers whose records can be addressed by
+// offset, which SCAN uses as its cursor.
+type recordReader interface {
+	RecordAt(offset uint64) (key, value []byte, next uint64, err error)
+}
+
+// command executes one command. It returns an error only if the connection
+// must be closed.
+func (c *conn) command(args [][]byte) error {
+	name := strings.ToLower(string(args[0]))
+	args = args[1:]
+	arity := func(min, max int) bool {
+		if len(args) < min || (max >= 0 && len(args) > max) {
+			c.errorf("ERR wrong number of arguments for '%s' command", name)
+			return false
+		}
+		return true
+	}
+
+	switch name {
+	case "ping":
+		if !arity(0, 1) {
+			return nil
+		}
+		if len(args) == 1 {
+			c.bulk(args[0])
+		} else {
+			c.simple("PONG")
+		}
+	case "echo":
+		if arity(1, 1) {
+			c.bulk(args[0])
+		}
+	case "quit":
+		c.simple("OK")
+		return errQuit
+	case "hello":
+		c.hello(args)
+	case "select":
+		if !arity(1, 1) {
+			return nil
+		}
+		if string(args[0]) != "0" {
+			c.errorf("ERR DB index is out of range")
+			return nil
+		}
+		c.simple("OK")
+	case "client":
+		c.client(args)
+	case "command":
+		c.array(0)
+	case "info":
+		c.info()
+	case "get", "strlen", "type", "ttl", "pttl":
+		if arity(1, 1) {
+			c.lookup(name, args[0])
+		}
+	case "mget":
+		if arity(1, -1) {
+			c.mget(args)
+		}
+	case "exists":
+		if arity(1, -1) {
+			c.exists(args)
+		}
+	case "dbsize":
+		if arity(0, 0) {
+			c.withDB(func(db cdb.Reader) {
+				c.integer(c.s.dbsize(db))
+			})
+		}
+	case "scan":
+		if arity(1, -1) {
+			c.scan(args)
+		}
+	default:
+		if mutating[name] {
+			c.errorf("READONLY You can't write against a read-only database")
+			return nil
+		}
+		c.errorf("ERR unknown command '%s'", name)
+	}
+	return nil
+}
+
+// withDB calls fn with the current database, or answers with an error if
+// there is none.
+func (c *conn) withDB(fn func(db cdb.Reader)) {
+	db, release, err := c.s.acquire()
+	if err != nil {
+		c.errorf("ERR %v", err)
+		return
+	}
+	defer release()
+	fn(db)
+}
+
+// hello answers HELLO [protover [AUTH username password] [SETNAME name]].
+// There are no users, so any credentials are accepted, like Redis does for
+// its default user without a password.
+func (c *conn) hello(args [][]byte) {
+	proto := c.proto
+	if len(args) > 0 {
+		v, err := strconv.Atoi(string(args[0]))
+		if err != nil {
+			c.errorf("ERR Protocol version is not an integer or out of range")
+			return
+		}
+		if v != 2 && v != 3 {
+			c.errorf("NOPROTO unsupported protocol version")
+			return
+		}
+		proto = v
+		for i := 1; i < len(args); i++ {
+			switch strings.ToLower(string(args[i])) {
+			case "auth":
+				i += 2
+			case "setname":
+				i++
+			default:
+				c.errorf("ERR Syntax error in HELLO option '%s'", args[i])
+				return
+			}
+			if i >= len(args) {
+				c.errorf("ERR Syntax error in HELLO option")
+				return
+			}
+		}
+	}
+	c.proto = proto
+
+	c.mapHeader(7)
+	c.bulkString("server")
+	c.bulkString("redis")
+	c.bulkString("version")
+	c.bulkString(c.s.version())
+	c.bulkString("proto")
+	c.integer(int64(proto))
+	c.bulkString("id")
+	c.integer(c.id)
+	c.bulkString("mode")
+	c.bulkString("standalone")
+	c.bulkString("role")
+	c.bulkString("master")
+	c.bulkString("modules")
+	c.array(0)
+}
+
+// client answers the CLIENT subcommands that client libraries send when
+// they connect.
+func (c *conn) client(args [][]byte) {
+	if len(args) == 0 {
+		c.errorf("ERR wrong number of arguments for 'client' command")
+		return
+	}
+	switch strings.ToLower(string(args[0])) {
+	case "setname", "setinfo":
+		c.simple("OK")
+	case "getname":
+		c.null()
+	case "id":
+		c.integer(c.id)
+	default:
+		c.errorf("ERR unknown subcommand '%s'", args[0])
+	}
+}
+
+// info answers INFO with the server and keyspace sections.
+func (c *conn) info() {
+	c.withDB(func(db cdb.Reader) {
+		var b strings.Builder
+		fmt.Fprintf(&b, "# Server\r\nredis_version:%s\r\nredis_mode:standalone\r\n", c.s.version())
+		fmt.Fprintf(&b, "process_id:%d\r\nuptime_in_seconds:%d\r\n", os.Getpid(), int64(time.Since(c.s.started).Seconds()))
+		fmt.Fprintf(&b, "\r\n# Keyspace\r\ndb0:keys=%d,expires=0,avg_ttl=0\r\n", c.s.dbsize(db))
+		c.bulkString(b.String())
+	})
+}
+
+// lookup answers the single-key commands.
+func (c *conn) lookup(name string, key []byte) {
+	c.withDB(func(db cdb.Reader) {
+		value, err := db.Get(key)
+		if err != nil {
+			c.errorf("ERR %v", err)
+			return
+		}
+		switch name {
+		case "get":
+			if value == nil {
+				c.null()
+			} else {
+				c.bulk(value)
+			}
+		case "strlen":
+			c.integer(int64(len(value)))
+		case "type":
+			if value == nil {
+				c.simple("none")
+			} else {
+				c.simple("string")
+			}
+		case "ttl", "pttl":
+			// -1 means no expiry, -2 that the key does not exist.
+			if value == nil {
+				c.integer(-2)
+			} else {
+				c.integer(-1)
+			}
+		}
+	})
+}
+
+func (c *conn) mget(keys [][]byte) {
+	c.withDB(func(db cdb.Reader) {
+		values := make([][]byte, len(keys))
+		for i, key := range keys {
+			value, err := db.Get(key)
+			if err != nil {
+				c.errorf("ERR %v", err)
+				return
+			}
+			values[i] = value
+		}
+		c.array(len(values))
+		for _, value := range values {
+			if value == nil {
+				c.null()
+			} else {
+				c.bulk(value)
+			}
+		}
+	})
+}
+
+// exists counts the keys that exist, counting repeated keys repeatedly like
+// Redis does.
+func (c *conn) exists(keys [][]byte) {
+	c.withDB(func(db cdb.Reader) {
+		var n int64
+		for _, key := range keys {
+			value, err := db.Get(key)
+			if err != nil {
+				c.errorf("ERR %v", err)
+				return
+			}
+			if value != nil {
+				n++
+			}
+		}
+		c.integer(n)
+	})
+}
+
+// scan answers SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]. COUNT
+// is the number of records examined, of which only those matching the
+// pattern are returned. All keys have the type string.
+func (c *conn) scan(args [][]byte) {
+	cursor, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		c.errorf("ERR invalid cursor")
+		return
+	}
+	var pattern []byte
+	count := defaultScanCount
+	typeOK := true
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			c.errorf("ERR syntax error")
+			return
+		}
+		switch strings.ToLower(string(args[i])) {
+		case "match":
+			pattern = args[i+1]
+		case "count":
+			count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil || count < 1 {
+				c.errorf("ERR value is out of range, must be positive")
+				return
+			}
+		case "type":
+			typeOK = strings.EqualFold(string(args[i+1]), "string")
+		default:
+			c.errorf("ERR syntax error")
+			return
+		}
+	}
+
+	c.withDB(func(db cdb.Reader) {
+		var keys [][]byte
+		add := func(key []byte) {
+			if typeOK && (pattern == nil || match(pattern, key)) {
+				keys = append(keys, key)
+			}
+		}
+
+		var next uint64
+		if rr, ok := db.(recordReader); ok {
+			next = cursor
+			for i := 0; i < count; i++ {
+				key, _, n, err := rr.RecordAt(next)
+				if errors.Is(err, io.EOF) {
+					next = 0
+					break
+				}
+				if err != nil {
+					c.errorf("ERR invalid cursor")
+					return
+				}
+				add(key)
+				next = n
+				if next == 0 {
+					break
+				}
+			}
+		} else {
+			// Without offsets, the cursor is the number of records
+			// already scanned.
+			var i uint64
+			for key := range db.Keys() {
+				if i >= cursor+uint64(count) {
+					next = i
+					break
+				}
+				if i >= cursor {
+					add(key)
+				}
+				i++
+			}
+		}
+
+		c.array(2)
+		c.bulkString(strconv.FormatUint(next, 10))
+		c.array(len(keys))
+		for _, key := range keys {
+			c.bulk(key)
+		}
+	})
+}
+
+// match reports whether s matches the glob-style pattern of KEYS and SCAN:
+// * matches any sequence, ? any byte, [abc], [^abc] and [a-z] a set of
+// bytes, and a backslash quotes the next byte.
+//
+// Patterns come from clients, so match does not recurse on *. It only
+// remembers the last * seen and, on a mismatch, retries from there with one
+// more byte of s consumed by it, which takes O(len(pattern)*len(s)) time.
+func match(pattern, s []byte) bool {
+	var p, i int
+	star, starI := -1, 0
+	for i < len(s) {
+		if p < len(pattern) {
+			if pattern[p] == '*' {
+				star, starI = p, i
+				p++
+				continue
+			}
+			if n, ok := matchOne(pattern[p:], s[i]); ok {
+				p += n
+				i++
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		starI++
+		p, i = star+1, starI
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchOne matches b against the element at the start of pattern, which is
+// not *, and returns the length of the element.
+func matchOne(pattern []byte, b byte) (int, bool) {
+	switch pattern[0] {
+	case '?':
+		return 1, true
+	case '[':
+		end := bytes.IndexByte(pattern[1:], ']')
+		if end < 0 {
+			// An unterminated set matches itself literally.
+			return 1, b == '['
+		}
+		return 2 + end, matchSet(pattern[1:1+end], b)
+	case '\\':
+		if len(pattern) > 1 {
+			return 2, b == pattern[1]
+		}
+	}
+	return 1, b == pattern[0]
+}
+
+// matchSet reports whether b is in a set such as abc, ^abc or a-z.
+func matchSet(set []byte, b byte) bool {
+	negate := len(set) > 0 && set[0] == '^'
+	if negate {
+		set = set[1:]
+	}
+	found := false
+	for i := 0; i < len(set); i++ {
+		if i+2 < len(set) && set[i+1] == '-' {
+			lo, hi := set[i], set[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			if lo <= b && b <= hi {
+				found = true
+			}
+			i += 2
+			continue
+		}
+		if set[i] == b {
+			found = true
+		}
+	}
+	return found != negate
+}
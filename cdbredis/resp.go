@@ -0,0 +1,126 @@
+package cdbredis
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// readCommand reads a multi-bulk request, or an inline command as sent by
+// telnet, and returns its arguments. An empty inline line returns no
+// arguments.
+func (c *conn) readCommand() ([][]byte, error) {
+	first, err := c.r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] != '*' {
+		line, err := c.readLine(maxInlineLength)
+		if err != nil {
+			return nil, err
+		}
+		var args [][]byte
+		for _, f := range bytes.Fields(line) {
+			args = append(args, append([]byte(nil), f...))
+		}
+		return args, nil
+	}
+
+	n, err := c.readLength('*', maxArgs)
+	if err != nil {
+		return nil, err
+	}
+	args := make([][]byte, 0, n)
+	for range n {
+		size, err := c.readLength('$', maxBulkLength)
+		if err != nil {
+			return nil, err
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, arg); err != nil {
+			return nil, err
+		}
+		if arg[size] != '\r' || arg[size+1] != '\n' {
+			return nil, c.protocolError("expected '\\r\\n' after bulk string")
+		}
+		args = append(args, arg[:size])
+	}
+	return args, nil
+}
+
+// readLength reads a header line such as *3 or $5 and returns its length.
+func (c *conn) readLength(prefix byte, max int) (int, error) {
+	line, err := c.readLine(maxInlineLength)
+	if err != nil {
+		return 0, err
+	}
+	if len(line) == 0 || line[0] != prefix {
+		return 0, c.protocolError(fmt.Sprintf("expected '%c', got '%q'", prefix, line))
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n < 0 {
+		return 0, c.protocolError("invalid length")
+	}
+	if n > max {
+		return 0, c.protocolError("request too large")
+	}
+	return n, nil
+}
+
+func (c *conn) simple(s string) {
+	c.w.WriteByte('+')
+	c.w.WriteString(s)
+	c.w.WriteString("\r\n")
+}
+
+func (c *conn) errorf(format string, args ...any) {
+	c.w.WriteByte('-')
+	fmt.Fprintf(c.w, format, args...)
+	c.w.WriteString("\r\n")
+}
+
+func (c *conn) header(prefix byte, n int64) {
+	c.buf = append(c.buf[:0], prefix)
+	c.buf = strconv.AppendInt(c.buf, n, 10)
+	c.buf = append(c.buf, '\r', '\n')
+	c.w.Write(c.buf)
+}
+
+func (c *conn) integer(n int64) {
+	c.header(':', n)
+}
+
+func (c *conn) bulk(b []byte) {
+	c.header('$', int64(len(b)))
+	c.w.Write(b)
+	c.w.WriteString("\r\n")
+}
+
+func (c *conn) bulkString(s string) {
+	c.header('$', int64(len(s)))
+	c.w.WriteString(s)
+	c.w.WriteString("\r\n")
+}
+
+// null writes a nil reply: a null bulk string in RESP2, a null in RESP3.
+func (c *conn) null() {
+	if c.proto == 3 {
+		c.w.WriteString("_\r\n")
+		return
+	}
+	c.w.WriteString("$-1\r\n")
+}
+
+func (c *conn) array(n int) {
+	c.header('*', int64(n))
+}
+
+// mapHeader starts a map of n pairs, which RESP2 sends as a flat array.
+func (c *conn) mapHeader(n int) {
+	if c.proto == 3 {
+		c.header('%', int64(n))
+		return
+	}
+	c.header('*', int64(2*n))
+}
@@ -0,0 +1,236 @@
+// Package cdbredis serves a CDB database to Redis clients, read-only.
+//
+// A Server speaks RESP2 and, after HELLO 3, RESP3, and accepts both
+// multi-bulk and inline commands, so redis-cli and client libraries work
+// unchanged. It answers GET, MGET, EXISTS, STRLEN, TYPE, TTL, PTTL, SCAN and
+// DBSIZE from the database, along with the connection commands clients send
+// on their own: PING, ECHO, HELLO, SELECT 0, CLIENT, COMMAND, INFO and QUIT.
+// Commands that would modify the database fail with a READONLY error.
+// Pipelined commands are answered in order, with one write per batch.
+//
+// The cursor of SCAN is the offset of the next record in the file, so a scan
+// visits every record exactly once, duplicates included, and costs nothing
+// to resume. A cursor from before a reload is rejected if it does not point
+// at a record of the new database. Likewise, DBSIZE and the keyspace section
+// of INFO count records, so a key written several times counts once for
+// each of its records.
+package cdbredis
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/perbu/cdb"
+	"github.com/perbu/cdb/internal/netserver"
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Close.
+var ErrServerClosed = netserver.ErrServerClosed
+
+// DefaultVersion is reported by HELLO and INFO if Server.Version is empty.
+const DefaultVersion = "7.0.0-cdb"
+
+const (
+	// maxArgs and maxBulkLength bound the size of a request. Keys and the
+	// arguments of the commands a read-only server answers are small.
+	maxArgs       = 1 << 20
+	maxBulkLength = 1 << 20
+	// maxInlineLength limits the length of an inline command.
+	maxInlineLength = 64 << 10
+	// defaultScanCount is the number of records SCAN examines by default.
+	defaultScanCount = 10
+)
+
+// mutating lists the commands that modify data and fail with READONLY.
+var mutating = map[string]bool{
+	"set": true, "setnx": true, "setex": true, "psetex": true, "mset": true, "msetnx": true,
+	"getset": true, "getdel": true, "getex": true, "append": true, "setrange": true,
+	"incr": true, "incrby": true, "incrbyfloat": true, "decr": true, "decrby": true,
+	"del": true, "unlink": true, "rename": true, "renamenx": true, "move": true, "copy": true,
+	"expire": true, "pexpire": true, "expireat": true, "pexpireat": true, "persist": true,
+	"flushdb": true, "flushall": true, "swapdb": true, "restore": true,
+	"hset": true, "hsetnx": true, "hmset": true, "hdel": true, "hincrby": true,
+	"lpush": true, "rpush": true, "lpop": true, "rpop": true, "lset": true, "lrem": true,
+	"sadd": true, "srem": true, "spop": true, "zadd": true, "zrem": true, "zincrby": true,
+}
+
+// Server serves a database over the Redis protocol. Configure it by setting
+// the exported fields before calling Serve.
+type Server struct {
+	// Version is reported by HELLO and INFO. If empty, DefaultVersion is
+	// used.
+	Version string
+	// IdleTimeout closes connections that have not sent a command for this
+	// long. If zero, connections never time out.
+	IdleTimeout time.Duration
+
+	acquire func() (cdb.Reader, func(), error)
+	started time.Time
+	srv     netserver.Server
+	nextID  atomic.Int64
+
+	// sizeMu guards the record count of sizeOf, the database DBSIZE last
+	// counted, so that it is counted once per version.
+	sizeMu sync.Mutex
+	sizeOf cdb.Reader
+	size   int64
+}
+
+// New returns a Server for r. The server does not close r.
+func New(r cdb.Reader) *Server {
+	return newServer(func() (cdb.Reader, func(), error) {
+		return r, func() {}, nil
+	})
+}
+
+// NewReloading returns a Server for the current database of r. Each command
+// is answered from the database that was current when it was read.
+func NewReloading(r *cdb.Reloader) *Server {
+	return newServer(func() (cdb.Reader, func(), error) {
+		db, release, err := r.Acquire()
+		if err != nil {
+			return nil, nil, err
+		}
+		return db, release, nil
+	})
+}
+
+func newServer(acquire func() (cdb.Reader, func(), error)) *Server {
+	return &Server{acquire: acquire, started: time.Now()}
+}
+
+// ListenAndServe listens on the given network, "tcp" or "unix", and address
+// and calls Serve.
+func (s *Server) ListenAndServe(network, address string) error {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return fmt.Errorf("net.Listen(%q, %q): %w", network, address, err)
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l and serves each in its own goroutine until
+// Close is called, after which it returns ErrServerClosed. Serve closes l.
+func (s *Server) Serve(l net.Listener) error {
+	return s.srv.Serve(l, s.serveConn)
+}
+
+// Close stops all listeners, closes all connections and waits for their
+// goroutines to return.
+func (s *Server) Close() error {
+	return s.srv.Close()
+}
+
+func (s *Server) version() string {
+	if s.Version != "" {
+		return s.Version
+	}
+	return DefaultVersion
+}
+
+// statser is implemented by readers that count their records from their
+// hash tables, without reading the records.
+type statser interface {
+	Stats() cdb.Stats
+}
+
+// dbsize returns the number of records in db. It is counted once per
+// database, outside sizeMu, so that callers do not wait for each other.
+func (s *Server) dbsize(db cdb.Reader) int64 {
+	s.sizeMu.Lock()
+	if s.sizeOf == db {
+		defer s.sizeMu.Unlock()
+		return s.size
+	}
+	s.sizeMu.Unlock()
+
+	var n int64
+	if st, ok := db.(statser); ok {
+		n = int64(st.Stats().Records)
+	} else {
+		for range db.Keys() {
+			n++
+		}
+	}
+
+	s.sizeMu.Lock()
+	defer s.sizeMu.Unlock()
+	s.sizeOf, s.size = db, n
+	return n
+}
+
+// errQuit ends a connection after QUIT or a protocol error.
+var errQuit = errors.New("quit")
+
+// conn is the state of one client connection.
+type conn struct {
+	s     *Server
+	r     *bufio.Reader
+	w     *bufio.Writer
+	id    int64
+	proto int
+	buf   []byte
+}
+
+func (s *Server) serveConn(nc net.Conn) {
+	c := &conn{
+		s:     s,
+		r:     bufio.NewReaderSize(nc, 16<<10),
+		w:     bufio.NewWriterSize(nc, 16<<10),
+		id:    s.nextID.Add(1),
+		proto: 2,
+	}
+	for {
+		if s.IdleTimeout > 0 {
+			_ = nc.SetReadDeadline(time.Now().Add(s.IdleTimeout))
+		}
+		args, err := c.readCommand()
+		if err == nil && len(args) > 0 {
+			err = c.command(args)
+		}
+		if err != nil {
+			_ = c.w.Flush()
+			return
+		}
+		// Answer a pipelined batch of commands with as few writes as
+		// possible, flushing once no more input is waiting.
+		if c.r.Buffered() == 0 {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// protocolError answers a malformed request. The connection is closed
+// afterwards, since the rest of the input cannot be parsed reliably.
+func (c *conn) protocolError(msg string) error {
+	c.errorf("ERR Protocol error: %s", msg)
+	return errQuit
+}
+
+// readLine reads a line of at most max bytes without its line ending.
+func (c *conn) readLine(max int) ([]byte, error) {
+	line, err := c.r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		buf := append([]byte(nil), line...)
+		for errors.Is(err, bufio.ErrBufferFull) && len(buf) <= max {
+			line, err = c.r.ReadSlice('\n')
+			buf = append(buf, line...)
+		}
+		line = buf
+	}
+	if len(line) > max {
+		return nil, c.protocolError("too big inline request")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(line[:len(line)-1], []byte("\r")), nil
+}
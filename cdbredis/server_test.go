@@ -0,0 +1,251 @@
+package cdbredis_test
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/perbu/cdb"
+	"github.com/perbu/cdb/cdbredis"
+)
+
+// startServer serves r on a TCP port and returns a connection to it.
+func startServer(t *testing.T, r cdb.Reader) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := cdbredis.New(r)
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(l) }()
+	t.Cleanup(func() {
+		if err := s.Close(); err != nil {
+			t.Error(err)
+		}
+		if err := <-done; !errors.Is(err, cdbredis.ErrServerClosed) {
+			t.Errorf("Serve = %v, want ErrServerClosed", err)
+		}
+	})
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, bufio.NewReader(conn)
+}
+
+func buildDB(t *testing.T, records ...string) *cdb.InMemoryCDB {
+	t.Helper()
+	b := cdb.NewBuilder()
+	for i := 0; i < len(records); i += 2 {
+		if err := b.Put([]byte(records[i]), []byte(records[i+1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db, err := b.InMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// encode returns args as a multi-bulk request.
+func encode(args ...string) string {
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		b.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	return b.String()
+}
+
+func roundTrip(t *testing.T, conn net.Conn, r *bufio.Reader, request, want string) string {
+	t.Helper()
+	if _, err := io.WriteString(conn, request); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, len(want))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatalf("reading response to %q: %v, got %q", request, err, buf)
+	}
+	return string(buf)
+}
+
+func TestServer(t *testing.T) {
+	conn, r := startServer(t, buildDB(t, "a", "1", "b", "hello", "empty", ""))
+
+	tests := []struct {
+		request, response string
+	}{
+		{encode("PING"), "+PONG\r\n"},
+		{"PING\r\n", "+PONG\r\n"},
+		{encode("GET", "a"), "$1\r\n1\r\n"},
+		{"get b\r\n", "$5\r\nhello\r\n"},
+		{encode("GET", "empty"), "$0\r\n\r\n"},
+		{encode("GET", "missing"), "$-1\r\n"},
+		{encode("MGET", "a", "missing", "b"), "*3\r\n$1\r\n1\r\n$-1\r\n$5\r\nhello\r\n"},
+		{encode("EXISTS", "a", "a", "missing"), ":2\r\n"},
+		{encode("STRLEN", "b"), ":5\r\n"},
+		{encode("STRLEN", "missing"), ":0\r\n"},
+		{encode("TYPE", "a"), "+string\r\n"},
+		{encode("TTL", "missing"), ":-2\r\n"},
+		{encode("DBSIZE"), ":3\r\n"},
+		{encode("SET", "a", "2"), "-READONLY You can't write against a read-only database\r\n"},
+		{encode("DEL", "a"), "-READONLY You can't write against a read-only database\r\n"},
+		{encode("GET"), "-ERR wrong number of arguments for 'get' command\r\n"},
+		{encode("FOO"), "-ERR unknown command 'foo'\r\n"},
+		{encode("SELECT", "1"), "-ERR DB index is out of range\r\n"},
+		// Pipelined commands are answered in order.
+		{encode("GET", "a") + encode("SET", "x", "y") + encode("GET", "b"),
+			"$1\r\n1\r\n-READONLY You can't write against a read-only database\r\n$5\r\nhello\r\n"},
+		{encode("HELLO", "3"), "%7\r\n$6\r\nserver\r\n$5\r\nredis\r\n$7\r\nversion\r\n$9\r\n" + cdbredis.DefaultVersion +
+			"\r\n$5\r\nproto\r\n:3\r\n$2\r\nid\r\n:1\r\n$4\r\nmode\r\n$10\r\nstandalone\r\n$4\r\nrole\r\n$6\r\nmaster\r\n$7\r\nmodules\r\n*0\r\n"},
+		{encode("GET", "missing"), "_\r\n"},
+		{encode("HELLO", "4"), "-NOPROTO unsupported protocol version\r\n"},
+		{encode("QUIT"), "+OK\r\n"},
+	}
+	for _, tt := range tests {
+		if got := roundTrip(t, conn, r, tt.request, tt.response); got != tt.response {
+			t.Errorf("%q = %q, want %q", tt.request, got, tt.response)
+		}
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("read after QUIT = %v, want EOF", err)
+	}
+}
+
+// scanAll runs SCAN until the cursor is 0 again and returns the keys.
+func scanAll(t *testing.T, r cdb.Reader, args ...string) []string {
+	t.Helper()
+	conn, br := startServer(t, r)
+	var keys []string
+	cursor := "0"
+	for i := 0; ; i++ {
+		if _, err := io.WriteString(conn, encode(append([]string{"SCAN", cursor}, args...)...)); err != nil {
+			t.Fatal(err)
+		}
+		reply := readReply(t, br).([]any)
+		cursor = reply[0].(string)
+		for _, key := range reply[1].([]any) {
+			keys = append(keys, key.(string))
+		}
+		if cursor == "0" {
+			return keys
+		}
+		if i > 100 {
+			t.Fatal("SCAN does not terminate")
+		}
+	}
+}
+
+// readReply parses a RESP2 reply of bulk strings and arrays.
+func readReply(t *testing.T, r *bufio.Reader) any {
+	t.Helper()
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	n := 0
+	for _, ch := range line[1:] {
+		n = n*10 + int(ch-'0')
+	}
+	switch line[0] {
+	case '$':
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	case '*':
+		items := make([]any, n)
+		for i := range items {
+			items[i] = readReply(t, r)
+		}
+		return items
+	}
+	t.Fatalf("unexpected reply %q", line)
+	return nil
+}
+
+func TestServerScan(t *testing.T) {
+	var records, all []string
+	for i := range 25 {
+		key := "key:" + strconv.Itoa(i)
+		records = append(records, key, "v")
+		all = append(all, key)
+	}
+	records = append(records, "other", "v")
+	mem := buildDB(t, records...)
+
+	if got := scanAll(t, mem, "COUNT", "7"); !slices.Equal(got, append(slices.Clone(all), "other")) {
+		t.Errorf("SCAN = %q", got)
+	}
+	if got := scanAll(t, mem, "MATCH", "key:1?", "COUNT", "4"); !slices.Equal(got, all[10:20]) {
+		t.Errorf("SCAN MATCH key:1? = %q, want %q", got, all[10:20])
+	}
+	if got := scanAll(t, mem, "MATCH", "[o]th*"); !slices.Equal(got, []string{"other"}) {
+		t.Errorf("SCAN MATCH [o]th* = %q", got)
+	}
+	if got := scanAll(t, buildDB(t)); len(got) != 0 {
+		t.Errorf("SCAN of an empty database = %q", got)
+	}
+
+	globs := buildDB(t, "a*b", "v", "a\\b", "v", "axxb", "v", "ab", "v", "[x", "v")
+	for _, tt := range []struct {
+		pattern string
+		want    []string
+	}{
+		{"a*b", []string{"a*b", "a\\b", "axxb", "ab"}},
+		{"a\\*b", []string{"a*b"}},
+		{"a\\\\b", []string{"a\\b"}},
+		{"a**x*b", []string{"axxb"}},
+		{"a??*", []string{"a*b", "a\\b", "axxb"}},
+		{"[^a]*", []string{"[x"}},
+		{"[x", []string{"[x"}},
+		{"*c*", nil},
+	} {
+		if got := scanAll(t, globs, "MATCH", tt.pattern); !slices.Equal(got, tt.want) {
+			t.Errorf("SCAN MATCH %q = %q, want %q", tt.pattern, got, tt.want)
+		}
+	}
+
+	// A pattern with many stars against a long key that almost matches
+	// takes polynomial, not exponential, time.
+	long := buildDB(t, strings.Repeat("a", 10000), "v")
+	start := time.Now()
+	if got := scanAll(t, long, "MATCH", strings.Repeat("*a", 30)+"*b"); len(got) != 0 {
+		t.Errorf("SCAN MATCH of a pathological pattern = %q", got)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("SCAN MATCH of a pathological pattern took %v", d)
+	}
+
+	conn, r := startServer(t, mem)
+	if got := roundTrip(t, conn, r, encode("SCAN", "4097"), "-ERR invalid cursor\r\n"); got != "-ERR invalid cursor\r\n" {
+		t.Errorf("SCAN with a forged cursor = %q", got)
+	}
+}
+
+func TestServerDBSizeDuplicates(t *testing.T) {
+	// DBSIZE counts records, like SCAN returns them.
+	conn, r := startServer(t, buildDB(t, "a", "1", "b", "2", "a", "3", "a", "4"))
+	if got := roundTrip(t, conn, r, encode("DBSIZE"), ":4\r\n"); got != ":4\r\n" {
+		t.Errorf("DBSIZE = %q, want :4", got)
+	}
+	if _, err := io.WriteString(conn, encode("INFO")); err != nil {
+		t.Fatal(err)
+	}
+	if info := readReply(t, r).(string); !strings.Contains(info, "db0:keys=4,") {
+		t.Errorf("INFO keyspace does not count 4 records:\n%s", info)
+	}
+}
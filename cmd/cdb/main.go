@@ -0,0 +1,430 @@
+// Command cdb reads, writes and inspects CDB databases in either the 64-bit
+// or the classic 32-bit format.
+//
+// Usage:
+//
+//	cdb get [-a] [-k format] [-o format] FILE KEY
+//	                                    print the value, or all values, of KEY
+//	cdb dump [-o format] FILE           print all records
+//	cdb keys [-o format] FILE           print all keys
+//	cdb count FILE                      print the number of records
+//	cdb stats [-json] FILE              print layout and probe statistics
+//	cdb verify FILE                     check the structure of FILE
+//	cdb make [-i format] [-32] FILE     create FILE from records on stdin
+//	cdb convert [-32] SRC DST           rewrite SRC as DST in another format
+//
+// Values and keys are printed raw, or as hex, base64 or JSON with -o. The
+// KEY argument of get is decoded from hex or base64 with -k, for keys that
+// cannot be passed as an argument, such as keys that contain NUL. Dump
+// and make use the cdbmake format by default, or JSON Lines or CSV.
+//
+// The exit status is 0 on success, 1 if get did not find the key, and 2 on
+// any error.
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"unicode/utf8"
+
+	"github.com/perbu/cdb"
+)
+
+const (
+	exitOK       = 0
+	exitNotFound = 1
+	exitError    = 2
+)
+
+var errNotFound = errors.New("key not found")
+
+// errUsage is returned for invalid arguments; the usage has been printed.
+var errUsage = errors.New("usage")
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+type command struct {
+	name  string
+	usage string
+	run   func(c *cli, args []string) error
+}
+
+var commands = []command{
+	{"get", "get [-a] [-k raw|hex|base64] [-o raw|hex|base64|json] FILE KEY", (*cli).get},
+	{"dump", "dump [-o cdbmake|jsonl|csv] FILE", (*cli).dump},
+	{"keys", "keys [-o raw|hex|base64|json] FILE", (*cli).keys},
+	{"count", "count FILE", (*cli).count},
+	{"stats", "stats [-json] FILE", (*cli).stats},
+	{"verify", "verify FILE", (*cli).verify},
+	{"make", "make [-i cdbmake|jsonl|csv] [-32] FILE < records", (*cli).make},
+	{"convert", "convert [-32] SRC DST", (*cli).convert},
+}
+
+type cli struct {
+	stdin          io.Reader
+	stdout, stderr io.Writer
+	usage          string
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	c := &cli{stdin: stdin, stdout: stdout, stderr: stderr}
+	if len(args) == 0 {
+		c.printUsage()
+		return exitError
+	}
+
+	for _, cmd := range commands {
+		if cmd.name != args[0] {
+			continue
+		}
+		c.usage = cmd.usage
+		err := cmd.run(c, args[1:])
+		switch {
+		case err == nil:
+			return exitOK
+		case errors.Is(err, errNotFound):
+			return exitNotFound
+		case errors.Is(err, errUsage):
+		default:
+			fmt.Fprintf(stderr, "cdb %s: %v\n", cmd.name, err)
+		}
+		return exitError
+	}
+
+	fmt.Fprintf(stderr, "cdb: unknown command %q\n", args[0])
+	c.printUsage()
+	return exitError
+}
+
+func (c *cli) printUsage() {
+	fmt.Fprintln(c.stderr, "usage:")
+	for _, cmd := range commands {
+		fmt.Fprintf(c.stderr, "  cdb %s\n", cmd.usage)
+	}
+}
+
+// flags returns a FlagSet for the current command that prints its usage.
+func (c *cli) flags() *flag.FlagSet {
+	fs := flag.NewFlagSet(c.usage, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(c.stderr, "usage: cdb %s\n", c.usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parse parses args and checks the number of positional arguments.
+func (c *cli) parse(fs *flag.FlagSet, args []string, n int) error {
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if fs.NArg() != n {
+		fs.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+func (c *cli) get(args []string) error {
+	fs := c.flags()
+	all := fs.Bool("a", false, "print all values of a duplicate key")
+	keyFormat := fs.String("k", "raw", "KEY `format`: raw, hex or base64")
+	format := fs.String("o", "raw", "output `format`: raw, hex, base64 or json")
+	if err := c.parse(fs, args, 2); err != nil {
+		return err
+	}
+	key, err := decodeKey(fs.Arg(1), *keyFormat)
+	if err != nil {
+		return err
+	}
+	out, err := newOutput(c.stdout, *format, !*all)
+	if err != nil {
+		return err
+	}
+
+	db, err := cdb.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	found := false
+	for value := range db.GetAll(key) {
+		found = true
+		out.write(value)
+		if !*all {
+			break
+		}
+	}
+	if err := out.flush(); err != nil {
+		return err
+	}
+	if !found {
+		return errNotFound
+	}
+	return nil
+}
+
+func (c *cli) keys(args []string) error {
+	fs := c.flags()
+	format := fs.String("o", "raw", "output `format`: raw, hex, base64 or json")
+	if err := c.parse(fs, args, 1); err != nil {
+		return err
+	}
+	out, err := newOutput(c.stdout, *format, false)
+	if err != nil {
+		return err
+	}
+
+	db, err := cdb.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for key := range db.Keys() {
+		out.write(key)
+	}
+	return out.flush()
+}
+
+func (c *cli) dump(args []string) error {
+	fs := c.flags()
+	format := fs.String("o", "cdbmake", "output `format`: cdbmake, jsonl or csv")
+	b64 := fs.Bool("base64", false, "base64-encode all keys and values in jsonl or csv output")
+	if err := c.parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	db, err := cdb.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch *format {
+	case "cdbmake":
+		return cdb.Export(db, c.stdout)
+	case "jsonl":
+		return cdb.ExportJSONL(db, c.stdout, cdb.JSONLOptions{Base64: *b64})
+	case "csv":
+		return cdb.ExportCSV(db, c.stdout, cdb.CSVOptions{Base64: *b64})
+	}
+	return fmt.Errorf("unknown format %q", *format)
+}
+
+func (c *cli) count(args []string) error {
+	fs := c.flags()
+	if err := c.parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	db, err := cdb.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var n int
+	for range db.All() {
+		n++
+	}
+	_, err = fmt.Fprintln(c.stdout, n)
+	return err
+}
+
+func (c *cli) stats(args []string) error {
+	fs := c.flags()
+	asJSON := fs.Bool("json", false, "print statistics as JSON")
+	if err := c.parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	db, err := cdb.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	s := db.Stats()
+	if *asJSON {
+		enc := json.NewEncoder(c.stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Format string
+			cdb.Stats
+		}{db.Format().String(), s})
+	}
+
+	w := bufio.NewWriter(c.stdout)
+	fmt.Fprintf(w, "format:         %s\n", db.Format())
+	fmt.Fprintf(w, "size:           %d\n", s.Size)
+	fmt.Fprintf(w, "data size:      %d\n", s.DataSize)
+	fmt.Fprintf(w, "table size:     %d\n", s.TableSize)
+	fmt.Fprintf(w, "records:        %d\n", s.Records)
+	fmt.Fprintf(w, "tables:         %d\n", s.Tables)
+	fmt.Fprintf(w, "slots:          %d\n", s.Slots)
+	fmt.Fprintf(w, "load factor:    %.3f\n", s.LoadFactor)
+	fmt.Fprintf(w, "power of two:   %t\n", s.PowerOfTwo)
+	fmt.Fprintf(w, "avg probe:      %.3f\n", s.AvgProbe)
+	fmt.Fprintf(w, "max probe:      %d\n", s.MaxProbe)
+	fmt.Fprintf(w, "avg miss probe: %.3f\n", s.AvgMissProbe)
+	return w.Flush()
+}
+
+func (c *cli) verify(args []string) error {
+	fs := c.flags()
+	if err := c.parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	db, err := cdb.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.Verify(); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(c.stdout, "ok")
+	return err
+}
+
+func (c *cli) make(args []string) error {
+	fs := c.flags()
+	format := fs.String("i", "cdbmake", "input `format`: cdbmake, jsonl or csv")
+	format32 := fs.Bool("32", false, "write the classic 32-bit format")
+	if err := c.parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	var importFn func(r io.Reader, w *cdb.Writer) error
+	switch *format {
+	case "cdbmake":
+		importFn = cdb.Import
+	case "jsonl":
+		importFn = func(r io.Reader, w *cdb.Writer) error {
+			return cdb.ImportJSONL(r, w, cdb.JSONLOptions{})
+		}
+	case "csv":
+		importFn = func(r io.Reader, w *cdb.Writer) error {
+			return cdb.ImportCSV(r, w, cdb.CSVOptions{})
+		}
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	create := cdb.CreateAtomic
+	if *format32 {
+		create = cdb.CreateAtomic32
+	}
+	w, err := create(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if err := importFn(c.stdin, w); err != nil {
+		_ = w.Abort()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		_ = w.Abort()
+		return err
+	}
+	return nil
+}
+
+func (c *cli) convert(args []string) error {
+	fs := c.flags()
+	format32 := fs.Bool("32", false, "write the classic 32-bit format instead of the 64-bit one")
+	if err := c.parse(fs, args, 2); err != nil {
+		return err
+	}
+
+	format := cdb.Format64
+	if *format32 {
+		format = cdb.Format32
+	}
+	return cdb.ConvertFile(fs.Arg(1), fs.Arg(0), format)
+}
+
+// output writes keys or values in one of the binary-safe output formats,
+// each followed by a newline. Raw output of a single value has no newline,
+// like cdbget, so that it can be redirected to a file.
+type output struct {
+	w      *bufio.Writer
+	format string
+	single bool
+}
+
+// decodeKey decodes a key argument given in format.
+func decodeKey(arg, format string) ([]byte, error) {
+	var key []byte
+	var err error
+	switch format {
+	case "raw":
+		return []byte(arg), nil
+	case "hex":
+		key, err = hex.DecodeString(arg)
+	case "base64":
+		key, err = base64.StdEncoding.DecodeString(arg)
+	default:
+		return nil, fmt.Errorf("unknown key format %q", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decode key %q: %w", arg, err)
+	}
+	return key, nil
+}
+
+func newOutput(w io.Writer, format string, single bool) (*output, error) {
+	switch format {
+	case "raw", "hex", "base64", "json":
+		return &output{w: bufio.NewWriter(w), format: format, single: single}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+func (o *output) write(b []byte) {
+	switch o.format {
+	case "raw":
+		o.w.Write(b)
+		if o.single {
+			return
+		}
+	case "hex":
+		o.w.WriteString(hex.EncodeToString(b))
+	case "base64":
+		o.w.WriteString(base64.StdEncoding.EncodeToString(b))
+	case "json":
+		o.w.Write(jsonString(b))
+	}
+	o.w.WriteByte('\n')
+}
+
+func (o *output) flush() error {
+	return o.w.Flush()
+}
+
+// jsonString encodes b as a JSON string if it is valid UTF-8, and as an
+// object holding its base64 encoding otherwise.
+func jsonString(b []byte) []byte {
+	var v any = string(b)
+	if !utf8.Valid(b) {
+		v = struct {
+			Base64 string `json:"base64"`
+		}{base64.StdEncoding.EncodeToString(b)}
+	}
+	out, _ := json.Marshal(v)
+	return out
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func runCLI(t *testing.T, stdin string, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(args, strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCLI(t *testing.T) {
+	dir := t.TempDir()
+	db := filepath.Join(dir, "test.cdb")
+	input := "+3,1:one->1\n+3,5:dup->first\n+3,6:dup->second\n+3,2:bin->\xff\x00\n\n"
+	if code, _, stderr := runCLI(t, input, "make", db); code != exitOK {
+		t.Fatalf("make exited with %d: %s", code, stderr)
+	}
+
+	tests := []struct {
+		args []string
+		code int
+		out  string
+	}{
+		{[]string{"get", db, "one"}, exitOK, "1"},
+		{[]string{"get", db, "dup"}, exitOK, "first"},
+		{[]string{"get", "-a", db, "dup"}, exitOK, "first\nsecond\n"},
+		{[]string{"get", "-o", "hex", db, "bin"}, exitOK, "ff00\n"},
+		{[]string{"get", "-o", "base64", db, "bin"}, exitOK, "/wA=\n"},
+		{[]string{"get", "-o", "json", "-a", db, "dup"}, exitOK, "\"first\"\n\"second\"\n"},
+		{[]string{"get", "-o", "json", db, "bin"}, exitOK, "{\"base64\":\"/wA=\"}\n"},
+		{[]string{"get", "-k", "hex", db, "626970"}, exitNotFound, ""},
+		{[]string{"get", "-k", "hex", db, "62696e"}, exitOK, "\xff\x00"},
+		{[]string{"get", "-k", "base64", db, "b25l"}, exitOK, "1"},
+		{[]string{"get", "-k", "hex", db, "zz"}, exitError, ""},
+		{[]string{"get", "-k", "octal", db, "1"}, exitError, ""},
+		{[]string{"get", db, "missing"}, exitNotFound, ""},
+		{[]string{"get", filepath.Join(dir, "missing.cdb"), "one"}, exitError, ""},
+		{[]string{"get", db}, exitError, ""},
+		{[]string{"keys", "-o", "json", db}, exitOK, "\"one\"\n\"dup\"\n\"dup\"\n\"bin\"\n"},
+		{[]string{"count", db}, exitOK, "4\n"},
+		{[]string{"verify", db}, exitOK, "ok\n"},
+		{[]string{"dump", db}, exitOK, input},
+		{[]string{"dump", "-o", "jsonl", db}, exitOK, `{"key":"one","value":"1"}
+{"key":"dup","value":"first"}
+{"key":"dup","value":"second"}
+{"key":"bin","value_base64":"/wA="}
+`},
+		{[]string{"frobnicate"}, exitError, ""},
+	}
+	for _, tt := range tests {
+		code, stdout, _ := runCLI(t, "", tt.args...)
+		if code != tt.code || stdout != tt.out {
+			t.Errorf("cdb %s = %d, %q; want %d, %q", strings.Join(tt.args, " "), code, stdout, tt.code, tt.out)
+		}
+	}
+
+	code, stdout, _ := runCLI(t, "", "stats", db)
+	if code != exitOK || !strings.Contains(stdout, "records:        4\n") {
+		t.Errorf("stats = %d, %q", code, stdout)
+	}
+}
+
+func TestCLIConvert(t *testing.T) {
+	dir := t.TempDir()
+	db64 := filepath.Join(dir, "test.cdb64")
+	db32 := filepath.Join(dir, "test.cdb")
+	if code, _, stderr := runCLI(t, `{"key":"k","value":"v"}`+"\n", "make", "-i", "jsonl", db64); code != exitOK {
+		t.Fatalf("make exited with %d: %s", code, stderr)
+	}
+	if code, _, stderr := runCLI(t, "", "convert", "-32", db64, db32); code != exitOK {
+		t.Fatalf("convert exited with %d: %s", code, stderr)
+	}
+
+	code, stdout, _ := runCLI(t, "", "stats", "-json", db32)
+	if code != exitOK || !strings.Contains(stdout, `"Format": "32-bit"`) {
+		t.Errorf("stats -json = %d, %q", code, stdout)
+	}
+	if code, stdout, _ := runCLI(t, "", "get", db32, "k"); code != exitOK || stdout != "v" {
+		t.Errorf("get = %d, %q; want 0, \"v\"", code, stdout)
+	}
+
+	if code, _, _ := runCLI(t, "+1,1:a", "make", filepath.Join(dir, "bad.cdb")); code != exitError {
+		t.Errorf("make of malformed input exited with %d, want %d", code, exitError)
+	}
+}
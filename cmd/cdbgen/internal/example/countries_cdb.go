@@ -0,0 +1,30 @@
+// Code generated by cdbgen from countries.csv; DO NOT EDIT.
+
+package example
+
+import (
+	_ "embed"
+
+	"github.com/perbu/cdb"
+)
+
+//go:embed countries.cdb
+var countriesData []byte
+
+// CountriesDB is the database built from countries.csv.
+var CountriesDB = func() *cdb.InMemoryCDB {
+	db, err := cdb.NewInMemory(countriesData)
+	if err != nil {
+		panic("countries.cdb: " + err.Error())
+	}
+	return db
+}()
+
+// Countries returns the value of key in CountriesDB and whether it was found.
+func Countries(key string) (v string, ok bool) {
+	data, _ := CountriesDB.Get([]byte(key))
+	if data == nil {
+		return v, false
+	}
+	return string(data), true
+}
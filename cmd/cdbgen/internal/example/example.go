@@ -0,0 +1,14 @@
+// Package example holds lookup tables generated by cdbgen, as a
+// demonstration and a test of the generated code.
+package example
+
+//go:generate go run github.com/perbu/cdb/cmd/cdbgen -header countries.csv
+//go:generate go run github.com/perbu/cdb/cmd/cdbgen -key plan -type Plan plans.jsonl
+
+// Plan is a subscription plan, decoded from JSON by Plans.
+type Plan struct {
+	Plan     string   `json:"plan"`
+	Seats    int      `json:"seats"`
+	SSO      bool     `json:"sso"`
+	Features []string `json:"features"`
+}
@@ -0,0 +1,33 @@
+package example_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/perbu/cdb/cmd/cdbgen/internal/example"
+)
+
+func TestCountries(t *testing.T) {
+	if name, ok := example.Countries("NO"); !ok || name != "Norway" {
+		t.Errorf("Countries(NO) = %q, %v", name, ok)
+	}
+	if name, ok := example.Countries("code"); ok {
+		t.Errorf("Countries(code) = %q, the header row was imported", name)
+	}
+	if n := slices.Collect(example.CountriesDB.Keys()); len(n) != 5 {
+		t.Errorf("CountriesDB has %d keys, want 5", len(n))
+	}
+}
+
+func TestPlans(t *testing.T) {
+	plan, ok, err := example.Plans("team")
+	if err != nil || !ok {
+		t.Fatalf("Plans(team) = %v, %v", ok, err)
+	}
+	if plan.Seats != 25 || plan.SSO || !slices.Equal(plan.Features, []string{"dashboards", "alerts"}) {
+		t.Errorf("Plans(team) = %+v", plan)
+	}
+	if _, ok, err := example.Plans("gold"); ok || err != nil {
+		t.Errorf("Plans(gold) = %v, %v", ok, err)
+	}
+}
@@ -0,0 +1,33 @@
+// Code generated by cdbgen from plans.jsonl; DO NOT EDIT.
+
+package example
+
+import (
+	_ "embed"
+	"encoding/json"
+
+	"github.com/perbu/cdb"
+)
+
+//go:embed plans.cdb
+var plansData []byte
+
+// PlansDB is the database built from plans.jsonl.
+var PlansDB = func() *cdb.InMemoryCDB {
+	db, err := cdb.NewInMemory(plansData)
+	if err != nil {
+		panic("plans.cdb: " + err.Error())
+	}
+	return db
+}()
+
+// Plans returns the value of key in PlansDB, decoded from JSON, and
+// whether it was found.
+func Plans(key string) (v Plan, ok bool, err error) {
+	data, _ := PlansDB.Get([]byte(key))
+	if data == nil {
+		return v, false, nil
+	}
+	err = json.Unmarshal(data, &v)
+	return v, true, err
+}
@@ -0,0 +1,423 @@
+// Command cdbgen compiles a table of records into a CDB database and a Go
+// file that embeds it, for lookup tables that are built into a binary and
+// need no parsing at startup.
+//
+// Usage:
+//
+//	cdbgen [flags] INPUT
+//
+// It is meant to be run by go generate, for example
+//
+//	//go:generate go run github.com/perbu/cdb/cmd/cdbgen -header -name Countries countries.csv
+//
+// which writes countries.cdb and countries_cdb.go to the package directory.
+// The Go file embeds the database with //go:embed and declares
+//
+//	var CountriesDB *cdb.InMemoryCDB
+//	func Countries(key string) (v string, ok bool)
+//
+// The input is in the cdbmake format, JSON Lines or CSV, chosen with -i or by
+// the extension of INPUT (.jsonl, .ndjson and .csv; anything else is
+// cdbmake). -key and -value select the fields of JSON Lines objects or the
+// columns of CSV rows as in cdb.ImportJSONL and cdb.ImportCSV.
+//
+// -type sets the type of the values returned by the accessor: string,
+// []byte, int, int64, float64 and bool are parsed from the value's text, and
+// any other type, such as the name of a struct in the package, is decoded
+// from JSON; such accessors also return the decoding error. Values are
+// checked when the database is generated, so the accessor of a scalar type
+// cannot fail. []byte values are the embedded data itself and must not be
+// modified.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"go/format"
+	"go/token"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/perbu/cdb"
+)
+
+const (
+	exitOK    = 0
+	exitError = 2
+)
+
+// errUsage is returned for invalid arguments; the usage has been printed.
+var errUsage = errors.New("usage")
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stderr))
+}
+
+func run(args []string, stderr io.Writer) int {
+	if err := generate(args, stderr); err != nil {
+		if !errors.Is(err, errUsage) {
+			fmt.Fprintf(stderr, "cdbgen: %v\n", err)
+		}
+		return exitError
+	}
+	return exitOK
+}
+
+// config is the parsed command line.
+type config struct {
+	input     string
+	format    string
+	name      string
+	pkg       string
+	out       string
+	db        string
+	valueType string
+	key       string
+	value     string
+	header    bool
+}
+
+func parseArgs(args []string, stderr io.Writer) (*config, error) {
+	fs := flag.NewFlagSet("cdbgen", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: cdbgen [flags] INPUT")
+		fs.PrintDefaults()
+	}
+	var c config
+	fs.StringVar(&c.format, "i", "", "input `format`: cdbmake, jsonl or csv; default from the extension of INPUT")
+	fs.StringVar(&c.name, "name", "", "`name` of the accessor; default from INPUT, as in country_codes.csv -> CountryCodes")
+	fs.StringVar(&c.pkg, "pkg", os.Getenv("GOPACKAGE"), "`package` of the Go file; default $GOPACKAGE, as set by go generate")
+	fs.StringVar(&c.out, "o", "", "Go `file` to write; default INPUT's base name with _cdb.go; the database is written next to it")
+	fs.StringVar(&c.valueType, "type", "string", "Go `type` of the values")
+	fs.StringVar(&c.key, "key", "", "JSON pointer or field of the key, or comma-separated CSV `columns`")
+	fs.StringVar(&c.value, "value", "", "JSON pointer or field of the value, or comma-separated CSV `columns`")
+	fs.BoolVar(&c.header, "header", false, "skip the first row of CSV input")
+	if err := fs.Parse(args); err != nil {
+		return nil, errUsage
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return nil, errUsage
+	}
+	c.input = fs.Arg(0)
+
+	base := strings.TrimSuffix(filepath.Base(c.input), filepath.Ext(c.input))
+	if c.format == "" {
+		switch strings.ToLower(filepath.Ext(c.input)) {
+		case ".jsonl", ".ndjson":
+			c.format = "jsonl"
+		case ".csv":
+			c.format = "csv"
+		default:
+			c.format = "cdbmake"
+		}
+	}
+	if c.name == "" {
+		c.name = exportedName(base)
+	}
+	if !token.IsIdentifier(c.name) {
+		return nil, fmt.Errorf("invalid name %q", c.name)
+	}
+	if c.pkg == "" {
+		return nil, errors.New("no package: set -pkg or run from go generate")
+	}
+	if c.out == "" {
+		c.out = fileName(base) + "_cdb.go"
+	}
+	c.db = filepath.Join(filepath.Dir(c.out), fileName(base)+".cdb")
+	if filepath.Clean(c.db) == filepath.Clean(c.input) {
+		return nil, fmt.Errorf("the database would overwrite the input %s", c.input)
+	}
+	return &c, nil
+}
+
+func generate(args []string, stderr io.Writer) error {
+	c, err := parseArgs(args, stderr)
+	if err != nil {
+		return err
+	}
+	vt := valueTypeOf(c.valueType)
+	importFn, err := c.importer()
+	if err != nil {
+		return err
+	}
+
+	// The records are imported into memory and checked before the
+	// database is written.
+	in, err := os.Open(c.input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	b := cdb.NewBuilder()
+	if err := importFn(in, b.Writer); err != nil {
+		return err
+	}
+	records, err := b.InMemory()
+	if err != nil {
+		return err
+	}
+
+	w, err := cdb.CreateAtomic(c.db)
+	if err != nil {
+		return err
+	}
+	n := 0
+	for key, value := range records.All() {
+		n++
+		if vt.check != nil {
+			if err := vt.check(value); err != nil {
+				_ = w.Abort()
+				return fmt.Errorf("record %d, key %q: %w", n, key, err)
+			}
+		}
+		if err := w.Put(key, value); err != nil {
+			_ = w.Abort()
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		_ = w.Abort()
+		return err
+	}
+
+	src, err := c.source(vt)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.out, src, 0o644)
+}
+
+// importer returns the function that reads the input format.
+func (c *config) importer() (func(r io.Reader, w *cdb.Writer) error, error) {
+	switch c.format {
+	case "cdbmake":
+		if c.key != "" || c.value != "" || c.header {
+			return nil, errors.New("-key, -value and -header need jsonl or csv input")
+		}
+		return cdb.Import, nil
+	case "jsonl":
+		if c.header {
+			return nil, errors.New("-header needs csv input")
+		}
+		opts := cdb.JSONLOptions{KeyField: c.key, ValueField: c.value}
+		return func(r io.Reader, w *cdb.Writer) error { return cdb.ImportJSONL(r, w, opts) }, nil
+	case "csv":
+		opts := cdb.CSVOptions{Header: c.header}
+		var err error
+		if opts.KeyColumns, err = columns(c.key); err != nil {
+			return nil, fmt.Errorf("-key: %w", err)
+		}
+		if opts.ValueColumns, err = columns(c.value); err != nil {
+			return nil, fmt.Errorf("-value: %w", err)
+		}
+		return func(r io.Reader, w *cdb.Writer) error { return cdb.ImportCSV(r, w, opts) }, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", c.format)
+}
+
+// columns parses a comma-separated list of CSV columns.
+func columns(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var cols []int
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid column %q", f)
+		}
+		cols = append(cols, n)
+	}
+	return cols, nil
+}
+
+// exportedName converts a file name such as "country_codes" to an exported
+// Go identifier such as "CountryCodes".
+func exportedName(s string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range s {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if b.Len() == 0 && unicode.IsDigit(r) {
+				b.WriteString("Table")
+			}
+			if upper {
+				r = unicode.ToUpper(r)
+			}
+			b.WriteRune(r)
+			upper = false
+		default:
+			upper = true
+		}
+	}
+	if b.Len() == 0 {
+		return "Table"
+	}
+	return b.String()
+}
+
+// unexportedName lowercases the first letter of name.
+func unexportedName(name string) string {
+	r, size := utf8.DecodeRuneInString(name)
+	return string(unicode.ToLower(r)) + name[size:]
+}
+
+// fileName converts a file name to lowercase letters, digits and
+// underscores, which are safe in a //go:embed pattern.
+func fileName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', '0' <= r && r <= '9', r == '_':
+			return r
+		case 'A' <= r && r <= 'Z':
+			return unicode.ToLower(r)
+		}
+		return '_'
+	}, s)
+}
+
+// valueType describes how the accessor returns values of a Go type.
+type valueType struct {
+	// GoType is the type of the values.
+	GoType string
+	// Import is a package the conversion needs.
+	Import string
+	// Convert is the body that returns the value v converted from data,
+	// with named results v and ok, and err for JSON.
+	Convert string
+	// JSON is set for types decoded from JSON, whose accessor also
+	// returns an error.
+	JSON bool
+	// check reports whether a value can be converted.
+	check func(value []byte) error
+}
+
+func valueTypeOf(goType string) valueType {
+	switch goType {
+	case "string":
+		return valueType{GoType: goType, Convert: "return string(data), true"}
+	case "[]byte":
+		return valueType{GoType: goType, Convert: "return data, true"}
+	case "int", "int64":
+		return valueType{
+			GoType:  goType,
+			Import:  "strconv",
+			Convert: "n, _ := strconv.ParseInt(string(data), 10, 64)\nreturn " + goType + "(n), true",
+			check: func(value []byte) error {
+				_, err := strconv.ParseInt(string(value), 10, 64)
+				return err
+			},
+		}
+	case "float64":
+		return valueType{
+			GoType:  goType,
+			Import:  "strconv",
+			Convert: "v, _ = strconv.ParseFloat(string(data), 64)\nreturn v, true",
+			check: func(value []byte) error {
+				_, err := strconv.ParseFloat(string(value), 64)
+				return err
+			},
+		}
+	case "bool":
+		return valueType{
+			GoType:  goType,
+			Import:  "strconv",
+			Convert: "v, _ = strconv.ParseBool(string(data))\nreturn v, true",
+			check: func(value []byte) error {
+				_, err := strconv.ParseBool(string(value))
+				return err
+			},
+		}
+	}
+	return valueType{
+		GoType:  goType,
+		Import:  "encoding/json",
+		Convert: "err = json.Unmarshal(data, &v)\nreturn v, true, err",
+		JSON:    true,
+		check: func(value []byte) error {
+			if !json.Valid(value) {
+				return errors.New("value is not valid JSON")
+			}
+			return nil
+		},
+	}
+}
+
+var sourceTemplate = template.Must(template.New("source").Parse(`// Code generated by cdbgen from {{.Input}}; DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	_ "embed"
+{{- if .Type.Import}}
+	"{{.Type.Import}}"
+{{- end}}
+
+	"github.com/perbu/cdb"
+)
+
+//go:embed {{.DB}}
+var {{.Data}} []byte
+
+// {{.Name}}DB is the database built from {{.Input}}.
+var {{.Name}}DB = func() *cdb.InMemoryCDB {
+	db, err := cdb.NewInMemory({{.Data}})
+	if err != nil {
+		panic("{{.DB}}: " + err.Error())
+	}
+	return db
+}()
+{{if .Type.JSON}}
+// {{.Name}} returns the value of key in {{.Name}}DB, decoded from JSON, and
+// whether it was found.
+func {{.Name}}(key string) (v {{.Type.GoType}}, ok bool, err error) {
+	data, _ := {{.Name}}DB.Get([]byte(key))
+	if data == nil {
+		return v, false, nil
+	}
+	{{.Type.Convert}}
+}
+{{- else}}
+// {{.Name}} returns the value of key in {{.Name}}DB and whether it was found.
+func {{.Name}}(key string) (v {{.Type.GoType}}, ok bool) {
+	data, _ := {{.Name}}DB.Get([]byte(key))
+	if data == nil {
+		return v, false
+	}
+	{{.Type.Convert}}
+}
+{{- end}}
+`))
+
+// source returns the formatted Go file.
+func (c *config) source(vt valueType) ([]byte, error) {
+	var buf bytes.Buffer
+	err := sourceTemplate.Execute(&buf, map[string]any{
+		"Input":   filepath.Base(c.input),
+		"Package": c.pkg,
+		"DB":      filepath.Base(c.db),
+		"Data":    unexportedName(c.name) + "Data",
+		"Name":    c.name,
+		"Type":    vt,
+	})
+	if err != nil {
+		return nil, err
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("format.Source: %w", err)
+	}
+	return src, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/perbu/cdb"
+)
+
+func runGen(t *testing.T, args ...string) (int, string) {
+	t.Helper()
+	var stderr bytes.Buffer
+	code := run(args, &stderr)
+	return code, stderr.String()
+}
+
+// TestGolden regenerates the tables of the example package, which go
+// generate keeps up to date, and compares the results.
+func TestGolden(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		input string
+		args  []string
+	}{
+		{"countries.csv", []string{"-header"}},
+		{"plans.jsonl", []string{"-key", "plan", "-type", "Plan"}},
+	} {
+		base := strings.TrimSuffix(tt.input, filepath.Ext(tt.input))
+		args := append(tt.args, "-pkg", "example", "-o", filepath.Join(dir, base+"_cdb.go"),
+			filepath.Join("internal", "example", tt.input))
+		if code, stderr := runGen(t, args...); code != exitOK {
+			t.Fatalf("cdbgen %s exited with %d: %s", strings.Join(args, " "), code, stderr)
+		}
+		for _, name := range []string{base + "_cdb.go", base + ".cdb"} {
+			got, err := os.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := os.ReadFile(filepath.Join("internal", "example", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s differs from the generated file; run go generate", name)
+			}
+		}
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "port-numbers.txt")
+	if err := os.WriteFile(input, []byte("+4,2:http->80\n+5,3:https->443\n\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "ports.go")
+	if code, stderr := runGen(t, "-pkg", "ports", "-type", "int", "-o", out, input); code != exitOK {
+		t.Fatalf("cdbgen exited with %d: %s", code, stderr)
+	}
+	src, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"package ports\n",
+		"//go:embed port_numbers.cdb\n",
+		"func PortNumbers(key string) (v int, ok bool) {",
+	} {
+		if !bytes.Contains(src, []byte(want)) {
+			t.Errorf("generated file lacks %q:\n%s", want, src)
+		}
+	}
+	db, err := cdb.Open(filepath.Join(dir, "port_numbers.cdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if value, err := db.Get([]byte("https")); err != nil || string(value) != "443" {
+		t.Errorf("Get(https) = %q, %v", value, err)
+	}
+
+	for _, tt := range []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"-pkg", "ports", "-type", "bool", "-o", out, input}, `key "http"`},
+		{[]string{"-pkg", "ports", "-i", "jsonl", "-o", out, input}, "line 1"},
+		{[]string{"-pkg", "ports", "-i", "xml", "-o", out, input}, "unknown format"},
+		{[]string{"-pkg", "ports", "-name", "port-numbers", "-o", out, input}, "invalid name"},
+		{[]string{"-o", out, input}, "no package"},
+		{[]string{"-pkg", "ports", "-o", out, filepath.Join(dir, "missing.txt")}, "no such file"},
+	} {
+		code, stderr := runGen(t, tt.args...)
+		if code != exitError || !strings.Contains(stderr, tt.err) {
+			t.Errorf("cdbgen %s = %d, %q; want an error containing %q", strings.Join(tt.args, " "), code, stderr, tt.err)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package cdb
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"unsafe"
+)
+
+// Codec converts values of type T to and from the bytes of keys or values,
+// for TypedReader and TypedWriter.
+type Codec[T any] interface {
+	// Append appends the encoding of v to dst and returns the extended
+	// slice.
+	Append(dst []byte, v T) ([]byte, error)
+	// Decode decodes a value from data. It must not retain data, which
+	// may be part of a memory-mapped file.
+	Decode(data []byte) (T, error)
+}
+
+// StringCodec stores strings as their bytes.
+type StringCodec struct{}
+
+// Append appends the bytes of v to dst.
+func (StringCodec) Append(dst []byte, v string) ([]byte, error) {
+	return append(dst, v...), nil
+}
+
+// Decode returns data as a string.
+func (StringCodec) Decode(data []byte) (string, error) {
+	return string(data), nil
+}
+
+// Integer is the set of integer types IntCodec encodes.
+type Integer interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
+}
+
+// IntCodec stores integers big-endian in the size of their type, with the
+// sign bit of signed types flipped, so that the encodings of integers sort
+// in the same order as the integers.
+type IntCodec[T Integer] struct{}
+
+// Append appends the big-endian encoding of v to dst.
+func (IntCodec[T]) Append(dst []byte, v T) ([]byte, error) {
+	size := int(unsafe.Sizeof(v))
+	u := uint64(v) ^ signBit[T]()
+	for i := size - 1; i >= 0; i-- {
+		dst = append(dst, byte(u>>(8*i)))
+	}
+	return dst, nil
+}
+
+// Decode decodes an integer, failing if data is not exactly its size.
+func (IntCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	size := int(unsafe.Sizeof(v))
+	if len(data) != size {
+		return v, fmt.Errorf("IntCodec[%T]: got %d bytes, want %d", v, len(data), size)
+	}
+	var u uint64
+	for _, b := range data {
+		u = u<<8 | uint64(b)
+	}
+	return T(u ^ signBit[T]()), nil
+}
+
+// signBit returns the sign bit of T in the low bits of a uint64, or 0 if T
+// is unsigned.
+func signBit[T Integer]() uint64 {
+	var zero T
+	if ^zero > 0 {
+		return 0
+	}
+	return 1 << (8*unsafe.Sizeof(zero) - 1)
+}
+
+// JSONCodec stores values as JSON with encoding/json.
+type JSONCodec[T any] struct{}
+
+// Append appends the JSON encoding of v to dst.
+func (JSONCodec[T]) Append(dst []byte, v T) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return dst, fmt.Errorf("json.Marshal: %w", err)
+	}
+	return append(dst, data...), nil
+}
+
+// Decode decodes a value from JSON.
+func (JSONCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	if err := json.Unmarshal(data, &v); err != nil {
+		return v, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	return v, nil
+}
+
+// GobCodec stores values with encoding/gob. Each value is a complete gob
+// stream, type description included, so it suits larger values better than
+// small ones.
+type GobCodec[T any] struct{}
+
+// Append appends the gob encoding of v to dst.
+func (GobCodec[T]) Append(dst []byte, v T) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return dst, fmt.Errorf("gob.Encode: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode decodes a value from a gob stream.
+func (GobCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v); err != nil {
+		return v, fmt.Errorf("gob.Decode: %w", err)
+	}
+	return v, nil
+}
+
+// BinaryCodec stores values of a type whose pointer implements
+// encoding.BinaryMarshaler and encoding.BinaryUnmarshaler, such as
+// BinaryCodec[time.Time, *time.Time].
+type BinaryCodec[T any, PT interface {
+	*T
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}] struct{}
+
+// Append appends the result of v's MarshalBinary to dst.
+func (BinaryCodec[T, PT]) Append(dst []byte, v T) ([]byte, error) {
+	data, err := PT(&v).MarshalBinary()
+	if err != nil {
+		return dst, fmt.Errorf("MarshalBinary: %w", err)
+	}
+	return append(dst, data...), nil
+}
+
+// Decode decodes a value with UnmarshalBinary.
+func (BinaryCodec[T, PT]) Decode(data []byte) (T, error) {
+	var v T
+	// UnmarshalBinary may keep its argument, which must not be part of
+	// the database.
+	if err := PT(&v).UnmarshalBinary(bytes.Clone(data)); err != nil {
+		return v, fmt.Errorf("UnmarshalBinary: %w", err)
+	}
+	return v, nil
+}
+
+var (
+	_ Codec[string] = StringCodec{}
+	_ Codec[int64]  = IntCodec[int64]{}
+	_ Codec[any]    = JSONCodec[any]{}
+	_ Codec[any]    = GobCodec[any]{}
+)
@@ -0,0 +1,208 @@
+package cdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// shardFlushSize is the amount of encoded records a ConcurrentWriter shard
+// buffers before appending them to the database.
+const shardFlushSize = 1 << 20
+
+// ConcurrentWriter wraps a Writer so that Put can be called from many
+// goroutines at once. Records are encoded into per-shard buffers without
+// holding a global lock, and the buffers are appended to the data section
+// and hash tables as they fill up and when the database is finalized.
+//
+// Finish, Close, Freeze and Abort must not be called concurrently with Put.
+// Configuration of the underlying Writer, such as LoadFactor or OnProgress,
+// applies as usual.
+type ConcurrentWriter struct {
+	// Deterministic makes the output independent of the order in which
+	// goroutines call Put, by writing all records sorted by key, then value,
+	// when the database is finalized. All records are held in memory until
+	// then. It must be set before the first call to Put.
+	Deterministic bool
+
+	w      *Writer
+	shards []concurrentShard
+	next   atomic.Uint64
+
+	mu        sync.Mutex // serializes access to w
+	err       error
+	finalized atomic.Bool
+}
+
+type concurrentShard struct {
+	mu      sync.Mutex
+	buf     []byte
+	entries []entry // offsets relative to buf
+
+	_ [64]byte // keep shards on separate cache lines
+}
+
+// NewConcurrentWriter returns a ConcurrentWriter that adds records to w. The
+// Writer must not be used directly afterwards.
+func NewConcurrentWriter(w *Writer) *ConcurrentWriter {
+	return &ConcurrentWriter{
+		w:      w,
+		shards: make([]concurrentShard, 4*runtime.GOMAXPROCS(0)),
+	}
+}
+
+// Put adds a key/value pair to the database. It is safe to call from
+// multiple goroutines. Errors from appending a full shard to the database,
+// such as ErrTooMuchData, are sticky: they are returned by the Put that
+// triggered the append, by every later append and by finalizing.
+func (c *ConcurrentWriter) Put(key, value []byte) error {
+	if c.finalized.Load() {
+		return ErrFinalized
+	}
+
+	shard := &c.shards[c.next.Add(1)%uint64(len(c.shards))]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	shard.entries = append(shard.entries, entry{hash: cdbHash(key), offset: uint64(len(shard.buf))})
+	shard.buf = binary.LittleEndian.AppendUint64(shard.buf, uint64(len(key)))
+	shard.buf = binary.LittleEndian.AppendUint64(shard.buf, uint64(len(value)))
+	shard.buf = append(shard.buf, key...)
+	shard.buf = append(shard.buf, value...)
+
+	if c.Deterministic || len(shard.buf) < shardFlushSize {
+		return nil
+	}
+	return c.flush(shard)
+}
+
+// PutContext is like Put, but returns the context's error without adding
+// the record if ctx is done.
+func (c *ConcurrentWriter) PutContext(ctx context.Context, key, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Put(key, value)
+}
+
+// flush appends the records buffered in shard to the database. The caller
+// must hold shard.mu.
+func (c *ConcurrentWriter) flush(shard *concurrentShard) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+
+	if err := c.w.putRaw(shard.buf, shard.entries); err != nil {
+		c.err = err
+		return err
+	}
+	shard.buf = shard.buf[:0]
+	shard.entries = shard.entries[:0]
+	return nil
+}
+
+// drain appends all buffered records to the database and stops accepting
+// new ones.
+func (c *ConcurrentWriter) drain() error {
+	if c.finalized.Swap(true) {
+		return c.err
+	}
+
+	if c.Deterministic {
+		return c.writeSorted()
+	}
+	for i := range c.shards {
+		shard := &c.shards[i]
+		shard.mu.Lock()
+		err := c.flush(shard)
+		shard.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSorted writes the records of all shards ordered by key, then value.
+func (c *ConcurrentWriter) writeSorted() error {
+	type record struct {
+		key, value []byte
+	}
+
+	var records []record
+	for i := range c.shards {
+		shard := &c.shards[i]
+		for _, e := range shard.entries {
+			keyLength := binary.LittleEndian.Uint64(shard.buf[e.offset:])
+			valueLength := binary.LittleEndian.Uint64(shard.buf[e.offset+8:])
+			keyEnd := e.offset + 16 + keyLength
+			records = append(records, record{
+				key:   shard.buf[e.offset+16 : keyEnd],
+				value: shard.buf[keyEnd : keyEnd+valueLength],
+			})
+		}
+	}
+
+	slices.SortFunc(records, func(a, b record) int {
+		if c := bytes.Compare(a.key, b.key); c != 0 {
+			return c
+		}
+		return bytes.Compare(a.value, b.value)
+	})
+
+	for _, r := range records {
+		if err := c.w.Put(r.key, r.value); err != nil {
+			c.err = err
+			return err
+		}
+	}
+	for i := range c.shards {
+		c.shards[i] = concurrentShard{}
+	}
+	return nil
+}
+
+// Finish finalizes the database without closing the underlying
+// io.WriteSeeker. See Writer.Finish.
+func (c *ConcurrentWriter) Finish() error {
+	return c.FinishContext(context.Background())
+}
+
+// FinishContext is like Finish, but stops building hash tables when ctx is
+// done. See Writer.FinishContext.
+func (c *ConcurrentWriter) FinishContext(ctx context.Context) error {
+	if err := c.drain(); err != nil {
+		return err
+	}
+	return c.w.FinishContext(ctx)
+}
+
+// Close finalizes the database and closes the underlying io.WriteSeeker.
+// See Writer.Close.
+func (c *ConcurrentWriter) Close() error {
+	if err := c.drain(); err != nil {
+		return err
+	}
+	return c.w.Close()
+}
+
+// Freeze finalizes the database and returns a Reader for it. See
+// Writer.Freeze.
+func (c *ConcurrentWriter) Freeze() (Reader, error) {
+	if err := c.drain(); err != nil {
+		return nil, err
+	}
+	return c.w.Freeze()
+}
+
+// Abort discards the database. See Writer.Abort.
+func (c *ConcurrentWriter) Abort() error {
+	c.finalized.Store(true)
+	return c.w.Abort()
+}
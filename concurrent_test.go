@@ -0,0 +1,101 @@
+package cdb_test
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/perbu/cdb"
+)
+
+func putConcurrently(t *testing.T, writer *cdb.ConcurrentWriter, goroutines, perGoroutine int) {
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < perGoroutine; i++ {
+				n := strconv.Itoa(g*perGoroutine + i)
+				if err := writer.Put([]byte("key"+n), []byte("value"+n)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestConcurrentWriter(t *testing.T) {
+	const goroutines, perGoroutine = 32, 5000
+
+	writer := cdb.NewConcurrentWriter(cdb.NewBuilder().Writer)
+	putConcurrently(t, writer, goroutines, perGoroutine)
+
+	db, err := writer.Freeze()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < goroutines*perGoroutine; i++ {
+		n := strconv.Itoa(i)
+		value, err := db.Get([]byte("key" + n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != "value"+n {
+			t.Fatalf("key%s: expected %q, got %q", n, "value"+n, value)
+		}
+	}
+
+	var count int
+	for range db.All() {
+		count++
+	}
+	if count != goroutines*perGoroutine {
+		t.Errorf("expected %d records, got %d", goroutines*perGoroutine, count)
+	}
+
+	if err := writer.Put([]byte("late"), nil); !errors.Is(err, cdb.ErrFinalized) {
+		t.Errorf("expected ErrFinalized after Freeze, got %v", err)
+	}
+}
+
+func TestConcurrentWriterDeterministic(t *testing.T) {
+	build := func(goroutines int) []byte {
+		builder := cdb.NewBuilder()
+		writer := cdb.NewConcurrentWriter(builder.Writer)
+		writer.Deterministic = true
+		putConcurrently(t, writer, goroutines, 12000/goroutines)
+		if err := writer.Finish(); err != nil {
+			t.Fatal(err)
+		}
+		data, err := builder.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	expected := build(1)
+	for _, goroutines := range []int{4, 16} {
+		if !bytes.Equal(expected, build(goroutines)) {
+			t.Errorf("output with %d goroutines differs from single goroutine output", goroutines)
+		}
+	}
+
+	db, err := cdb.NewInMemory(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var prev []byte
+	for key := range db.Keys() {
+		if prev != nil && bytes.Compare(prev, key) > 0 {
+			t.Fatalf("records not sorted: %q before %q", prev, key)
+		}
+		prev = key
+	}
+}
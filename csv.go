@@ -0,0 +1,220 @@
+package cdb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// CSVOptions configures ImportCSV and ExportCSV. The zero value imports and
+// exports rows of two columns, key and value, separated by commas.
+type CSVOptions struct {
+	// Comma is the field delimiter. Zero means ','.
+	Comma rune
+
+	// Header makes import skip the first row and export write a
+	// "key,value" header row.
+	Header bool
+
+	// KeyColumns are the zero-based columns that make up the key on import,
+	// joined with KeySeparator. Nil means column 0.
+	KeyColumns   []int
+	KeySeparator string
+
+	// ValueColumns are the columns that make up the value on import. A
+	// single column is used as it is; several columns are stored as a CSV
+	// row of those fields, without a trailing newline. Nil means column 1.
+	// WholeRow stores the complete row instead.
+	ValueColumns []int
+	WholeRow     bool
+
+	// Base64 makes import decode key and single-column values from standard
+	// base64, and export encode every key and value. Without it, export
+	// encodes only records whose key or value is not valid UTF-8, and marks
+	// them with a third column, "base64", which import with the default
+	// columns recognizes.
+	Base64 bool
+
+	// OnError decides what happens with rows that cannot be parsed or lack
+	// a selected column. OnSkip, if set, is called with the *ImportError of
+	// every skipped row.
+	OnError ErrorPolicy
+	OnSkip  func(error)
+}
+
+func (opts *CSVOptions) comma() rune {
+	if opts.Comma == 0 {
+		return ','
+	}
+	return opts.Comma
+}
+
+// csvBase64Marker is the third column of a row ExportCSV has base64-encoded
+// because it is not valid UTF-8.
+const csvBase64Marker = "base64"
+
+// ImportCSV adds a record to w for every row of CSV in r. Problems with a
+// row are reported as an *ImportError with its line number and byte offset,
+// or skipped according to opts.OnError. W is not finalized.
+func ImportCSV(r io.Reader, w *Writer, opts CSVOptions) error {
+	cr := csv.NewReader(r)
+	cr.Comma = opts.comma()
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+
+	keyColumns, valueColumns := opts.KeyColumns, opts.ValueColumns
+	// Rows marked by ExportCSV are only recognized in its layout.
+	marked := keyColumns == nil && valueColumns == nil && !opts.WholeRow && !opts.Base64
+	encoded := opts
+	encoded.Base64 = true
+	if keyColumns == nil {
+		keyColumns = []int{0}
+	}
+	if valueColumns == nil {
+		valueColumns = []int{1}
+	}
+
+	var (
+		key, value bytes.Buffer
+		offset     int64
+	)
+	for first := true; ; first = false {
+		start := offset
+		row, err := cr.Read()
+		offset = cr.InputOffset()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				return fmt.Errorf("read: %w", err)
+			}
+			err = &ImportError{Line: parseErr.StartLine, Offset: start, Err: parseErr.Err}
+			if err := opts.OnError.handle(err, opts.OnSkip); err != nil {
+				return err
+			}
+			continue
+		}
+		if first && opts.Header {
+			continue
+		}
+
+		line, _ := cr.FieldPos(0)
+		rowOpts := &opts
+		if marked && len(row) == 3 && row[2] == csvBase64Marker {
+			rowOpts = &encoded
+		}
+		if err := rowOpts.row(row, keyColumns, valueColumns, &key, &value); err != nil {
+			err = &ImportError{Line: line, Offset: start, Err: err}
+			if err := opts.OnError.handle(err, opts.OnSkip); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := w.Put(key.Bytes(), value.Bytes()); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+}
+
+// row builds the key and value of a row.
+func (opts *CSVOptions) row(row []string, keyColumns, valueColumns []int, key, value *bytes.Buffer) error {
+	key.Reset()
+	for i, column := range keyColumns {
+		field, err := opts.field(row, column)
+		if err != nil {
+			return fmt.Errorf("key: %w", err)
+		}
+		if i > 0 {
+			key.WriteString(opts.KeySeparator)
+		}
+		key.Write(field)
+	}
+
+	value.Reset()
+	if opts.WholeRow {
+		return opts.encodeRow(value, row)
+	}
+	if len(valueColumns) == 1 {
+		field, err := opts.field(row, valueColumns[0])
+		if err != nil {
+			return fmt.Errorf("value: %w", err)
+		}
+		value.Write(field)
+		return nil
+	}
+
+	fields := make([]string, len(valueColumns))
+	for i, column := range valueColumns {
+		if column < 0 || column >= len(row) {
+			return fmt.Errorf("value: column %d out of range for %d fields", column, len(row))
+		}
+		fields[i] = row[column]
+	}
+	return opts.encodeRow(value, fields)
+}
+
+// field returns a column of row, decoding it if opts.Base64 is set.
+func (opts *CSVOptions) field(row []string, column int) ([]byte, error) {
+	if column < 0 || column >= len(row) {
+		return nil, fmt.Errorf("column %d out of range for %d fields", column, len(row))
+	}
+	if !opts.Base64 {
+		return []byte(row[column]), nil
+	}
+	return base64.StdEncoding.DecodeString(row[column])
+}
+
+// encodeRow writes fields to buf as a CSV row without a trailing newline.
+func (opts *CSVOptions) encodeRow(buf *bytes.Buffer, fields []string) error {
+	cw := csv.NewWriter(buf)
+	cw.Comma = opts.comma()
+	if err := cw.Write(fields); err != nil {
+		return err
+	}
+	cw.Flush()
+	buf.Truncate(buf.Len() - 1)
+	return nil
+}
+
+// ExportCSV writes every record of r to w as a CSV row of key and value, in
+// the order All yields them. Records that are not valid UTF-8 are encoded
+// as described for CSVOptions.Base64.
+func ExportCSV(r Reader, w io.Writer, opts CSVOptions) error {
+	cw := csv.NewWriter(w)
+	cw.Comma = opts.comma()
+	if opts.Header {
+		if err := cw.Write([]string{"key", "value"}); err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+	}
+
+	row := make([]string, 3)
+	for key, value := range r.All() {
+		row := row[:2]
+		switch {
+		case opts.Base64:
+			row[0] = base64.StdEncoding.EncodeToString(key)
+			row[1] = base64.StdEncoding.EncodeToString(value)
+		case utf8.Valid(key) && utf8.Valid(value):
+			row[0], row[1] = string(key), string(value)
+		default:
+			row = append(row, csvBase64Marker)
+			row[0] = base64.StdEncoding.EncodeToString(key)
+			row[1] = base64.StdEncoding.EncodeToString(value)
+		}
+		if err := cw.Write(row); err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package cdb_test
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/perbu/cdb"
+)
+
+func importCSV(t *testing.T, input string, opts cdb.CSVOptions) ([]string, error) {
+	t.Helper()
+	builder := cdb.NewBuilder()
+	if err := cdb.ImportCSV(strings.NewReader(input), builder.Writer, opts); err != nil {
+		return nil, err
+	}
+	db, err := builder.InMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return collectPairs(db.All()), nil
+}
+
+func TestCSVRoundTrip(t *testing.T) {
+	db := buildInMemory(t, "a", "one, two", "b", "line\nbreak", "c", `"quoted"`)
+
+	var buf bytes.Buffer
+	if err := cdb.ExportCSV(db, &buf, cdb.CSVOptions{Header: true}); err != nil {
+		t.Fatal(err)
+	}
+	want := "key,value\na,\"one, two\"\nb,\"line\nbreak\"\nc,\"\"\"quoted\"\"\"\n"
+	if buf.String() != want {
+		t.Errorf("ExportCSV = %q, want %q", buf.String(), want)
+	}
+	got, err := importCSV(t, buf.String(), cdb.CSVOptions{Header: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, collectPairs(db.All())) {
+		t.Errorf("round trip = %q, want %q", got, collectPairs(db.All()))
+	}
+
+	// Without Base64, only the records that need it are encoded, and
+	// marked so that import decodes them.
+	binary := buildInMemory(t, "\xff", "\x00", "text", "v", "k", "\xfe")
+	buf.Reset()
+	if err := cdb.ExportCSV(binary, &buf, cdb.CSVOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "/w==,AA==,base64\ntext,v\naw==,/g==,base64\n"; buf.String() != want {
+		t.Errorf("ExportCSV of binary records = %q, want %q", buf.String(), want)
+	}
+	got, err = importCSV(t, buf.String(), cdb.CSVOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := collectPairs(binary.All()); !slices.Equal(got, want) {
+		t.Errorf("round trip of binary records = %q, want %q", got, want)
+	}
+
+	binary = buildInMemory(t, "\xff", "\x00")
+	buf.Reset()
+	if err := cdb.ExportCSV(binary, &buf, cdb.CSVOptions{Base64: true}); err != nil {
+		t.Fatal(err)
+	}
+	got, err = importCSV(t, buf.String(), cdb.CSVOptions{Base64: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"\xff=\x00"}; !slices.Equal(got, want) {
+		t.Errorf("base64 round trip = %q, want %q", got, want)
+	}
+}
+
+func TestImportCSVColumns(t *testing.T) {
+	input := "country;city;population;mayor\nno;oslo;700000;x\nse;stockholm;980000;y\n"
+	tests := []struct {
+		opts cdb.CSVOptions
+		want []string
+	}{
+		{cdb.CSVOptions{KeyColumns: []int{0, 1}, KeySeparator: "/", ValueColumns: []int{2}}, []string{
+			"no/oslo=700000",
+			"se/stockholm=980000",
+		}},
+		{cdb.CSVOptions{KeyColumns: []int{1}, ValueColumns: []int{2, 0}}, []string{
+			"oslo=700000;no",
+			"stockholm=980000;se",
+		}},
+		{cdb.CSVOptions{KeyColumns: []int{1}, WholeRow: true}, []string{
+			"oslo=no;oslo;700000;x",
+			"stockholm=se;stockholm;980000;y",
+		}},
+	}
+	for _, tt := range tests {
+		tt.opts.Comma = ';'
+		tt.opts.Header = true
+		got, err := importCSV(t, input, tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("ImportCSV(%+v) = %q, want %q", tt.opts, got, tt.want)
+		}
+	}
+}
+
+func TestImportCSVErrors(t *testing.T) {
+	input := "a,1\nb\nc,\"3\nd,4\n"
+	_, err := importCSV(t, input, cdb.CSVOptions{})
+	var importErr *cdb.ImportError
+	if !errors.As(err, &importErr) || importErr.Line != 2 || importErr.Offset != 4 {
+		t.Errorf("ImportCSV = %v, want an ImportError at line 2, byte 4", err)
+	}
+
+	var skipped int
+	got, err := importCSV(t, "a,1\nb\nc,3\n", cdb.CSVOptions{
+		OnError: cdb.SkipInvalid,
+		OnSkip:  func(error) { skipped++ },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a=1", "c=3"}; !slices.Equal(got, want) || skipped != 1 {
+		t.Errorf("ImportCSV = %q with %d skipped, want %q with 1 skipped", got, skipped, want)
+	}
+
+	_, err = importCSV(t, input, cdb.CSVOptions{OnError: cdb.SkipInvalid})
+	if err != nil {
+		t.Errorf("ImportCSV with an unterminated quote = %v, want it skipped", err)
+	}
+}
@@ -0,0 +1,57 @@
+package cdb
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrInvalidOffset is returned by RecordAt for an offset that is not the
+// start of a record.
+var ErrInvalidOffset = errors.New("CDB offset does not start a record")
+
+// RecordAt returns the key and value of the record at offset and the offset
+// of the next record, which is 0 after the last one. Offset 0 stands for the
+// first record, so a scan that starts at 0 and follows next until it is 0
+// again reads every record once. Offsets are checked against the hash
+// tables, so ones from an untrusted source, such as a client's cursor, fail
+// with ErrInvalidOffset rather than returning garbage. RecordAt returns
+// io.EOF if the database is empty.
+func (cdb *MmapCDB) RecordAt(offset uint64) (key, value []byte, next uint64, err error) {
+	return recordAt(cdb.format.layout(), cdb.data, cdb.end, offset)
+}
+
+// RecordAt returns the record at offset and the offset of the next one. See
+// MmapCDB.RecordAt.
+func (cdb *InMemoryCDB) RecordAt(offset uint64) (key, value []byte, next uint64, err error) {
+	return recordAt(cdb.format.layout(), cdb.data, cdb.end, offset)
+}
+
+// recordAt reads the record at offset of data, whose records end at endPos.
+func recordAt(l layout, data []byte, endPos, offset uint64) ([]byte, []byte, uint64, error) {
+	if offset == 0 {
+		if l.indexSize >= endPos {
+			return nil, nil, 0, io.EOF
+		}
+		offset = l.indexSize
+	}
+	if offset < l.indexSize || offset >= endPos || endPos-offset < l.tupleSize {
+		return nil, nil, 0, ErrInvalidOffset
+	}
+
+	keyLength, valueLength := l.tuple(data, offset)
+	keyEnd := offset + l.tupleSize + keyLength
+	valueEnd := keyEnd + valueLength
+	if keyEnd < offset || valueEnd < keyEnd || valueEnd > endPos {
+		return nil, nil, 0, ErrInvalidOffset
+	}
+	key := data[offset+l.tupleSize : keyEnd]
+	if !hasSlot(l, data, cdbHash(key), offset) {
+		return nil, nil, 0, ErrInvalidOffset
+	}
+
+	next := valueEnd
+	if next == endPos {
+		next = 0
+	}
+	return key, data[keyEnd:valueEnd], next, nil
+}
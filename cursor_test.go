@@ -0,0 +1,51 @@
+package cdb_test
+
+import (
+	"errors"
+	"io"
+	"slices"
+	"testing"
+
+	"github.com/perbu/cdb"
+)
+
+func TestRecordAt(t *testing.T) {
+	for _, path := range []string{testFile, testFile32} {
+		db, err := cdb.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		var got []string
+		var offsets []uint64
+		for offset := uint64(0); ; {
+			key, value, next, err := db.RecordAt(offset)
+			if err != nil {
+				t.Fatalf("%s: RecordAt(%d): %v", path, offset, err)
+			}
+			got = append(got, string(key)+"="+string(value))
+			offsets = append(offsets, next)
+			if next == 0 {
+				break
+			}
+			offset = next
+		}
+		if want := collectPairs(db.All()); !slices.Equal(got, want) {
+			t.Errorf("%s: records by offset = %q, want %q", path, got, want)
+		}
+
+		// An offset inside a record is rejected.
+		if _, _, _, err := db.RecordAt(offsets[0] + 1); !errors.Is(err, cdb.ErrInvalidOffset) {
+			t.Errorf("%s: RecordAt inside a record = %v, want ErrInvalidOffset", path, err)
+		}
+		if _, _, _, err := db.RecordAt(uint64(db.Size())); !errors.Is(err, cdb.ErrInvalidOffset) {
+			t.Errorf("%s: RecordAt past the data = %v, want ErrInvalidOffset", path, err)
+		}
+	}
+
+	empty := buildInMemory(t)
+	if _, _, _, err := empty.RecordAt(0); !errors.Is(err, io.EOF) {
+		t.Errorf("RecordAt of an empty database = %v, want io.EOF", err)
+	}
+}
@@ -0,0 +1,168 @@
+package cdb
+
+import (
+	"bytes"
+	"fmt"
+	"iter"
+	"slices"
+)
+
+// ChangeKind is the kind of difference Diff reports for a key.
+type ChangeKind int
+
+const (
+	// Added means the key is only present in the new database.
+	Added ChangeKind = iota
+	// Removed means the key is only present in the old database.
+	Removed
+	// Changed means the key is present in both with different values.
+	Changed
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	case Changed:
+		return "changed"
+	}
+	return fmt.Sprintf("ChangeKind(%d)", int(k))
+}
+
+// Change is a difference between two databases for a single key. Old and
+// New hold the values of all records of the key in write order, so that
+// duplicate keys are compared as a whole: a key whose records differ in
+// number, order or content is Changed.
+type Change struct {
+	Kind ChangeKind
+	Key  []byte
+	Old  [][]byte
+	New  [][]byte
+}
+
+// DiffSummary counts the keys of two databases by kind of difference.
+type DiffSummary struct {
+	Added     int
+	Removed   int
+	Changed   int
+	Unchanged int
+}
+
+// Diff returns an iterator over the keys that differ between old and new:
+// first the added and changed keys in the write order of new, then the
+// removed keys in the write order of old. Membership is checked through the
+// hash tables of the other database, so neither needs to fit in memory.
+// For readers other than 64-bit MmapCDB and InMemoryCDB, only the value
+// returned by Get is compared and keys seen are kept in memory to skip
+// duplicates.
+// A lookup error is yielded with an empty Change and ends the iteration.
+func Diff(old, new Reader) iter.Seq2[Change, error] {
+	return func(yield func(Change, error) bool) {
+		_ = diff(old, new, func(c Change, unchanged bool, err error) bool {
+			if unchanged {
+				return true
+			}
+			return yield(c, err)
+		})
+	}
+}
+
+// Summarize counts the differences between old and new. See Diff.
+func Summarize(old, new Reader) (DiffSummary, error) {
+	var s DiffSummary
+	err := diff(old, new, func(c Change, unchanged bool, err error) bool {
+		switch {
+		case err != nil:
+			return false
+		case unchanged:
+			s.Unchanged++
+		case c.Kind == Added:
+			s.Added++
+		case c.Kind == Removed:
+			s.Removed++
+		case c.Kind == Changed:
+			s.Changed++
+		}
+		return true
+	})
+	return s, err
+}
+
+// diff calls fn for every distinct key of old and new, reporting whether it
+// is unchanged, until fn returns false. It returns the first lookup error.
+func diff(old, new Reader, fn func(c Change, unchanged bool, err error) bool) error {
+	for key := range firstKeys(new) {
+		newValues, err := valuesOf(new, key)
+		if err != nil {
+			fn(Change{}, false, err)
+			return err
+		}
+		oldValues, err := valuesOf(old, key)
+		if err != nil {
+			fn(Change{}, false, err)
+			return err
+		}
+
+		c := Change{Kind: Changed, Key: key, Old: oldValues, New: newValues}
+		if oldValues == nil {
+			c.Kind = Added
+		}
+		unchanged := oldValues != nil && slices.EqualFunc(oldValues, newValues, bytes.Equal)
+		if !fn(c, unchanged, nil) {
+			return nil
+		}
+	}
+
+	for key := range firstKeys(old) {
+		newValue, err := new.Get(key)
+		if err != nil {
+			fn(Change{}, false, err)
+			return err
+		}
+		if newValue != nil {
+			continue
+		}
+
+		oldValues, err := valuesOf(old, key)
+		if err != nil {
+			fn(Change{}, false, err)
+			return err
+		}
+		if !fn(Change{Kind: Removed, Key: key, Old: oldValues}, false, nil) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// firstKeys yields every distinct key of r once.
+func firstKeys(r Reader) iter.Seq[[]byte] {
+	return func(yield func([]byte) bool) {
+		for key := range firstRecords(r) {
+			if !yield(key) {
+				return
+			}
+		}
+	}
+}
+
+// valuesOf returns the values of all records of key in r, or nil if there
+// are none. Readers without raw access only report the value from Get.
+func valuesOf(r Reader, key []byte) ([][]byte, error) {
+	if data, ok := rawDataOf(r); ok {
+		var values [][]byte
+		forEachValue(data, cdbHash(key), key, func(_ uint64, value []byte) bool {
+			values = append(values, value)
+			return true
+		})
+		return values, nil
+	}
+
+	value, err := r.Get(key)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	return [][]byte{value}, nil
+}
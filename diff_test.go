@@ -0,0 +1,72 @@
+package cdb_test
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/perbu/cdb"
+)
+
+func diffToStrings(t *testing.T, old, new cdb.Reader) []string {
+	t.Helper()
+	var out []string
+	for c, err := range cdb.Diff(old, new) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, fmt.Sprintf("%s %s %q %q", c.Kind, c.Key, bytes.Join(c.Old, []byte(",")), bytes.Join(c.New, []byte(","))))
+	}
+	return out
+}
+
+func TestDiff(t *testing.T) {
+	old := buildInMemory(t,
+		"same", "1",
+		"changed", "old",
+		"removed", "gone",
+		"dup", "x", "dup", "y",
+		"dupsame", "p", "dupsame", "q",
+	)
+	new := buildInMemory(t,
+		"added", "new",
+		"dupsame", "p", "dupsame", "q",
+		"changed", "new",
+		"dup", "x",
+		"same", "1",
+	)
+
+	want := []string{
+		`added added "" "new"`,
+		`changed changed "old" "new"`,
+		`changed dup "x,y" "x"`,
+		`removed removed "gone" ""`,
+	}
+	if got := diffToStrings(t, old, new); !slices.Equal(got, want) {
+		t.Errorf("Diff = %q, want %q", got, want)
+	}
+
+	// Generic readers only compare the value Get returns.
+	wantGeneric := []string{
+		`added added "" "new"`,
+		`changed changed "old" "new"`,
+		`removed removed "gone" ""`,
+	}
+	if got := diffToStrings(t, iterOnly{old}, iterOnly{new}); !slices.Equal(got, wantGeneric) {
+		t.Errorf("Diff of generic readers = %q, want %q", got, wantGeneric)
+	}
+
+	if got := diffToStrings(t, old, old); len(got) != 0 {
+		t.Errorf("Diff of identical databases = %q, want nothing", got)
+	}
+
+	summary, err := cdb.Summarize(old, new)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantSummary := cdb.DiffSummary{Added: 1, Removed: 1, Changed: 2, Unchanged: 2}
+	if summary != wantSummary {
+		t.Errorf("Summarize = %+v, want %+v", summary, wantSummary)
+	}
+}
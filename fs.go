@@ -0,0 +1,269 @@
+package cdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// FS is a read-only file system over a database whose keys are
+// slash-separated paths, such as one built by PackFS. Each record is a file
+// holding its value, a key ending in a slash marks a directory, which is
+// only needed for empty ones, and the other directories are implied by the
+// paths below them. Keys that are not valid paths, as defined by
+// fs.ValidPath, are ignored.
+//
+// Files have mode 0444, directories mode 0555, and all have a zero
+// modification time, like the files of an embed.FS. Files read the values
+// in place, so they, and the FS, are only usable while the database is open.
+type FS struct {
+	r       Reader
+	entries map[string]*fsEntry
+}
+
+var (
+	_ fs.ReadFileFS = (*FS)(nil)
+	_ fs.ReadDirFS  = (*FS)(nil)
+	_ fs.StatFS     = (*FS)(nil)
+)
+
+// NewFS returns an FS over r. It reads all keys to build the directory tree
+// and fails if a path is both a file and a directory. The FS does not close
+// r.
+func NewFS(r Reader) (*FS, error) {
+	root := &fsEntry{name: ".", dir: true}
+	fsys := &FS{r: r, entries: map[string]*fsEntry{".": root}}
+	for key, value := range r.All() {
+		name, dir := strings.CutSuffix(string(key), "/")
+		if !fs.ValidPath(name) || name == "." {
+			continue
+		}
+		if err := fsys.add(name, dir, int64(len(value))); err != nil {
+			return nil, err
+		}
+	}
+	for _, e := range fsys.entries {
+		slices.SortFunc(e.children, func(a, b *fsEntry) int {
+			return strings.Compare(a.name, b.name)
+		})
+	}
+	return fsys, nil
+}
+
+// add adds the file or directory name, and the directories above it. A
+// name that is already present keeps its first entry.
+func (fsys *FS) add(name string, dir bool, size int64) error {
+	if e, ok := fsys.entries[name]; ok {
+		if e.dir != dir {
+			return fmt.Errorf("%s is both a file and a directory", name)
+		}
+		return nil
+	}
+	parent := path.Dir(name)
+	if err := fsys.add(parent, true, 0); err != nil {
+		return err
+	}
+	e := &fsEntry{name: path.Base(name), dir: dir}
+	if !dir {
+		e.size = size
+	}
+	fsys.entries[name] = e
+	fsys.entries[parent].children = append(fsys.entries[parent].children, e)
+	return nil
+}
+
+// Open opens the named file or directory.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	e, err := fsys.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if e.dir {
+		return &fsDir{path: name, entry: e}, nil
+	}
+	value, err := fsys.value("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return &fsFile{entry: e, Reader: bytes.NewReader(value)}, nil
+}
+
+// ReadFile returns a copy of the contents of the named file.
+func (fsys *FS) ReadFile(name string) ([]byte, error) {
+	e, err := fsys.lookup("read", name)
+	if err != nil {
+		return nil, err
+	}
+	if e.dir {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errIsDir}
+	}
+	value, err := fsys.value("read", name)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Clone(value), nil
+}
+
+// ReadDir returns the entries of the named directory, sorted by name.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	e, err := fsys.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !e.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errNotDir}
+	}
+	entries := make([]fs.DirEntry, len(e.children))
+	for i, child := range e.children {
+		entries[i] = child
+	}
+	return entries, nil
+}
+
+// Stat returns a FileInfo describing the named file or directory.
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	e, err := fsys.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+var (
+	errIsDir  = errors.New("is a directory")
+	errNotDir = errors.New("not a directory")
+)
+
+func (fsys *FS) lookup(op, name string) (*fsEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	e, ok := fsys.entries[name]
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return e, nil
+}
+
+func (fsys *FS) value(op, name string) ([]byte, error) {
+	value, err := fsys.r.Get([]byte(name))
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	if value == nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return value, nil
+}
+
+// fsEntry is a file or directory of an FS. It is both its fs.FileInfo and
+// its fs.DirEntry.
+type fsEntry struct {
+	name     string
+	dir      bool
+	size     int64
+	children []*fsEntry
+}
+
+func (e *fsEntry) Name() string               { return e.name }
+func (e *fsEntry) Size() int64                { return e.size }
+func (e *fsEntry) ModTime() time.Time         { return time.Time{} }
+func (e *fsEntry) IsDir() bool                { return e.dir }
+func (e *fsEntry) Sys() any                   { return nil }
+func (e *fsEntry) Type() fs.FileMode          { return e.Mode().Type() }
+func (e *fsEntry) Info() (fs.FileInfo, error) { return e, nil }
+func (e *fsEntry) String() string             { return fs.FormatFileInfo(e) }
+
+func (e *fsEntry) Mode() fs.FileMode {
+	if e.dir {
+		return fs.ModeDir | 0o555
+	}
+	return 0o444
+}
+
+// fsFile is an open file. It reads its value in place and implements
+// io.Seeker, io.ReaderAt and io.WriterTo.
+type fsFile struct {
+	entry *fsEntry
+	*bytes.Reader
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) { return f.entry, nil }
+func (f *fsFile) Close() error               { return nil }
+
+// fsDir is an open directory.
+type fsDir struct {
+	path   string
+	entry  *fsEntry
+	offset int
+}
+
+func (d *fsDir) Stat() (fs.FileInfo, error) { return d.entry, nil }
+func (d *fsDir) Close() error               { return nil }
+
+func (d *fsDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.path, Err: errIsDir}
+}
+
+// ReadDir returns the next n entries of the directory, or all remaining
+// entries if n <= 0, as described by fs.ReadDirFile.
+func (d *fsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entry.children[d.offset:]
+	if n > 0 {
+		if len(rest) == 0 {
+			return nil, io.EOF
+		}
+		rest = rest[:min(n, len(rest))]
+	}
+	entries := make([]fs.DirEntry, len(rest))
+	for i, child := range rest {
+		entries[i] = child
+	}
+	d.offset += len(rest)
+	return entries, nil
+}
+
+// PackFS adds every file of fsys to w, with its slash-separated path as the
+// key and its contents as the value, in the lexical order of fs.WalkDir.
+// Empty directories are recorded by a key of their path and a slash, so that
+// NewFS over the database reproduces the tree. The contents of other file
+// types, such as symbolic links, are read with fs.ReadFile. PackFS does not
+// finalize w.
+func PackFS(fsys fs.FS, w *Writer) error {
+	// empty is a directory none of whose entries have been seen yet.
+	var empty string
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if empty != "" {
+			if !strings.HasPrefix(name, empty+"/") {
+				if err := w.Put([]byte(empty+"/"), nil); err != nil {
+					return err
+				}
+			}
+			empty = ""
+		}
+		if d.IsDir() {
+			if name != "." {
+				empty = name
+			}
+			return nil
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return fmt.Errorf("fs.ReadFile(%q): %w", name, err)
+		}
+		return w.Put([]byte(name), data)
+	})
+	if err != nil || empty == "" {
+		return err
+	}
+	return w.Put([]byte(empty+"/"), nil)
+}
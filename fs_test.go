@@ -0,0 +1,80 @@
+package cdb_test
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/perbu/cdb"
+)
+
+func TestPackFS(t *testing.T) {
+	src := fstest.MapFS{
+		"index.html":         {Data: []byte("<h1>hello</h1>")},
+		"css/site.css":       {Data: []byte("body {}")},
+		"js/app.js":          {Data: []byte("main()")},
+		"js/vendor/lib.js":   {Data: []byte("lib()")},
+		"empty.txt":          {Data: []byte{}},
+		"images/empty":       {Mode: fs.ModeDir},
+		"images/logo.svg":    {Data: []byte("<svg/>")},
+		"deep/a/b/c/file.md": {Data: []byte("# deep")},
+		"zzz-empty":          {Mode: fs.ModeDir},
+	}
+
+	path := filepath.Join(t.TempDir(), "assets.cdb")
+	w, err := cdb.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cdb.PackFS(src, w); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err := cdb.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	fsys, err := cdb.NewFS(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(fsys, "index.html", "css/site.css", "js/vendor/lib.js", "empty.txt",
+		"images/logo.svg", "images/empty", "deep/a/b/c/file.md", "zzz-empty"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := fsys.ReadFile("js/app.js")
+	if err != nil || string(data) != "main()" {
+		t.Fatalf("ReadFile(js/app.js) = %q, %v", data, err)
+	}
+	// The returned slice is a copy that may be modified.
+	data[0] = 'M'
+	if data, _ := fs.ReadFile(fsys, "js/app.js"); string(data) != "main()" {
+		t.Errorf("ReadFile after modifying a result = %q", data)
+	}
+	if _, err := fsys.Open("missing.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Open(missing.txt) = %v, want ErrNotExist", err)
+	}
+}
+
+func TestNewFSConflict(t *testing.T) {
+	b := cdb.NewBuilder()
+	for _, key := range []string{"a/b", "a"} {
+		if err := b.Put([]byte(key), []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db, err := b.InMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cdb.NewFS(db); err == nil {
+		t.Error("NewFS with a path that is both a file and a directory succeeded")
+	}
+}
@@ -0,0 +1,296 @@
+package cdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// JSONLOptions configures ImportJSONL and ExportJSONL.
+//
+// By default both use one object per line with the key in "key" and the
+// value in "value", or in "key_base64" and "value_base64" when they are not
+// valid UTF-8, so that any database survives a round trip.
+type JSONLOptions struct {
+	// KeyField selects the key of each object on import, as a JSON pointer
+	// such as "/user/id" or as the name of a top-level field. Strings are
+	// used as they are, numbers and booleans as their JSON text. Empty means
+	// the "key" field if ValueField is set, and the default layout if not.
+	KeyField string
+
+	// ValueField selects the value of each object on import, like
+	// KeyField. Strings are stored as they are, anything else as compact
+	// JSON. Empty means the whole object, as compact JSON, unless KeyField
+	// is empty too.
+	ValueField string
+
+	// Base64 makes import decode selected string keys and values from
+	// standard base64, and export encode every key and value in the
+	// "_base64" fields.
+	Base64 bool
+
+	// OnError decides what happens with lines that are not valid JSON or
+	// lack the key or value. OnSkip, if set, is called with the
+	// *ImportError of every skipped line.
+	OnError ErrorPolicy
+	OnSkip  func(error)
+}
+
+// jsonlRecord is a line in the default layout. On import, a value that is
+// not a string is stored as compact JSON.
+type jsonlRecord struct {
+	Key         *string         `json:"key,omitempty"`
+	KeyBase64   *string         `json:"key_base64,omitempty"`
+	Value       json.RawMessage `json:"value,omitempty"`
+	ValueBase64 *string         `json:"value_base64,omitempty"`
+}
+
+// jsonlExport is a line written by ExportJSONL.
+type jsonlExport struct {
+	Key         *string `json:"key,omitempty"`
+	KeyBase64   *string `json:"key_base64,omitempty"`
+	Value       *string `json:"value,omitempty"`
+	ValueBase64 *string `json:"value_base64,omitempty"`
+}
+
+// ImportJSONL adds a record to w for every JSON object in r, one per line.
+// Empty lines are ignored. Problems with a line are reported as an
+// *ImportError with its line number and byte offset, or skipped according
+// to opts.OnError. W is not finalized.
+func ImportJSONL(r io.Reader, w *Writer, opts JSONLOptions) error {
+	br := bufio.NewReader(r)
+	var (
+		offset  int64
+		compact bytes.Buffer
+	)
+	for lineNo := 1; ; lineNo++ {
+		line, readErr := br.ReadBytes('\n')
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			return fmt.Errorf("read: %w", readErr)
+		}
+		start := offset
+		offset += int64(len(line))
+
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			key, value, err := opts.parse(line, &compact)
+			if err != nil {
+				err = &ImportError{Line: lineNo, Offset: start, Err: err}
+				if err := opts.OnError.handle(err, opts.OnSkip); err != nil {
+					return err
+				}
+			} else if err := w.Put(key, value); err != nil {
+				return fmt.Errorf("line %d: %w", lineNo, err)
+			}
+		}
+
+		if readErr != nil {
+			return nil
+		}
+	}
+}
+
+// parse returns the key and value of a line.
+func (opts *JSONLOptions) parse(line []byte, compact *bytes.Buffer) ([]byte, []byte, error) {
+	if opts.KeyField == "" && opts.ValueField == "" {
+		return opts.parseRecord(line)
+	}
+	if !json.Valid(line) {
+		return nil, nil, errors.New("invalid JSON")
+	}
+
+	keyField := opts.KeyField
+	if keyField == "" {
+		keyField = "key"
+	}
+	raw, err := jsonPointer(line, keyField)
+	if err != nil {
+		return nil, nil, fmt.Errorf("key %q: %w", keyField, err)
+	}
+	key, err := opts.scalar(raw)
+	if err != nil {
+		return nil, nil, fmt.Errorf("key %q: %w", keyField, err)
+	}
+
+	if opts.ValueField == "" {
+		compact.Reset()
+		if err := json.Compact(compact, line); err != nil {
+			return nil, nil, err
+		}
+		return key, compact.Bytes(), nil
+	}
+	raw, err = jsonPointer(line, opts.ValueField)
+	if err != nil {
+		return nil, nil, fmt.Errorf("value %q: %w", opts.ValueField, err)
+	}
+	value, err := opts.value(raw, compact)
+	if err != nil {
+		return nil, nil, fmt.Errorf("value %q: %w", opts.ValueField, err)
+	}
+	return key, value, nil
+}
+
+// parseRecord parses a line in the default layout.
+func (opts *JSONLOptions) parseRecord(line []byte) ([]byte, []byte, error) {
+	var rec jsonlRecord
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return nil, nil, err
+	}
+
+	var key, value []byte
+	switch {
+	case rec.KeyBase64 != nil:
+		decoded, err := base64.StdEncoding.DecodeString(*rec.KeyBase64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("key_base64: %w", err)
+		}
+		key = decoded
+	case rec.Key != nil:
+		key = []byte(*rec.Key)
+	default:
+		return nil, nil, errors.New(`missing "key"`)
+	}
+
+	switch {
+	case rec.ValueBase64 != nil:
+		decoded, err := base64.StdEncoding.DecodeString(*rec.ValueBase64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("value_base64: %w", err)
+		}
+		value = decoded
+	case rec.Value != nil:
+		var s string
+		if err := json.Unmarshal(rec.Value, &s); err == nil {
+			value = []byte(s)
+		} else {
+			var compact bytes.Buffer
+			if err := json.Compact(&compact, rec.Value); err != nil {
+				return nil, nil, err
+			}
+			value = compact.Bytes()
+		}
+	default:
+		return nil, nil, errors.New(`missing "value"`)
+	}
+	return key, value, nil
+}
+
+// scalar converts a selected key to bytes.
+func (opts *JSONLOptions) scalar(raw json.RawMessage) ([]byte, error) {
+	switch raw[0] {
+	case '"':
+		return opts.str(raw)
+	case '{', '[', 'n':
+		return nil, errors.New("must be a string, number or boolean")
+	}
+	return raw, nil
+}
+
+// value converts a selected value to bytes.
+func (opts *JSONLOptions) value(raw json.RawMessage, compact *bytes.Buffer) ([]byte, error) {
+	if raw[0] == '"' {
+		return opts.str(raw)
+	}
+	compact.Reset()
+	if err := json.Compact(compact, raw); err != nil {
+		return nil, err
+	}
+	return compact.Bytes(), nil
+}
+
+// str decodes a JSON string, and then base64 if opts.Base64 is set.
+func (opts *JSONLOptions) str(raw json.RawMessage) ([]byte, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, err
+	}
+	if !opts.Base64 {
+		return []byte(s), nil
+	}
+	return base64.StdEncoding.DecodeString(s)
+}
+
+var pointerUnescaper = strings.NewReplacer("~1", "/", "~0", "~")
+
+// jsonPointer returns the raw JSON selected by pointer in doc. A pointer
+// without a leading slash names a top-level field.
+func jsonPointer(doc []byte, pointer string) (json.RawMessage, error) {
+	raw := json.RawMessage(bytes.TrimSpace(doc))
+	if pointer == "" {
+		return raw, nil
+	}
+
+	var tokens []string
+	if strings.HasPrefix(pointer, "/") {
+		tokens = strings.Split(pointer[1:], "/")
+	} else {
+		tokens = []string{pointer}
+	}
+	for _, token := range tokens {
+		token = pointerUnescaper.Replace(token)
+		switch raw[0] {
+		case '{':
+			var object map[string]json.RawMessage
+			if err := json.Unmarshal(raw, &object); err != nil {
+				return nil, err
+			}
+			next, ok := object[token]
+			if !ok {
+				return nil, fmt.Errorf("field %q not found", token)
+			}
+			raw = next
+		case '[':
+			var array []json.RawMessage
+			if err := json.Unmarshal(raw, &array); err != nil {
+				return nil, err
+			}
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(array) {
+				return nil, fmt.Errorf("index %q out of range", token)
+			}
+			raw = array[i]
+		default:
+			return nil, fmt.Errorf("cannot select %q in a scalar", token)
+		}
+	}
+	return raw, nil
+}
+
+// ExportJSONL writes every record of r to w as a JSON object per line, in
+// the default layout described by JSONLOptions, in the order All yields
+// them. Only opts.Base64 is used.
+func ExportJSONL(r Reader, w io.Writer, opts JSONLOptions) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	for key, value := range r.All() {
+		var rec jsonlExport
+		if opts.Base64 || !utf8.Valid(key) {
+			s := base64.StdEncoding.EncodeToString(key)
+			rec.KeyBase64 = &s
+		} else {
+			s := string(key)
+			rec.Key = &s
+		}
+		if opts.Base64 || !utf8.Valid(value) {
+			s := base64.StdEncoding.EncodeToString(value)
+			rec.ValueBase64 = &s
+		} else {
+			s := string(value)
+			rec.Value = &s
+		}
+		if err := enc.Encode(rec); err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package cdb_test
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/perbu/cdb"
+)
+
+func importJSONL(t *testing.T, input string, opts cdb.JSONLOptions) ([]string, error) {
+	t.Helper()
+	builder := cdb.NewBuilder()
+	if err := cdb.ImportJSONL(strings.NewReader(input), builder.Writer, opts); err != nil {
+		return nil, err
+	}
+	db, err := builder.InMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return collectPairs(db.All()), nil
+}
+
+func TestJSONLRoundTrip(t *testing.T) {
+	db := buildInMemory(t, "plain", "<value> & more", "bin\xff", "\xfe\x01", "", "")
+
+	var buf bytes.Buffer
+	if err := cdb.ExportJSONL(db, &buf, cdb.JSONLOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"key":"plain","value":"<value> & more"}
+{"key_base64":"Ymlu/w==","value_base64":"/gE="}
+{"key":"","value":""}
+`
+	if buf.String() != want {
+		t.Errorf("ExportJSONL = %q, want %q", buf.String(), want)
+	}
+
+	got, err := importJSONL(t, buf.String(), cdb.JSONLOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, collectPairs(db.All())) {
+		t.Errorf("round trip = %q, want %q", got, collectPairs(db.All()))
+	}
+}
+
+func TestImportJSONLFields(t *testing.T) {
+	input := `{"id": 7, "user": {"name": "per", "roles": ["admin", "dev"]}}
+
+{"id": "x/y", "user": {"name": "anna", "roles": []}}
+`
+	tests := []struct {
+		opts cdb.JSONLOptions
+		want []string
+	}{
+		{cdb.JSONLOptions{KeyField: "id"}, []string{
+			`7={"id":7,"user":{"name":"per","roles":["admin","dev"]}}`,
+			`x/y={"id":"x/y","user":{"name":"anna","roles":[]}}`,
+		}},
+		{cdb.JSONLOptions{KeyField: "/user/name", ValueField: "/user/roles"}, []string{
+			`per=["admin","dev"]`,
+			`anna=[]`,
+		}},
+		{cdb.JSONLOptions{KeyField: "/user/name", ValueField: "/id"}, []string{
+			`per=7`,
+			`anna=x/y`,
+		}},
+	}
+	for _, tt := range tests {
+		got, err := importJSONL(t, input, tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("ImportJSONL(%+v) = %q, want %q", tt.opts, got, tt.want)
+		}
+	}
+
+	// With only ValueField, the key is the "key" field.
+	got, err := importJSONL(t, `{"key": "a", "data": {"n": 1}}
+{"key": 2, "data": "two"}
+`, cdb.JSONLOptions{ValueField: "data"})
+	if want := []string{`a={"n":1}`, `2=two`}; err != nil || !slices.Equal(got, want) {
+		t.Errorf("ImportJSONL with only ValueField = %q, %v, want %q", got, err, want)
+	}
+}
+
+func TestImportJSONLErrors(t *testing.T) {
+	input := `{"id": "a", "v": 1}
+{"id": "b", "v":
+{"v": 3}
+{"id": {"nested": true}, "v": 4}
+{"id": "e", "v": 5}
+`
+	opts := cdb.JSONLOptions{KeyField: "id", ValueField: "v"}
+	_, err := importJSONL(t, input, opts)
+	var importErr *cdb.ImportError
+	if !errors.As(err, &importErr) || importErr.Line != 2 || importErr.Offset != 20 {
+		t.Errorf("ImportJSONL = %v, want an ImportError at line 2, byte 20", err)
+	}
+
+	var skipped []int
+	opts.OnError = cdb.SkipInvalid
+	opts.OnSkip = func(err error) {
+		if errors.As(err, &importErr) {
+			skipped = append(skipped, importErr.Line)
+		}
+	}
+	got, err := importJSONL(t, input, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a=1", "e=5"}; !slices.Equal(got, want) {
+		t.Errorf("ImportJSONL = %q, want %q", got, want)
+	}
+	if want := []int{2, 3, 4}; !slices.Equal(skipped, want) {
+		t.Errorf("skipped lines %v, want %v", skipped, want)
+	}
+}
@@ -0,0 +1,324 @@
+package cdb
+
+import "fmt"
+
+type mergeMode int
+
+const (
+	mergeFirstWins mergeMode = iota
+	mergeLastWins
+	mergeKeepAll
+	mergeCombine
+)
+
+// MergePolicy decides which records Merge keeps for a key that is present
+// in more than one source. Records of keys found in a single source are
+// always copied unchanged, including duplicates within that source.
+type MergePolicy struct {
+	mode    mergeMode
+	combine func(key []byte, values [][]byte) ([]byte, error)
+}
+
+var (
+	// MergeFirstWins keeps the records of the first source containing the
+	// key.
+	MergeFirstWins = MergePolicy{mode: mergeFirstWins}
+	// MergeLastWins keeps the records of the last source containing the key.
+	MergeLastWins = MergePolicy{mode: mergeLastWins}
+	// MergeKeepAll keeps every record of every source.
+	MergeKeepAll = MergePolicy{mode: mergeKeepAll}
+)
+
+// MergeCombine returns a MergePolicy that replaces all records of a key
+// present in several sources with a single record whose value is returned
+// by fn. Fn receives the values of all those records in source order. An
+// error from fn aborts the merge.
+func MergeCombine(fn func(key []byte, values [][]byte) ([]byte, error)) MergePolicy {
+	return MergePolicy{mode: mergeCombine, combine: fn}
+}
+
+// rawReader is implemented by readers whose complete database is available
+// as a byte slice. rawData returns nil unless the database is in Format64.
+type rawReader interface {
+	rawData() []byte
+}
+
+func (cdb *MmapCDB) rawData() []byte {
+	if cdb.format != Format64 {
+		return nil
+	}
+	return cdb.data
+}
+
+func (cdb *InMemoryCDB) rawData() []byte {
+	if cdb.format != Format64 {
+		return nil
+	}
+	return cdb.data
+}
+
+// rawDataOf returns the complete 64-bit database behind r, if available.
+func rawDataOf(r Reader) ([]byte, bool) {
+	if raw, ok := r.(rawReader); ok {
+		if data := raw.rawData(); data != nil {
+			return data, true
+		}
+	}
+	return nil, false
+}
+
+// mergeBatchEntries bounds the number of hash table entries Merge collects
+// before appending a run of records to the destination.
+const mergeBatchEntries = 1 << 16
+
+// Merge adds the records of all sources to dst in source order, resolving
+// keys present in several sources according to policy. Records are copied
+// as raw byte ranges with their hashes computed once when the sources are
+// 64-bit MmapCDB or InMemoryCDB. Membership of keys in the other sources is
+// checked through their hash tables, so sources do not need to fit in
+// memory. Dst is not finalized.
+func Merge(dst *Writer, policy MergePolicy, srcs ...Reader) error {
+	if policy.mode == mergeCombine && policy.combine == nil {
+		return fmt.Errorf("merge: MergeCombine requires a function")
+	}
+
+	m := merger{dst: dst, policy: policy, srcs: srcs}
+	for i, src := range srcs {
+		var err error
+		if data, ok := rawDataOf(src); ok {
+			err = m.mergeRaw(i, data)
+		} else {
+			err = m.mergeRecords(i, src)
+		}
+		if err != nil {
+			return fmt.Errorf("merge source %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+type merger struct {
+	dst    *Writer
+	policy MergePolicy
+	srcs   []Reader
+}
+
+// decision is what the merger does with a single record.
+type decision int
+
+const (
+	keepRecord decision = iota
+	skipRecord
+	combineRecords
+)
+
+// decide returns what to do with a record of key in source i. first
+// reports whether it is the first record of key in that source.
+func (m *merger) decide(i int, hash uint32, key []byte, first bool) decision {
+	switch m.policy.mode {
+	case mergeFirstWins:
+		if m.inAny(hash, key, 0, i) {
+			return skipRecord
+		}
+	case mergeLastWins:
+		if m.inAny(hash, key, i+1, len(m.srcs)) {
+			return skipRecord
+		}
+	case mergeCombine:
+		if m.inAny(hash, key, 0, i) {
+			return skipRecord // combined when the first source was merged
+		}
+		if m.inAny(hash, key, i+1, len(m.srcs)) {
+			if first {
+				return combineRecords
+			}
+			return skipRecord
+		}
+	}
+	return keepRecord
+}
+
+// inAny reports whether key is present in any of srcs[from:to].
+func (m *merger) inAny(hash uint32, key []byte, from, to int) bool {
+	for _, src := range m.srcs[from:to] {
+		if data, ok := rawDataOf(src); ok {
+			found := false
+			forEachValue(data, hash, key, func(uint64, []byte) bool {
+				found = true
+				return false
+			})
+			if found {
+				return true
+			}
+			continue
+		}
+		if value, err := src.Get(key); err == nil && value != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// combine writes a single record for key, combining the values of all its
+// records in srcs[from:].
+func (m *merger) combine(from int, hash uint32, key []byte) error {
+	var values [][]byte
+	for _, src := range m.srcs[from:] {
+		if data, ok := rawDataOf(src); ok {
+			forEachValue(data, hash, key, func(_ uint64, value []byte) bool {
+				values = append(values, value)
+				return true
+			})
+			continue
+		}
+		value, err := src.Get(key)
+		if err != nil {
+			return err
+		}
+		if value != nil {
+			values = append(values, value)
+		}
+	}
+
+	value, err := m.policy.combine(key, values)
+	if err != nil {
+		return err
+	}
+	return m.dst.Put(key, value)
+}
+
+// mergeRaw copies the records of source i, held in data, appending runs of
+// kept records to dst without re-encoding them.
+func (m *merger) mergeRaw(i int, data []byte) error {
+	var (
+		runStart uint64
+		runEnd   uint64
+		entries  []entry
+	)
+	flush := func() error {
+		if len(entries) > 0 {
+			if err := m.dst.putRaw(data[runStart:runEnd], entries); err != nil {
+				return err
+			}
+		}
+		entries = entries[:0]
+		return nil
+	}
+
+	endPos := dataEnd(data)
+	pos := uint64(indexSize)
+	for pos < endPos {
+		keyLength, valueLength := readTupleMmap(data, pos)
+		keyEnd := pos + 16 + keyLength
+		recordEnd := keyEnd + valueLength
+		if pos+16 > endPos || keyEnd < pos || recordEnd < keyEnd || recordEnd > endPos {
+			return corrupt("record at offset %d extends past the data section", pos)
+		}
+		key := data[pos+16 : keyEnd]
+		hash := cdbHash(key)
+
+		d := keepRecord
+		if m.policy.mode != mergeKeepAll {
+			d = m.decide(i, hash, key, m.isFirst(data, hash, key, pos))
+		}
+
+		if d == keepRecord {
+			if len(entries) == 0 {
+				runStart = pos
+			}
+			entries = append(entries, entry{hash: hash, offset: pos - runStart})
+			runEnd = recordEnd
+			if len(entries) >= mergeBatchEntries {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		} else {
+			if err := flush(); err != nil {
+				return err
+			}
+			if d == combineRecords {
+				if err := m.combine(i, hash, key); err != nil {
+					return err
+				}
+			}
+		}
+		pos = recordEnd
+	}
+	return flush()
+}
+
+// isFirst reports whether the record at pos is the first record of key.
+func (m *merger) isFirst(data []byte, hash uint32, key []byte, pos uint64) bool {
+	if m.policy.mode != mergeCombine {
+		return true
+	}
+	first := true
+	forEachValue(data, hash, key, func(offset uint64, _ []byte) bool {
+		first = offset == pos
+		return false
+	})
+	return first
+}
+
+// mergeRecords copies the records of source i through its iterator.
+func (m *merger) mergeRecords(i int, src Reader) error {
+	seen := make(map[string]bool)
+	for key, value := range src.All() {
+		hash := cdbHash(key)
+
+		first := true
+		if m.policy.mode == mergeCombine {
+			first = !seen[string(key)]
+			seen[string(key)] = true
+		}
+
+		d := keepRecord
+		if m.policy.mode != mergeKeepAll {
+			d = m.decide(i, hash, key, first)
+		}
+
+		switch d {
+		case keepRecord:
+			if err := m.dst.Put(key, value); err != nil {
+				return err
+			}
+		case combineRecords:
+			if err := m.combine(i, hash, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// forEachValue calls fn with the offset and value of every record of key in
+// data, in the order Get would find them, until fn returns false.
+func forEachValue(data []byte, hash uint32, key []byte, fn func(offset uint64, value []byte) bool) {
+	t := readTableAt(data, uint8(hash&0xff))
+	if t.length == 0 {
+		return
+	}
+
+	startingSlot := t.startSlot(hash)
+	slot := startingSlot
+	for {
+		slotHash, offset := readTupleMmap(data, t.offset+16*slot)
+		if offset == 0 {
+			return
+		}
+		if slotHash == uint64(hash) {
+			if value := getValueAt(data, offset, key); value != nil && !fn(offset, value) {
+				return
+			}
+		}
+
+		slot++
+		if slot == t.length {
+			slot = 0
+		}
+		if slot == startingSlot {
+			return
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package cdb_test
+
+import (
+	"bytes"
+	"errors"
+	"iter"
+	"slices"
+	"testing"
+
+	"github.com/perbu/cdb"
+)
+
+func buildInMemory(t *testing.T, records ...string) *cdb.InMemoryCDB {
+	t.Helper()
+	builder := cdb.NewBuilder()
+	for i := 0; i < len(records); i += 2 {
+		if err := builder.Put([]byte(records[i]), []byte(records[i+1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db, err := builder.InMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// iterOnly hides the concrete reader type so Merge takes its generic path.
+type iterOnly struct {
+	cdb.Reader
+}
+
+func collectPairs(seq iter.Seq2[[]byte, []byte]) []string {
+	var out []string
+	for key, value := range seq {
+		out = append(out, string(key)+"="+string(value))
+	}
+	return out
+}
+
+func mergeToPairs(t *testing.T, policy cdb.MergePolicy, srcs ...cdb.Reader) []string {
+	t.Helper()
+	builder := cdb.NewBuilder()
+	if err := cdb.Merge(builder.Writer, policy, srcs...); err != nil {
+		t.Fatal(err)
+	}
+	db, err := builder.InMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	return collectPairs(db.All())
+}
+
+func TestMerge(t *testing.T) {
+	eu := buildInMemory(t, "a", "eu-a", "b", "eu-b", "dup", "eu-1", "dup", "eu-2")
+	us := buildInMemory(t, "b", "us-b", "c", "us-c", "dup", "us-1")
+	ap := buildInMemory(t, "c", "ap-c", "d", "ap-d")
+
+	combine := cdb.MergeCombine(func(key []byte, values [][]byte) ([]byte, error) {
+		return bytes.Join(values, []byte("+")), nil
+	})
+
+	tests := []struct {
+		name     string
+		policy   cdb.MergePolicy
+		expected []string
+	}{
+		{"first wins", cdb.MergeFirstWins, []string{"a=eu-a", "b=eu-b", "dup=eu-1", "dup=eu-2", "c=us-c", "d=ap-d"}},
+		{"last wins", cdb.MergeLastWins, []string{"a=eu-a", "b=us-b", "dup=us-1", "c=ap-c", "d=ap-d"}},
+		{"keep all", cdb.MergeKeepAll, []string{"a=eu-a", "b=eu-b", "dup=eu-1", "dup=eu-2", "b=us-b", "c=us-c", "dup=us-1", "c=ap-c", "d=ap-d"}},
+		{"combine", combine, []string{"a=eu-a", "b=eu-b+us-b", "dup=eu-1+eu-2+us-1", "c=us-c+ap-c", "d=ap-d"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeToPairs(t, tt.policy, eu, us, ap)
+			if !slices.Equal(got, tt.expected) {
+				t.Errorf("raw sources: expected %v, got %v", tt.expected, got)
+			}
+
+			got = mergeToPairs(t, tt.policy, iterOnly{eu}, iterOnly{us}, iterOnly{ap})
+			if tt.name == "combine" {
+				// Generic readers only expose the first value of a key.
+				tt.expected[2] = "dup=eu-1+us-1"
+			}
+			if !slices.Equal(got, tt.expected) {
+				t.Errorf("generic sources: expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestMergeCombineError(t *testing.T) {
+	a := buildInMemory(t, "key", "1")
+	b := buildInMemory(t, "key", "2")
+	fail := errors.New("cannot combine")
+
+	builder := cdb.NewBuilder()
+	err := cdb.Merge(builder.Writer, cdb.MergeCombine(func([]byte, [][]byte) ([]byte, error) {
+		return nil, fail
+	}), a, b)
+	if !errors.Is(err, fail) {
+		t.Errorf("expected combine error, got %v", err)
+	}
+}
@@ -12,16 +12,21 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-// MmapCDB represents a memory-mapped 64-bit CDB database.
+// MmapCDB represents a memory-mapped CDB database in either Format.
 // The returned key and value slices from its methods point directly to the
 // memory-mapped file data and are valid only until the database is closed.
 // Do not modify the contents of the returned slices.
 type MmapCDB struct {
-	data []byte
-	file *os.File
+	data   []byte
+	file   *os.File
+	format Format
+	end    uint64 // end of the records, for RecordAt
 }
 
-// Open opens a 64-bit CDB file at the given path using memory mapping for reads.
+// Open opens a CDB file at the given path using memory mapping for reads.
+// The file is read as a 32-bit database if it is a valid one and not a valid
+// 64-bit one, and as a 64-bit database otherwise. Use Open32 to force the
+// 32-bit layout.
 func Open(path string) (*MmapCDB, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -31,15 +36,22 @@ func Open(path string) (*MmapCDB, error) {
 	return Mmap(f)
 }
 
-// Mmap creates a memory-mapped 64-bit CDB from an open file.
+// Mmap creates a memory-mapped CDB from an open file, detecting its format
+// like Open.
 func Mmap(file *os.File) (*MmapCDB, error) {
+	return mmapFormat(file, Format64, true)
+}
+
+// mmapFormat maps file as a database in the given format, or in the
+// detected one if detect is set.
+func mmapFormat(file *os.File, format Format, detect bool) (*MmapCDB, error) {
 	stat, err := file.Stat()
 	if err != nil {
 		_ = file.Close() // not much we can do here.
 		return nil, fmt.Errorf("file.Stat: %w", err)
 	}
 	size := int(stat.Size())
-	if size < indexSize {
+	if size < indexSize32 {
 		_ = file.Close()
 		return nil, fmt.Errorf("size < indexSize: %w", syscall.EINVAL)
 	}
@@ -50,9 +62,20 @@ func Mmap(file *os.File) (*MmapCDB, error) {
 		return nil, fmt.Errorf("unix.Mmap: %w", err)
 	}
 
+	if detect {
+		format = detectFormat(data)
+	}
+	if size < int(format.layout().indexSize) {
+		_ = unix.Munmap(data)
+		_ = file.Close()
+		return nil, fmt.Errorf("size < indexSize: %w", syscall.EINVAL)
+	}
+
 	cdb := &MmapCDB{
-		data: data,
-		file: file,
+		data:   data,
+		file:   file,
+		format: format,
+		end:    format.layout().dataEnd(data),
 	}
 
 	return cdb, nil
@@ -60,6 +83,9 @@ func Mmap(file *os.File) (*MmapCDB, error) {
 
 // Get returns the value for a given key using memory-mapped access.
 func (cdb *MmapCDB) Get(key []byte) ([]byte, error) {
+	if cdb.format == Format32 {
+		return layout32.get(cdb.data, key), nil
+	}
 	hash := cdbHash(key)
 
 	table := readTableAt(cdb.data, uint8(hash&0xff))
@@ -68,15 +94,16 @@ func (cdb *MmapCDB) Get(key []byte) ([]byte, error) {
 	}
 
 	// Probe the given hash table, starting at the given slot.
-	startingSlot := (uint64(hash) >> 8) % table.length
+	startingSlot := table.startSlot(hash)
 	slot := startingSlot
 
 	for {
 		slotOffset := table.offset + (16 * slot)
 		slotHash, offset := readTupleMmap(cdb.data, slotOffset)
 
-		// An empty slot means the key doesn't exist.
-		if slotHash == 0 {
+		// An empty slot means the key doesn't exist. Offset 0 is the
+		// index, never a record, while a key may hash to 0.
+		if offset == 0 {
 			break
 		} else if slotHash == uint64(hash) {
 			value := getValueAt(cdb.data, offset, key)
@@ -85,7 +112,10 @@ func (cdb *MmapCDB) Get(key []byte) ([]byte, error) {
 			}
 		}
 
-		slot = (slot + 1) % table.length
+		slot++
+		if slot == table.length {
+			slot = 0
+		}
 		if slot == startingSlot {
 			break
 		}
@@ -94,6 +124,25 @@ func (cdb *MmapCDB) Get(key []byte) ([]byte, error) {
 	return nil, nil
 }
 
+// GetAll returns an iterator over the values of all records with the given
+// key, in the order they were written.
+func (cdb *MmapCDB) GetAll(key []byte) iter.Seq[[]byte] {
+	return cdb.format.layout().values(cdb.data, key)
+}
+
+// Stat returns the FileInfo of the open file, which identifies the version of
+// a database that is replaced by renaming a new file over it.
+func (cdb *MmapCDB) Stat() (os.FileInfo, error) {
+	if cdb.file == nil {
+		return nil, fmt.Errorf("file.Stat: %w", os.ErrClosed)
+	}
+	info, err := cdb.file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("file.Stat: %w", err)
+	}
+	return info, nil
+}
+
 // Close unmaps the file and closes the file descriptor.
 func (cdb *MmapCDB) Close() error {
 	var errs []error
@@ -117,27 +166,42 @@ func (cdb *MmapCDB) Close() error {
 	return nil
 }
 
-// InMemoryCDB represents an in-memory 64-bit CDB database.
+// InMemoryCDB represents an in-memory CDB database in either Format.
 // The data slice must remain valid for the lifetime of the InMemoryCDB.
 // The returned key and value slices from its methods point directly to the
 // underlying data and are valid as long as the data slice remains valid.
 // Do not modify the contents of the returned slices.
 type InMemoryCDB struct {
-	data []byte
+	data   []byte
+	format Format
+	end    uint64 // end of the records, for RecordAt
 }
 
-// NewInMemory creates an in-memory 64-bit CDB from a byte slice containing
-// a complete CDB database. The caller must ensure the data slice remains
-// valid for the lifetime of the InMemoryCDB and is not modified.
+// NewInMemory creates an in-memory CDB from a byte slice containing a
+// complete CDB database, detecting its format like Open. The caller must
+// ensure the data slice remains valid for the lifetime of the InMemoryCDB
+// and is not modified.
 func NewInMemory(data []byte) (*InMemoryCDB, error) {
-	if len(data) < indexSize {
+	return newInMemoryFormat(data, Format64, true)
+}
+
+// newInMemoryFormat reads data as a database in the given format, or in the
+// detected one if detect is set.
+func newInMemoryFormat(data []byte, format Format, detect bool) (*InMemoryCDB, error) {
+	if detect {
+		format = detectFormat(data)
+	}
+	if uint64(len(data)) < format.layout().indexSize {
 		return nil, fmt.Errorf("data size < indexSize: %w", syscall.EINVAL)
 	}
-	return &InMemoryCDB{data: data}, nil
+	return &InMemoryCDB{data: data, format: format, end: format.layout().dataEnd(data)}, nil
 }
 
 // Get returns the value for a given key from the in-memory CDB.
 func (cdb *InMemoryCDB) Get(key []byte) ([]byte, error) {
+	if cdb.format == Format32 {
+		return layout32.get(cdb.data, key), nil
+	}
 	hash := cdbHash(key)
 
 	table := readTableAt(cdb.data, uint8(hash&0xff))
@@ -146,15 +210,16 @@ func (cdb *InMemoryCDB) Get(key []byte) ([]byte, error) {
 	}
 
 	// Probe the given hash table, starting at the given slot.
-	startingSlot := (uint64(hash) >> 8) % table.length
+	startingSlot := table.startSlot(hash)
 	slot := startingSlot
 
 	for {
 		slotOffset := table.offset + (16 * slot)
 		slotHash, offset := readTupleMmap(cdb.data, slotOffset)
 
-		// An empty slot means the key doesn't exist.
-		if slotHash == 0 {
+		// An empty slot means the key doesn't exist. Offset 0 is the
+		// index, never a record, while a key may hash to 0.
+		if offset == 0 {
 			break
 		} else if slotHash == uint64(hash) {
 			value := getValueAt(cdb.data, offset, key)
@@ -163,7 +228,10 @@ func (cdb *InMemoryCDB) Get(key []byte) ([]byte, error) {
 			}
 		}
 
-		slot = (slot + 1) % table.length
+		slot++
+		if slot == table.length {
+			slot = 0
+		}
 		if slot == startingSlot {
 			break
 		}
@@ -172,6 +240,12 @@ func (cdb *InMemoryCDB) Get(key []byte) ([]byte, error) {
 	return nil, nil
 }
 
+// GetAll returns an iterator over the values of all records with the given
+// key, in the order they were written.
+func (cdb *InMemoryCDB) GetAll(key []byte) iter.Seq[[]byte] {
+	return cdb.format.layout().values(cdb.data, key)
+}
+
 // Close is a no-op for InMemoryCDB since there are no resources to release.
 // The caller is responsible for managing the lifetime of the underlying data slice.
 func (cdb *InMemoryCDB) Close() error {
@@ -185,26 +259,11 @@ func (cdb *InMemoryCDB) Size() int {
 
 // All returns an iterator over all key-value pairs in the database.
 func (cdb *InMemoryCDB) All() iter.Seq2[[]byte, []byte] {
+	if cdb.format == Format32 {
+		return layout32.records(cdb.data)
+	}
 	return func(yield func([]byte, []byte) bool) {
-		// Find the minimum table offset to determine where data section ends
-		var endPos uint64
-		endPos = uint64(len(cdb.data)) // Start with file size, then find minimum table offset
-
-		for i := 0; i < 256; i++ {
-			table := readTableAt(cdb.data, uint8(i))
-			if table.length > 0 && table.offset < endPos {
-				endPos = table.offset
-			}
-		}
-
-		// If no hash tables exist, data goes to end of file
-		if endPos == uint64(len(cdb.data)) {
-			// For empty database, endPos should be indexSize
-			if endPos == uint64(indexSize) {
-				endPos = uint64(indexSize)
-			}
-		}
-
+		endPos := dataEnd(cdb.data)
 		pos := uint64(indexSize)
 		for pos < endPos {
 			// Ensure we don't read past the end of data
@@ -279,6 +338,19 @@ func readTableAt(data []byte, tableNum uint8) table {
 	}
 }
 
+// dataEnd returns the offset where the data section ends, which is the
+// offset of the first hash table, or the end of the data if there is none.
+func dataEnd(data []byte) uint64 {
+	endPos := uint64(len(data))
+	for i := 0; i < 256; i++ {
+		table := readTableAt(data, uint8(i))
+		if table.length > 0 && table.offset < endPos {
+			endPos = table.offset
+		}
+	}
+	return endPos
+}
+
 // getValueAt retrieves a value at the given offset from the data.
 func getValueAt(data []byte, offset uint64, expectedKey []byte) []byte {
 	if int(offset)+16 > len(data) {
@@ -316,26 +388,11 @@ func (cdb *MmapCDB) Size() int {
 
 // All returns an iterator over all key-value pairs in the database.
 func (cdb *MmapCDB) All() iter.Seq2[[]byte, []byte] {
+	if cdb.format == Format32 {
+		return layout32.records(cdb.data)
+	}
 	return func(yield func([]byte, []byte) bool) {
-		// Find the minimum table offset to determine where data section ends
-		var endPos uint64
-		endPos = uint64(len(cdb.data)) // Start with file size, then find minimum table offset
-
-		for i := 0; i < 256; i++ {
-			table := readTableAt(cdb.data, uint8(i))
-			if table.length > 0 && table.offset < endPos {
-				endPos = table.offset
-			}
-		}
-
-		// If no hash tables exist, data goes to end of file
-		if endPos == uint64(len(cdb.data)) {
-			// For empty database, endPos should be indexSize
-			if endPos == uint64(indexSize) {
-				endPos = uint64(indexSize)
-			}
-		}
-
+		endPos := dataEnd(cdb.data)
 		pos := uint64(indexSize)
 		for pos < endPos {
 			// Ensure we don't read past the end of mapped data
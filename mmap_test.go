@@ -209,6 +209,27 @@ func TestMmapCDB(t *testing.T) {
 	}
 }
 
+func TestGetAll(t *testing.T) {
+	for _, path := range []string{testFile, testFile32} {
+		db, err := cdb.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		var values []string
+		for value := range db.GetAll([]byte("duplicate")) {
+			values = append(values, string(value))
+		}
+		if fmt.Sprint(values) != "[v1 v2]" {
+			t.Errorf("%s: GetAll(duplicate) = %q, want [v1 v2]", path, values)
+		}
+		for range db.GetAll([]byte("not in the table")) {
+			t.Errorf("%s: GetAll of a missing key yielded a value", path)
+		}
+	}
+}
+
 func TestMmapErrorHandling(t *testing.T) {
 	// Test opening non-existent file
 	db, err := cdb.Open("nonexistent.cdb")
@@ -0,0 +1,196 @@
+package cdb
+
+import (
+	"bytes"
+	"errors"
+	"iter"
+)
+
+// TombstonePrefix starts the keys of tombstones, records that hide a key in
+// the lower layers of an Overlay. The tombstone of a key is TombstonePrefix
+// followed by the key, with an empty value, so values are unrestricted, but
+// keys starting with TombstonePrefix are reserved in overlay layers.
+const TombstonePrefix = "\x00cdb:tombstone\x00"
+
+// IsTombstone reports whether key is the key of a tombstone.
+func IsTombstone(key []byte) bool {
+	return bytes.HasPrefix(key, []byte(TombstonePrefix))
+}
+
+// tombstoneKey returns the key of the tombstone of key.
+func tombstoneKey(key []byte) []byte {
+	return append([]byte(TombstonePrefix), key...)
+}
+
+// PutTombstone adds a record that hides key in the lower layers of an
+// Overlay, as if it had been deleted.
+func (cdb *Writer) PutTombstone(key []byte) error {
+	return cdb.Put(tombstoneKey(key), nil)
+}
+
+// Overlay stacks several databases behind the Reader API, so that small
+// delta databases can be shipped on top of a large base and compacted into
+// it only occasionally. Layers are searched newest first: a key's value is
+// the value of its first record in the newest layer that contains the key,
+// and a tombstone hides the key in all older layers, but not in its own.
+type Overlay struct {
+	layers []Reader
+}
+
+var _ Reader = (*Overlay)(nil)
+
+// NewOverlay returns an Overlay over the given layers, newest first. The
+// Overlay takes ownership of the layers and closes them when it is closed.
+func NewOverlay(layers ...Reader) *Overlay {
+	return &Overlay{layers: layers}
+}
+
+// Get returns the value for the given key from the newest layer that
+// contains it, or nil if there is none or it has been deleted.
+func (o *Overlay) Get(key []byte) ([]byte, error) {
+	if IsTombstone(key) {
+		return nil, nil
+	}
+	tombstone := tombstoneKey(key)
+	for _, layer := range o.layers {
+		value, err := layer.Get(key)
+		if err != nil || value != nil {
+			return value, err
+		}
+		value, err = layer.Get(tombstone)
+		if err != nil || value != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// All returns an iterator over the merged view of all layers: every live
+// key exactly once with the value Get returns for it. Keys are yielded layer
+// by layer, newest first, in write order within a layer.
+func (o *Overlay) All() iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		for i, layer := range o.layers {
+			for key, value := range firstRecords(layer) {
+				if IsTombstone(key) || o.inNewer(i, key) {
+					continue
+				}
+				if !yield(key, value) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Keys returns an iterator over all live keys. See All.
+func (o *Overlay) Keys() iter.Seq[[]byte] {
+	return func(yield func([]byte) bool) {
+		for key := range o.All() {
+			if !yield(key) {
+				return
+			}
+		}
+	}
+}
+
+// Values returns an iterator over the values of all live keys. See All.
+func (o *Overlay) Values() iter.Seq[[]byte] {
+	return func(yield func([]byte) bool) {
+		for _, value := range o.All() {
+			if !yield(value) {
+				return
+			}
+		}
+	}
+}
+
+// Size returns the combined size of all layers.
+func (o *Overlay) Size() int {
+	var size int
+	for _, layer := range o.layers {
+		size += layer.Size()
+	}
+	return size
+}
+
+// Close closes all layers.
+func (o *Overlay) Close() error {
+	var errs []error
+	for _, layer := range o.layers {
+		if err := layer.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Compact writes the merged view of all layers to dst, without tombstones,
+// so that it can replace the whole stack. Dst is not finalized.
+func (o *Overlay) Compact(dst *Writer) error {
+	for key, value := range o.All() {
+		if err := dst.Put(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inNewer reports whether key, or its tombstone, is present in a layer
+// newer than layer i.
+func (o *Overlay) inNewer(i int, key []byte) bool {
+	tombstone := tombstoneKey(key)
+	for _, layer := range o.layers[:i] {
+		for _, k := range [][]byte{key, tombstone} {
+			if value, err := layer.Get(k); err == nil && value != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// firstRecords yields the first record of every key in r, skipping later
+// duplicates. Databases available as raw data are checked through their
+// hash tables; other readers need to remember the keys they have seen.
+func firstRecords(r Reader) iter.Seq2[[]byte, []byte] {
+	data, ok := rawDataOf(r)
+	if !ok {
+		return func(yield func([]byte, []byte) bool) {
+			seen := make(map[string]struct{})
+			for key, value := range r.All() {
+				if _, dup := seen[string(key)]; dup {
+					continue
+				}
+				seen[string(key)] = struct{}{}
+				if !yield(key, value) {
+					return
+				}
+			}
+		}
+	}
+
+	return func(yield func([]byte, []byte) bool) {
+		endPos := dataEnd(data)
+		pos := uint64(indexSize)
+		for pos < endPos {
+			keyLength, valueLength := readTupleMmap(data, pos)
+			keyEnd := pos + 16 + keyLength
+			recordEnd := keyEnd + valueLength
+			if pos+16 > endPos || keyEnd < pos || recordEnd < keyEnd || recordEnd > endPos {
+				return
+			}
+			key := data[pos+16 : keyEnd]
+
+			first := true
+			forEachValue(data, cdbHash(key), key, func(offset uint64, _ []byte) bool {
+				first = offset == pos
+				return false
+			})
+			if first && !yield(key, data[keyEnd:recordEnd]) {
+				return
+			}
+			pos = recordEnd
+		}
+	}
+}
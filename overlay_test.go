@@ -0,0 +1,114 @@
+package cdb_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/perbu/cdb"
+)
+
+func buildDelta(t *testing.T, deleted []string, records ...string) *cdb.InMemoryCDB {
+	t.Helper()
+	builder := cdb.NewBuilder()
+	for _, key := range deleted {
+		if err := builder.PutTombstone([]byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < len(records); i += 2 {
+		if err := builder.Put([]byte(records[i]), []byte(records[i+1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db, err := builder.InMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestOverlay(t *testing.T) {
+	base := buildInMemory(t, "a", "base-a", "b", "base-b", "c", "base-c", "dup", "base-1", "dup", "base-2")
+	monday := buildDelta(t, []string{"b"}, "c", "mon-c", "d", "mon-d")
+	tuesday := buildDelta(t, []string{"d"}, "b", "tue-b", "e", "tue-e", "e", "tue-e2")
+
+	for _, layers := range [][]cdb.Reader{
+		{tuesday, monday, base},
+		{iterOnly{tuesday}, iterOnly{monday}, iterOnly{base}},
+	} {
+		overlay := cdb.NewOverlay(layers...)
+
+		expected := map[string]string{
+			"a":   "base-a",
+			"b":   "tue-b", // deleted on monday, re-added on tuesday
+			"c":   "mon-c",
+			"d":   "", // added on monday, deleted on tuesday
+			"e":   "tue-e",
+			"dup": "base-1",
+		}
+		for key, value := range expected {
+			got, err := overlay.Get([]byte(key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value == "" {
+				if got != nil {
+					t.Errorf("%s: expected deleted key, got %q", key, got)
+				}
+				continue
+			}
+			if string(got) != value {
+				t.Errorf("%s: expected %q, got %q", key, value, got)
+			}
+		}
+
+		got := collectPairs(overlay.All())
+		want := []string{"b=tue-b", "e=tue-e", "c=mon-c", "a=base-a", "dup=base-1"}
+		if !slices.Equal(got, want) {
+			t.Errorf("expected merged view %v, got %v", want, got)
+		}
+	}
+}
+
+func TestOverlayCompact(t *testing.T) {
+	base := buildInMemory(t, "a", "1", "b", "2")
+	delta := buildDelta(t, []string{"a"}, "c", "3")
+
+	builder := cdb.NewBuilder()
+	if err := cdb.NewOverlay(delta, base).Compact(builder.Writer); err != nil {
+		t.Fatal(err)
+	}
+	db, err := builder.InMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := collectPairs(db.All()), []string{"c=3", "b=2"}; !slices.Equal(got, want) {
+		t.Errorf("expected compacted records %v, got %v", want, got)
+	}
+	for key := range db.Keys() {
+		if cdb.IsTombstone(key) {
+			t.Error("compacted database contains a tombstone")
+		}
+	}
+}
+
+func TestOverlayAnyValue(t *testing.T) {
+	// Tombstones are keys, so any value can be stored, including the
+	// former in-band tombstone value.
+	value := "\x00cdb:tombstone\x00\xff"
+	base := buildInMemory(t, "a", "base")
+	delta := buildDelta(t, []string{"b"}, "a", value, "c", "")
+	overlay := cdb.NewOverlay(delta, base)
+	if got, err := overlay.Get([]byte("a")); err != nil || string(got) != value {
+		t.Errorf("Get(a) = %q, %v, want %q", got, err, value)
+	}
+	if got, err := overlay.Get([]byte("c")); err != nil || got == nil || len(got) != 0 {
+		t.Errorf("Get(c) = %q, %v, want an empty value", got, err)
+	}
+	if got, err := overlay.Get([]byte(cdb.TombstonePrefix + "b")); err != nil || got != nil {
+		t.Errorf("Get of a tombstone key = %q, %v, want nil", got, err)
+	}
+	if got, want := collectPairs(overlay.All()), []string{"a=" + value, "c="}; !slices.Equal(got, want) {
+		t.Errorf("All = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,286 @@
+package cdb
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// ErrPatchMismatch is returned by ApplyPatch when the patch was made for a
+// different old database, or when the result does not match the digest
+// recorded in the patch.
+var ErrPatchMismatch = errors.New("CDB patch does not match")
+
+// patchMagic starts every patch, followed by the format version.
+const (
+	patchMagic   = "cdbpatch"
+	patchVersion = 1
+)
+
+// Patch operations.
+const (
+	opCopy   = 'C' // offset, length: copy a run of records from old
+	opInsert = 'I' // klen, vlen, key, value: add a new record
+	opEnd    = 'E' // records, digest: end of patch
+)
+
+// MakePatch writes to w a patch that turns old into new at the record level.
+// Runs of records that new shares with old, in the same order, are encoded
+// as references into old; all other records are stored literally. The patch
+// records a SHA-256 digest of the data section of both databases, so that
+// ApplyPatch can check it is applied to the right database and that it
+// reproduces new exactly.
+//
+// Old must be a 64-bit MmapCDB or InMemoryCDB. New can be any Reader; its
+// records are taken in the order All yields them. Patches are not compressed.
+func MakePatch(old, new Reader, w io.Writer) error {
+	oldData, ok := rawDataOf(old)
+	if !ok {
+		return fmt.Errorf("MakePatch: old database must be a 64-bit MmapCDB or InMemoryCDB")
+	}
+	oldDigest := sha256.Sum256(oldData[indexSize:dataEnd(oldData)])
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString(patchMagic)
+	writeUvarint(bw, patchVersion)
+	bw.Write(oldDigest[:])
+
+	var (
+		runStart, runEnd uint64
+		records          uint64
+		digest           = sha256.New()
+	)
+	flush := func() {
+		if runEnd > runStart {
+			bw.WriteByte(opCopy)
+			writeUvarint(bw, runStart)
+			writeUvarint(bw, runEnd-runStart)
+		}
+		runStart, runEnd = 0, 0
+	}
+
+	for key, value := range new.All() {
+		records++
+		writeRecord(digest, key, value)
+
+		offset, found := findRecord(oldData, key, value, runEnd)
+		if !found {
+			flush()
+			bw.WriteByte(opInsert)
+			writeUvarint(bw, uint64(len(key)))
+			writeUvarint(bw, uint64(len(value)))
+			bw.Write(key)
+			bw.Write(value)
+			continue
+		}
+		if offset != runEnd {
+			flush()
+			runStart = offset
+		}
+		runEnd = offset + 16 + uint64(len(key)) + uint64(len(value))
+	}
+	flush()
+
+	bw.WriteByte(opEnd)
+	writeUvarint(bw, records)
+	bw.Write(digest.Sum(nil))
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("write patch: %w", err)
+	}
+	return nil
+}
+
+// ApplyPatch adds the records of the database described by patch to dst,
+// copying the records it shares with old as raw byte ranges. Old must be the
+// database the patch was made from, as a 64-bit MmapCDB or InMemoryCDB.
+// Errors wrap ErrPatchMismatch if old is the wrong database or the result
+// does not match the digest in the patch; since that can only be known at
+// the end, dst should be aborted on any error. Dst is not finalized.
+func ApplyPatch(old Reader, patch io.Reader, dst *Writer) error {
+	oldData, ok := rawDataOf(old)
+	if !ok {
+		return fmt.Errorf("ApplyPatch: old database must be a 64-bit MmapCDB or InMemoryCDB")
+	}
+	oldEnd := dataEnd(oldData)
+
+	br := bufio.NewReader(patch)
+	var header [len(patchMagic)]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return patchError(err)
+	}
+	if string(header[:]) != patchMagic {
+		return fmt.Errorf("read patch: bad magic %q", header[:])
+	}
+	version, err := binary.ReadUvarint(br)
+	if err != nil {
+		return patchError(err)
+	}
+	if version != patchVersion {
+		return fmt.Errorf("read patch: unsupported version %d", version)
+	}
+
+	var oldDigest [sha256.Size]byte
+	if _, err := io.ReadFull(br, oldDigest[:]); err != nil {
+		return patchError(err)
+	}
+	if sha256.Sum256(oldData[indexSize:oldEnd]) != oldDigest {
+		return fmt.Errorf("%w: patch was made for a different old database", ErrPatchMismatch)
+	}
+
+	var (
+		records uint64
+		digest  = sha256.New()
+		buf     bytes.Buffer
+	)
+	for {
+		op, err := br.ReadByte()
+		if err != nil {
+			return patchError(err)
+		}
+
+		switch op {
+		case opCopy:
+			offset, err := binary.ReadUvarint(br)
+			if err != nil {
+				return patchError(err)
+			}
+			length, err := binary.ReadUvarint(br)
+			if err != nil {
+				return patchError(err)
+			}
+			if offset < indexSize || offset > oldEnd || length > oldEnd-offset {
+				return fmt.Errorf("read patch: copy of %d bytes at offset %d is outside the old data section", length, offset)
+			}
+			n, err := copyRecords(dst, oldData[offset:offset+length])
+			if err != nil {
+				return err
+			}
+			digest.Write(oldData[offset : offset+length])
+			records += n
+
+		case opInsert:
+			keyLength, err := binary.ReadUvarint(br)
+			if err != nil {
+				return patchError(err)
+			}
+			valueLength, err := binary.ReadUvarint(br)
+			if err != nil {
+				return patchError(err)
+			}
+			if keyLength > uint64(maxInt) || valueLength > uint64(maxInt)-keyLength {
+				return fmt.Errorf("read patch: record of %d+%d bytes is too large", keyLength, valueLength)
+			}
+			buf.Reset()
+			if _, err := io.CopyN(&buf, br, int64(keyLength+valueLength)); err != nil {
+				return patchError(err)
+			}
+			key, value := buf.Bytes()[:keyLength], buf.Bytes()[keyLength:]
+			if err := dst.Put(key, value); err != nil {
+				return err
+			}
+			writeRecord(digest, key, value)
+			records++
+
+		case opEnd:
+			want, err := binary.ReadUvarint(br)
+			if err != nil {
+				return patchError(err)
+			}
+			var wantDigest [sha256.Size]byte
+			if _, err := io.ReadFull(br, wantDigest[:]); err != nil {
+				return patchError(err)
+			}
+			if records != want || !bytes.Equal(digest.Sum(nil), wantDigest[:]) {
+				return fmt.Errorf("%w: result differs from the new database", ErrPatchMismatch)
+			}
+			return nil
+
+		default:
+			return fmt.Errorf("read patch: unknown operation %q", op)
+		}
+	}
+}
+
+// maxInt is the largest record size ApplyPatch accepts.
+const maxInt = int(^uint(0) >> 1)
+
+// copyRecords appends the records in data to dst without re-encoding them,
+// returning how many there were.
+func copyRecords(dst *Writer, data []byte) (uint64, error) {
+	var (
+		records  uint64
+		runStart uint64
+		entries  []entry
+	)
+	end := uint64(len(data))
+	pos := uint64(0)
+	for pos < end {
+		keyLength, valueLength := readTupleMmap(data, pos)
+		keyEnd := pos + 16 + keyLength
+		recordEnd := keyEnd + valueLength
+		if pos+16 > end || keyEnd < pos || recordEnd < keyEnd || recordEnd > end {
+			return records, fmt.Errorf("read patch: copied range does not end on a record boundary")
+		}
+		entries = append(entries, entry{hash: cdbHash(data[pos+16 : keyEnd]), offset: pos - runStart})
+		records++
+		pos = recordEnd
+
+		if len(entries) >= mergeBatchEntries || pos == end {
+			if err := dst.putRaw(data[runStart:pos], entries); err != nil {
+				return records, err
+			}
+			entries = entries[:0]
+			runStart = pos
+		}
+	}
+	return records, nil
+}
+
+// findRecord returns the offset of a record of key with the given value in
+// data, preferring the one at offset prefer to extend a run of copies.
+func findRecord(data, key, value []byte, prefer uint64) (uint64, bool) {
+	var (
+		offset uint64
+		found  bool
+	)
+	forEachValue(data, cdbHash(key), key, func(o uint64, v []byte) bool {
+		if !bytes.Equal(v, value) {
+			return true
+		}
+		if !found || o == prefer {
+			offset, found = o, true
+		}
+		return o != prefer
+	})
+	return offset, found
+}
+
+// writeRecord writes the encoding of a record, as found in the data section,
+// to h.
+func writeRecord(h hash.Hash, key, value []byte) {
+	var header [16]byte
+	binary.LittleEndian.PutUint64(header[:8], uint64(len(key)))
+	binary.LittleEndian.PutUint64(header[8:], uint64(len(value)))
+	h.Write(header[:])
+	h.Write(key)
+	h.Write(value)
+}
+
+func writeUvarint(w *bufio.Writer, x uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	w.Write(buf[:binary.PutUvarint(buf[:], x)])
+}
+
+// patchError reports a read error, treating a premature end of the patch as
+// io.ErrUnexpectedEOF.
+func patchError(err error) error {
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("read patch: %w", err)
+}
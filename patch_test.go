@@ -0,0 +1,117 @@
+package cdb_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/perbu/cdb"
+)
+
+func buildVersions(t *testing.T) (old, new []byte) {
+	t.Helper()
+	oldBuilder, newBuilder := cdb.NewBuilder(), cdb.NewBuilder()
+	for i := 0; i < 2000; i++ {
+		key := []byte(fmt.Sprintf("key-%04d", i))
+		value := bytes.Repeat([]byte{byte(i)}, 64)
+		if err := oldBuilder.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case i%100 == 7: // removed
+		case i%100 == 42: // changed
+			value = []byte("changed")
+			fallthrough
+		default:
+			if err := newBuilder.Put(key, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if i%500 == 0 {
+			if err := newBuilder.Put([]byte(fmt.Sprintf("added-%04d", i)), []byte("new")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Duplicates of old records are copied too.
+	if err := newBuilder.Put([]byte("key-0001"), bytes.Repeat([]byte{1}, 64)); err != nil {
+		t.Fatal(err)
+	}
+
+	old, err := oldBuilder.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	new, err = newBuilder.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return old, new
+}
+
+func TestPatch(t *testing.T) {
+	oldData, newData := buildVersions(t)
+	old, err := cdb.NewInMemory(oldData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	new, err := cdb.NewInMemory(newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var patch bytes.Buffer
+	if err := cdb.MakePatch(old, new, &patch); err != nil {
+		t.Fatal(err)
+	}
+	if patch.Len() > len(newData)/10 {
+		t.Errorf("patch is %d bytes for a %d byte database", patch.Len(), len(newData))
+	}
+
+	builder := cdb.NewBuilder()
+	if err := cdb.ApplyPatch(old, bytes.NewReader(patch.Bytes()), builder.Writer); err != nil {
+		t.Fatal(err)
+	}
+	got, err := builder.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, newData) {
+		t.Error("patched database differs from the new database")
+	}
+
+	// Generic readers are accepted as the new database.
+	var generic bytes.Buffer
+	if err := cdb.MakePatch(old, iterOnly{new}, &generic); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(generic.Bytes(), patch.Bytes()) {
+		t.Error("patch from a generic reader differs")
+	}
+
+	t.Run("wrong old database", func(t *testing.T) {
+		err := cdb.ApplyPatch(new, bytes.NewReader(patch.Bytes()), cdb.NewBuilder().Writer)
+		if !errors.Is(err, cdb.ErrPatchMismatch) {
+			t.Errorf("ApplyPatch = %v, want ErrPatchMismatch", err)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		truncated := patch.Bytes()[:patch.Len()-10]
+		err := cdb.ApplyPatch(old, bytes.NewReader(truncated), cdb.NewBuilder().Writer)
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("ApplyPatch = %v, want io.ErrUnexpectedEOF", err)
+		}
+	})
+
+	t.Run("corrupted digest", func(t *testing.T) {
+		corrupted := bytes.Clone(patch.Bytes())
+		corrupted[len(corrupted)-1] ^= 0xff
+		err := cdb.ApplyPatch(old, bytes.NewReader(corrupted), cdb.NewBuilder().Writer)
+		if !errors.Is(err, cdb.ErrPatchMismatch) {
+			t.Errorf("ApplyPatch = %v, want ErrPatchMismatch", err)
+		}
+	})
+}
@@ -0,0 +1,51 @@
+package cdb
+
+import "fmt"
+
+// progressInterval is the number of records between two progress reports
+// and context checks in long-running operations.
+const progressInterval = 1 << 16
+
+// Phase identifies the stage of a long-running operation.
+type Phase int
+
+const (
+	// PhaseRecords is reported while records are written or scanned.
+	PhaseRecords Phase = iota
+	// PhaseTables is reported while hash tables are built or checked.
+	PhaseTables
+	// PhaseIndex is reported when the index is written.
+	PhaseIndex
+	// PhaseDone is reported once when the operation has completed.
+	PhaseDone
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseRecords:
+		return "records"
+	case PhaseTables:
+		return "tables"
+	case PhaseIndex:
+		return "index"
+	case PhaseDone:
+		return "done"
+	}
+	return fmt.Sprintf("Phase(%d)", int(p))
+}
+
+// Progress is a snapshot of a long-running operation such as building a
+// database with Writer, Verify or a scan. Progress callbacks are never
+// called concurrently.
+type Progress struct {
+	Phase Phase
+	// Records is the number of records written or scanned so far.
+	Records uint64
+	// Bytes is the number of bytes written or scanned so far.
+	Bytes uint64
+	// TotalBytes is the size of the database if known, or zero while it is
+	// still being written.
+	TotalBytes uint64
+	// Tables is the number of the 256 hash tables completed so far.
+	Tables int
+}
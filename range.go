@@ -0,0 +1,24 @@
+package cdb
+
+import (
+	"bytes"
+	"iter"
+)
+
+// Range returns an iterator over the records of r whose keys k satisfy
+// begin <= k < end in byte order, in write order. A nil end has no upper
+// bound. A CDB has no ordered index, so Range reads every record; it is
+// meant for keys whose encoding preserves the order of what they encode,
+// such as those of IntCodec or of the cdbkey package.
+func Range(r Reader, begin, end []byte) iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		for key, value := range r.All() {
+			if bytes.Compare(key, begin) < 0 || end != nil && bytes.Compare(key, end) >= 0 {
+				continue
+			}
+			if !yield(key, value) {
+				return
+			}
+		}
+	}
+}
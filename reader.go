@@ -0,0 +1,25 @@
+package cdb
+
+import "iter"
+
+// Reader is the read API shared by MmapCDB and InMemoryCDB.
+type Reader interface {
+	// Get returns the value for the first record with the given key, or nil
+	// if there is none.
+	Get(key []byte) ([]byte, error)
+	// All returns an iterator over all key-value pairs in write order.
+	All() iter.Seq2[[]byte, []byte]
+	// Keys returns an iterator over all keys in write order.
+	Keys() iter.Seq[[]byte]
+	// Values returns an iterator over all values in write order.
+	Values() iter.Seq[[]byte]
+	// Size returns the size of the database in bytes.
+	Size() int
+	// Close releases the resources held by the reader.
+	Close() error
+}
+
+var (
+	_ Reader = (*MmapCDB)(nil)
+	_ Reader = (*InMemoryCDB)(nil)
+)
@@ -0,0 +1,178 @@
+package cdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrReloaderClosed is returned by Acquire and Reload after Close.
+var ErrReloaderClosed = errors.New("CDB reloader is closed")
+
+// Reloader holds a memory-mapped database at a path that is replaced while it
+// is being read, typically by a new version written with CreateAtomic.
+//
+// Readers Acquire the current database and release it when they are done
+// with the slices it returned. A database that has been reloaded is closed
+// once its last reader has released it, so a long-running server can reload
+// any number of times without keeping old mappings around.
+type Reloader struct {
+	path string
+
+	mu      sync.Mutex
+	current *reloadRef
+}
+
+// reloadRef counts the users of one database: the Reloader or Store while it
+// is current, plus every reader that has acquired it.
+type reloadRef struct {
+	db   *MmapCDB
+	info os.FileInfo
+	refs atomic.Int64
+}
+
+func (ref *reloadRef) release() {
+	if ref.refs.Add(-1) == 0 {
+		_ = ref.db.Close()
+	}
+}
+
+// OpenReloader opens the database at path for reloading.
+func OpenReloader(path string) (*Reloader, error) {
+	ref, err := openRef(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Reloader{path: path, current: ref}, nil
+}
+
+func openRef(path string) (*reloadRef, error) {
+	db, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := db.Stat()
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	ref := &reloadRef{db: db, info: info}
+	ref.refs.Store(1)
+	return ref, nil
+}
+
+// Path returns the path the database is reloaded from.
+func (r *Reloader) Path() string {
+	return r.path
+}
+
+// Acquire returns the current database and a function that releases it.
+// Slices returned by the database stay valid until release is called, even
+// if the database is reloaded in the meantime. Release must be called
+// exactly once.
+func (r *Reloader) Acquire() (*MmapCDB, func(), error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.current == nil {
+		return nil, nil, ErrReloaderClosed
+	}
+	ref := r.current
+	ref.refs.Add(1)
+	var once sync.Once
+	return ref.db, func() { once.Do(ref.release) }, nil
+}
+
+// Reload reopens the database at the path and makes it the current one. On
+// failure, the current database is kept.
+func (r *Reloader) Reload() error {
+	ref, err := openRef(r.path)
+	if err != nil {
+		return err
+	}
+	r.swap(ref)
+	return nil
+}
+
+// ReloadIfChanged reloads the database if the file at the path is no longer
+// the one that is open, or has a different size or modification time. It
+// reports whether it reloaded.
+func (r *Reloader) ReloadIfChanged() (bool, error) {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return false, fmt.Errorf("os.Stat(%q): %w", r.path, err)
+	}
+
+	r.mu.Lock()
+	current := r.current
+	r.mu.Unlock()
+	if current == nil {
+		return false, ErrReloaderClosed
+	}
+	if os.SameFile(info, current.info) && info.Size() == current.info.Size() && info.ModTime().Equal(current.info.ModTime()) {
+		return false, nil
+	}
+
+	if err := r.Reload(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Watch calls ReloadIfChanged every interval until ctx is done. Errors, for
+// instance while the file is briefly missing, are passed to onError if it is
+// not nil, and the current database is kept.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := r.ReloadIfChanged(); err != nil {
+			if errors.Is(err, ErrReloaderClosed) {
+				return
+			}
+			if onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// swap makes ref the current database and releases the previous one. If the
+// Reloader has been closed, ref is released instead.
+func (r *Reloader) swap(ref *reloadRef) {
+	r.mu.Lock()
+	old := r.current
+	if old != nil {
+		r.current = ref
+	}
+	r.mu.Unlock()
+
+	if old == nil {
+		ref.release()
+		return
+	}
+	old.release()
+}
+
+// Close releases the current database, which is closed once all readers
+// have released it.
+func (r *Reloader) Close() error {
+	r.mu.Lock()
+	ref := r.current
+	r.current = nil
+	r.mu.Unlock()
+
+	if ref == nil {
+		return ErrReloaderClosed
+	}
+	ref.release()
+	return nil
+}
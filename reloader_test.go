@@ -0,0 +1,74 @@
+package cdb_test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/perbu/cdb"
+)
+
+// writeVersion atomically replaces the database at path with one record.
+func writeVersion(t *testing.T, path, version string) {
+	t.Helper()
+	w, err := cdb.CreateAtomic(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Put([]byte("version"), []byte(version)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.cdb")
+	writeVersion(t, path, "1")
+
+	r, err := cdb.OpenReloader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, release, err := r.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldValue, _ := old.Get([]byte("version"))
+
+	if changed, err := r.ReloadIfChanged(); err != nil || changed {
+		t.Errorf("ReloadIfChanged of an unchanged file = %v, %v", changed, err)
+	}
+	writeVersion(t, path, "2")
+	if changed, err := r.ReloadIfChanged(); err != nil || !changed {
+		t.Errorf("ReloadIfChanged of a replaced file = %v, %v", changed, err)
+	}
+
+	db, releaseNew, err := r.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := db.Get([]byte("version")); string(value) != "2" {
+		t.Errorf("version after reload = %q, want 2", value)
+	}
+	// The old database stays mapped until it has been released.
+	if string(oldValue) != "1" {
+		t.Errorf("version before reload = %q, want 1", oldValue)
+	}
+	release()
+	if _, err := old.Stat(); err == nil {
+		t.Error("released database is still open")
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.Acquire(); !errors.Is(err, cdb.ErrReloaderClosed) {
+		t.Errorf("Acquire after Close = %v, want ErrReloaderClosed", err)
+	}
+	if value, _ := db.Get([]byte("version")); string(value) != "2" {
+		t.Errorf("acquired database closed by Close, got %q", value)
+	}
+	releaseNew()
+}
@@ -0,0 +1,316 @@
+package cdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"iter"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// manifestVersion is the version of the sharded manifest format.
+const manifestVersion = 1
+
+// shardHashName identifies the hash ShardOf uses in manifests.
+const shardHashName = "fnv1a64-fmix64"
+
+// Manifest describes a database split into several CDB files by ShardOf.
+// Shard paths are relative to the directory of the manifest.
+type Manifest struct {
+	Version int      `json:"version"`
+	Hash    string   `json:"hash"`
+	Shards  []string `json:"shards"`
+}
+
+// ShardOf returns the shard, in [0, shards), that holds key. It is derived
+// from the 64-bit FNV-1a hash of the key passed through the MurmurHash3
+// finalizer. FNV-1a alone correlates with the low byte of cdbHash that
+// selects a table, which would leave most tables in each shard empty.
+func ShardOf(key []byte, shards int) int {
+	h := fnv.New64a()
+	_, _ = h.Write(key)
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return int(x % uint64(shards))
+}
+
+// ShardPath returns the path of shard i of n for the manifest at
+// manifestPath, as used by CreateSharded.
+func ShardPath(manifestPath string, i, n int) string {
+	base := strings.TrimSuffix(manifestPath, filepath.Ext(manifestPath))
+	return fmt.Sprintf("%s-%05d-of-%05d.cdb", base, i, n)
+}
+
+// ReadManifest reads and validates the manifest at path.
+func ReadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile(%q): %w", path, err)
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal(%q): %w", path, err)
+	}
+	if m.Version != manifestVersion {
+		return nil, fmt.Errorf("manifest %q: unsupported version %d", path, m.Version)
+	}
+	if m.Hash != shardHashName {
+		return nil, fmt.Errorf("manifest %q: unsupported hash %q", path, m.Hash)
+	}
+	if len(m.Shards) == 0 {
+		return nil, fmt.Errorf("manifest %q: no shards", path)
+	}
+	return &m, nil
+}
+
+// WriteManifest atomically writes a manifest for the given shard paths,
+// which must be relative to the directory of path.
+func WriteManifest(path string, shards []string) error {
+	data, err := json.MarshalIndent(Manifest{
+		Version: manifestVersion,
+		Hash:    shardHashName,
+		Shards:  shards,
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("os.CreateTemp(%q): %w", dir, err)
+	}
+	defer os.Remove(f.Name()) // fails harmlessly once renamed
+
+	_, err = f.Write(append(data, '\n'))
+	if err == nil {
+		err = f.Chmod(0o644)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("write manifest %q: %w", path, err)
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("os.Rename(%q, %q): %w", f.Name(), path, err)
+	}
+	return syncDir(dir)
+}
+
+// ShardedWriter builds a database split into several CDB files, routing
+// each record to the shard chosen by ShardOf. Each shard is written with
+// CreateAtomic, the shards replace the previous ones only once all of them
+// are complete, and the manifest is written last.
+//
+// A single shard can also be rebuilt on its own: write the records whose
+// ShardOf is i to ShardPath(manifestPath, i, n) and call ReloadShard on open
+// ShardedReaders.
+type ShardedWriter struct {
+	path    string
+	writers []*Writer
+}
+
+// CreateSharded creates a sharded database with the given number of shards,
+// described by the manifest at manifestPath.
+func CreateSharded(manifestPath string, shards int) (*ShardedWriter, error) {
+	if shards <= 0 {
+		return nil, fmt.Errorf("invalid shard count %d", shards)
+	}
+
+	sw := &ShardedWriter{path: manifestPath}
+	for i := 0; i < shards; i++ {
+		w, err := CreateAtomic(ShardPath(manifestPath, i, shards))
+		if err != nil {
+			_ = sw.Abort()
+			return nil, err
+		}
+		sw.writers = append(sw.writers, w)
+	}
+	return sw, nil
+}
+
+// Shard returns the Writer for shard i, for example to configure it.
+func (sw *ShardedWriter) Shard(i int) *Writer {
+	return sw.writers[i]
+}
+
+// Put adds a key/value pair to the shard that holds key.
+func (sw *ShardedWriter) Put(key, value []byte) error {
+	return sw.writers[ShardOf(key, len(sw.writers))].Put(key, value)
+}
+
+// Close finalizes all shards and writes the manifest. Every shard is built
+// and synced under its temporary name before any of them is renamed over
+// the previous generation, so a shard that fails to build leaves the whole
+// previous generation in place and the others are discarded.
+func (sw *ShardedWriter) Close() error {
+	for i, w := range sw.writers {
+		if err := w.prepare(); err != nil {
+			_ = sw.Abort()
+			return fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+
+	shards := make([]string, len(sw.writers))
+	for i, w := range sw.writers {
+		if err := w.Close(); err != nil {
+			_ = sw.Abort()
+			return fmt.Errorf("shard %d: %w", i, err)
+		}
+		shards[i] = filepath.Base(ShardPath(sw.path, i, len(sw.writers)))
+	}
+	return WriteManifest(sw.path, shards)
+}
+
+// Abort discards all shards that have not been closed yet.
+func (sw *ShardedWriter) Abort() error {
+	var errs []error
+	for _, w := range sw.writers {
+		if err := w.Abort(); err != nil && !errors.Is(err, ErrWriterClosed) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ShardedReader reads a database written by ShardedWriter, dispatching each
+// lookup to the shard that holds the key.
+type ShardedReader struct {
+	dir      string
+	manifest *Manifest
+
+	mu      sync.RWMutex
+	shards  []*MmapCDB
+	retired []*MmapCDB
+}
+
+var _ Reader = (*ShardedReader)(nil)
+
+// OpenSharded opens the sharded database described by the manifest at
+// manifestPath.
+func OpenSharded(manifestPath string) (*ShardedReader, error) {
+	m, err := ReadManifest(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+
+	sr := &ShardedReader{dir: filepath.Dir(manifestPath), manifest: m}
+	for _, name := range m.Shards {
+		db, err := Open(filepath.Join(sr.dir, name))
+		if err != nil {
+			_ = sr.Close()
+			return nil, err
+		}
+		sr.shards = append(sr.shards, db)
+	}
+	return sr, nil
+}
+
+// Shards returns the number of shards.
+func (sr *ShardedReader) Shards() int {
+	return len(sr.manifest.Shards)
+}
+
+// ReloadShard reopens shard i after it has been rebuilt. Slices returned by
+// the previous shard stay valid until the ShardedReader is closed.
+func (sr *ShardedReader) ReloadShard(i int) error {
+	if i < 0 || i >= len(sr.manifest.Shards) {
+		return fmt.Errorf("shard %d out of range [0, %d)", i, len(sr.manifest.Shards))
+	}
+
+	db, err := Open(filepath.Join(sr.dir, sr.manifest.Shards[i]))
+	if err != nil {
+		return err
+	}
+
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.retired = append(sr.retired, sr.shards[i])
+	sr.shards[i] = db
+	return nil
+}
+
+// Get returns the value for the given key from the shard that holds it.
+func (sr *ShardedReader) Get(key []byte) ([]byte, error) {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+	return sr.shards[ShardOf(key, len(sr.shards))].Get(key)
+}
+
+// All returns an iterator over all key-value pairs, shard by shard.
+func (sr *ShardedReader) All() iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		sr.mu.RLock()
+		shards := append([]*MmapCDB(nil), sr.shards...)
+		sr.mu.RUnlock()
+
+		for _, db := range shards {
+			for key, value := range db.All() {
+				if !yield(key, value) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Keys returns an iterator over all keys, shard by shard.
+func (sr *ShardedReader) Keys() iter.Seq[[]byte] {
+	return func(yield func([]byte) bool) {
+		for key := range sr.All() {
+			if !yield(key) {
+				return
+			}
+		}
+	}
+}
+
+// Values returns an iterator over all values, shard by shard.
+func (sr *ShardedReader) Values() iter.Seq[[]byte] {
+	return func(yield func([]byte) bool) {
+		for _, value := range sr.All() {
+			if !yield(value) {
+				return
+			}
+		}
+	}
+}
+
+// Size returns the combined size of all shards.
+func (sr *ShardedReader) Size() int {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+	var size int
+	for _, db := range sr.shards {
+		size += db.Size()
+	}
+	return size
+}
+
+// Close closes all shards.
+func (sr *ShardedReader) Close() error {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	var errs []error
+	for _, db := range append(sr.shards, sr.retired...) {
+		if err := db.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	sr.shards, sr.retired = nil, nil
+	return errors.Join(errs...)
+}
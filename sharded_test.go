@@ -0,0 +1,171 @@
+package cdb_test
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/perbu/cdb"
+)
+
+func TestSharded(t *testing.T) {
+	dir := t.TempDir()
+	manifest := filepath.Join(dir, "db.manifest")
+
+	sw, err := cdb.CreateSharded(manifest, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		n := strconv.Itoa(i)
+		if err := sw.Put([]byte("key"+n), []byte("value"+n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sr, err := cdb.OpenSharded(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Close()
+	if sr.Shards() != 4 {
+		t.Errorf("expected 4 shards, got %d", sr.Shards())
+	}
+
+	for i := 0; i < 1000; i++ {
+		n := strconv.Itoa(i)
+		value, err := sr.Get([]byte("key" + n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != "value"+n {
+			t.Fatalf("key%s: expected %q, got %q", n, "value"+n, value)
+		}
+	}
+
+	var count int
+	for range sr.All() {
+		count++
+	}
+	if count != 1000 {
+		t.Errorf("expected 1000 records, got %d", count)
+	}
+
+	// Every shard holds only its own keys, spread over several tables.
+	for i := 0; i < 4; i++ {
+		db, err := cdb.Open(cdb.ShardPath(manifest, i, 4))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key := range db.Keys() {
+			if cdb.ShardOf(key, 4) != i {
+				t.Errorf("key %q in shard %d belongs to shard %d", key, i, cdb.ShardOf(key, 4))
+			}
+		}
+		if stats := db.Stats(); stats.Records < 150 || stats.Tables < 100 {
+			t.Errorf("shard %d is unbalanced: %+v", i, stats)
+		}
+		db.Close()
+	}
+}
+
+func TestShardedRebuildShard(t *testing.T) {
+	dir := t.TempDir()
+	manifest := filepath.Join(dir, "db.manifest")
+
+	sw, err := cdb.CreateSharded(manifest, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.Put([]byte("key"), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sr, err := cdb.OpenSharded(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Close()
+
+	// Rebuild only the shard holding the key.
+	shard := cdb.ShardOf([]byte("key"), 3)
+	w, err := cdb.CreateAtomic(cdb.ShardPath(manifest, shard, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Put([]byte("key"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	old, _ := sr.Get([]byte("key"))
+	if err := sr.ReloadShard(shard); err != nil {
+		t.Fatal(err)
+	}
+	value, _ := sr.Get([]byte("key"))
+	if string(value) != "new" {
+		t.Errorf("expected reloaded value %q, got %q", "new", value)
+	}
+	if string(old) != "old" {
+		t.Errorf("value from before the reload changed to %q", old)
+	}
+}
+
+func TestShardedMissingManifest(t *testing.T) {
+	if _, err := cdb.OpenSharded(filepath.Join(t.TempDir(), "missing.manifest")); err == nil {
+		t.Error("expected error for missing manifest")
+	}
+}
+
+func TestShardedFailedCloseKeepsGeneration(t *testing.T) {
+	dir := t.TempDir()
+	manifest := filepath.Join(dir, "db.manifest")
+
+	write := func(value string, broken bool) error {
+		t.Helper()
+		sw, err := cdb.CreateSharded(manifest, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			if err := sw.Put([]byte("key"+strconv.Itoa(i)), []byte(value)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if broken {
+			// The last shard fails to finalize after the others
+			// have been built.
+			sw.Shard(3).LoadFactor = 2
+		}
+		return sw.Close()
+	}
+	if err := write("old", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := write("new", true); err == nil {
+		t.Fatal("Close with a failing shard succeeded")
+	}
+
+	sr, err := cdb.OpenSharded(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Close()
+	for i := 0; i < 100; i++ {
+		key := "key" + strconv.Itoa(i)
+		if value, err := sr.Get([]byte(key)); err != nil || string(value) != "old" {
+			t.Fatalf("%s in shard %d = %q, %v after a failed Close, want old", key, cdb.ShardOf([]byte(key), 4), value, err)
+		}
+	}
+	if stray, _ := filepath.Glob(filepath.Join(dir, ".*.tmp-*")); len(stray) != 0 {
+		t.Errorf("temporary files left behind: %q", stray)
+	}
+}
@@ -0,0 +1,99 @@
+package cdb
+
+// Stats describes the layout of a CDB database and the cost of lookups in it.
+type Stats struct {
+	// Size is the total size of the database in bytes.
+	Size uint64
+	// DataSize is the size of the records section in bytes.
+	DataSize uint64
+	// TableSize is the size of all hash tables in bytes.
+	TableSize uint64
+
+	// Records is the number of hash table entries, one per record.
+	Records uint64
+	// Tables is the number of non-empty hash tables.
+	Tables int
+	// Slots is the total number of hash table slots.
+	Slots uint64
+	// LoadFactor is Records / Slots.
+	LoadFactor float64
+	// PowerOfTwo reports whether every non-empty table has a power-of-two
+	// length.
+	PowerOfTwo bool
+
+	// AvgProbe is the average number of slots inspected by a successful
+	// lookup, and MaxProbe the worst case.
+	AvgProbe float64
+	MaxProbe uint64
+	// AvgMissProbe is the average number of slots inspected by an
+	// unsuccessful lookup, averaged over all starting slots.
+	AvgMissProbe float64
+}
+
+// Stats returns layout and probe statistics for the database.
+func (cdb *MmapCDB) Stats() Stats {
+	return stats(cdb.format.layout(), cdb.data)
+}
+
+// Stats returns layout and probe statistics for the database.
+func (cdb *InMemoryCDB) Stats() Stats {
+	return stats(cdb.format.layout(), cdb.data)
+}
+
+// stats walks all hash tables in data and gathers Stats.
+func stats(l layout, data []byte) Stats {
+	s := Stats{
+		Size:       uint64(len(data)),
+		DataSize:   l.dataEnd(data) - l.indexSize,
+		PowerOfTwo: true,
+	}
+
+	var probes, missProbes uint64
+	for i := 0; i < 256; i++ {
+		t := l.table(data, uint8(i))
+		if t.length == 0 {
+			continue
+		}
+		s.Tables++
+		s.Slots += t.length
+		s.TableSize += l.tupleSize * t.length
+		if t.length&(t.length-1) != 0 {
+			s.PowerOfTwo = false
+		}
+
+		// Walk the table backwards twice so that every slot knows the
+		// distance to the next empty slot, which is the cost of a miss
+		// that starts there.
+		var run uint64
+		for j := 2 * t.length; j > 0; j-- {
+			slot := (j - 1) % t.length
+			hash, offset := l.tuple(data, t.offset+l.tupleSize*slot)
+			if offset == 0 {
+				run = 0
+			} else if run < t.length {
+				run++
+			}
+			if j > t.length {
+				continue
+			}
+
+			missProbes += min(run+1, t.length)
+			if offset != 0 {
+				s.Records++
+				home := t.startSlot(uint32(hash))
+				probe := (slot+t.length-home)%t.length + 1
+				probes += probe
+				s.MaxProbe = max(s.MaxProbe, probe)
+			}
+		}
+	}
+
+	if s.Slots > 0 {
+		s.LoadFactor = float64(s.Records) / float64(s.Slots)
+		s.AvgMissProbe = float64(missProbes) / float64(s.Slots)
+	}
+	if s.Records > 0 {
+		s.AvgProbe = float64(probes) / float64(s.Records)
+	}
+	return s
+}
@@ -0,0 +1,581 @@
+package cdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"iter"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrStoreClosed is returned when a Store is used after Close.
+var ErrStoreClosed = errors.New("CDB store is closed")
+
+const (
+	storeBaseName = "data.cdb"
+	walPrefix     = "wal-"
+	walSuffix     = ".log"
+
+	walPut    byte = 1
+	walDelete byte = 2
+
+	// walHeaderSize is the size of a WAL record header: a CRC-32C of the
+	// rest of the record, the operation, and the key and value lengths.
+	walHeaderSize = 4 + 1 + 8 + 8
+)
+
+var walTable = crc32.MakeTable(crc32.Castagnoli)
+
+// StoreOptions configures a Store.
+type StoreOptions struct {
+	// CompactInterval, if non-zero, compacts the write-ahead log into the
+	// base database in the background at this interval.
+	CompactInterval time.Duration
+	// CompactSize, if non-zero, starts a background compaction once the
+	// write-ahead log holds this many bytes.
+	CompactSize int64
+}
+
+// Store is a mutable key-value store built on a constant database. Reads are
+// served from an in-memory table of recent puts and deletes, then from a
+// memory-mapped base database. Every change is appended to a write-ahead log
+// and synced before Put or Delete returns. Compaction writes the base and the
+// logged changes into a new base with CreateAtomic and swaps it in, after
+// which the log is discarded.
+//
+// A Store keeps its files in a directory that must not be shared with
+// another process. Values returned by Get, View and All must not be
+// modified. Get returns values that stay valid after the Store changes,
+// while View and All read the base in place, and the values they return from
+// it are only valid until the view or the iteration ends. A base replaced by
+// compaction is closed, and its disk space released, once the last view or
+// iteration over it has ended.
+type Store struct {
+	dir  string
+	opts StoreOptions
+
+	mu      sync.RWMutex
+	base    *reloadRef // nil until the first compaction
+	mem     map[string]memValue
+	imm     map[string]memValue // changes being compacted, if any
+	wal     *os.File
+	walSeq  uint64
+	walSize int64
+	closed  bool
+
+	compactMu sync.Mutex
+	trigger   chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// memValue is a logged change: a new value or a deletion.
+type memValue struct {
+	value   []byte
+	deleted bool
+}
+
+// OpenStore opens the Store in dir, creating the directory if needed, and
+// replays any write-ahead logs left by a previous process.
+func OpenStore(dir string, opts StoreOptions) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("os.MkdirAll(%q): %w", dir, err)
+	}
+
+	s := &Store{
+		dir:     dir,
+		opts:    opts,
+		mem:     make(map[string]memValue),
+		trigger: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+
+	// Remove temporary files of compactions interrupted by a crash.
+	stale, _ := filepath.Glob(filepath.Join(dir, "."+storeBaseName+".tmp-*"))
+	for _, path := range stale {
+		_ = os.Remove(path)
+	}
+
+	base, err := openRef(filepath.Join(dir, storeBaseName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		s.base = base
+	}
+
+	seqs, err := s.walSeqs()
+	if err != nil {
+		s.releaseBase()
+		return nil, err
+	}
+	for _, seq := range seqs {
+		if err := s.replay(seq); err != nil {
+			s.releaseBase()
+			return nil, err
+		}
+		s.walSeq = seq
+	}
+
+	// Always log to a fresh file, so a torn record at the end of an old
+	// log is never followed by valid ones.
+	s.walSeq++
+	s.wal, err = s.createWAL(s.walSeq)
+	if err != nil {
+		s.releaseBase()
+		return nil, err
+	}
+
+	if opts.CompactInterval > 0 || opts.CompactSize > 0 {
+		s.wg.Add(1)
+		go s.compactLoop()
+		s.maybeCompact()
+	}
+	return s, nil
+}
+
+// Get returns the current value for key, or nil if it does not exist or has
+// been deleted. Values from the base are copied, so that they outlive it;
+// View reads them in place.
+func (s *Store) Get(key []byte) ([]byte, error) {
+	var held []*reloadRef
+	defer func() { releaseRefs(held) }()
+	value, inBase, err := s.lookup(key, &held)
+	if inBase {
+		value = bytes.Clone(value)
+	}
+	return value, err
+}
+
+// View calls fn with a function that looks up keys like Get, but returns
+// values from the base without copying them. The bases these values come
+// from stay open until fn returns, even if the Store compacts in the
+// meantime, so the values must not be used after that. View returns the
+// error of fn.
+func (s *Store) View(fn func(get func(key []byte) ([]byte, error)) error) error {
+	var held []*reloadRef
+	defer func() { releaseRefs(held) }()
+	return fn(func(key []byte) ([]byte, error) {
+		value, _, err := s.lookup(key, &held)
+		return value, err
+	})
+}
+
+// lookup returns the current value for key and whether it comes from the
+// base. The base is acquired and added to held, unless it already is.
+func (s *Store) lookup(key []byte, held *[]*reloadRef) ([]byte, bool, error) {
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return nil, false, ErrStoreClosed
+	}
+	for _, m := range []map[string]memValue{s.mem, s.imm} {
+		if v, ok := m[string(key)]; ok {
+			s.mu.RUnlock()
+			return v.value, false, nil
+		}
+	}
+	base := s.base
+	if base != nil && !slices.Contains(*held, base) {
+		base.refs.Add(1)
+		*held = append(*held, base)
+	}
+	s.mu.RUnlock()
+
+	if base == nil {
+		return nil, false, nil
+	}
+	value, err := base.db.Get(key)
+	return value, value != nil, err
+}
+
+func releaseRefs(refs []*reloadRef) {
+	for _, ref := range refs {
+		ref.release()
+	}
+}
+
+// Put sets the value for key. The change is durable when Put returns.
+func (s *Store) Put(key, value []byte) error {
+	return s.log(walPut, key, value)
+}
+
+// Delete removes key. The change is durable when Delete returns.
+func (s *Store) Delete(key []byte) error {
+	return s.log(walDelete, key, nil)
+}
+
+// log appends a change to the write-ahead log, syncs it and applies it to
+// the in-memory table.
+func (s *Store) log(op byte, key, value []byte) error {
+	record := make([]byte, walHeaderSize+len(key)+len(value))
+	record[4] = op
+	binary.LittleEndian.PutUint64(record[5:], uint64(len(key)))
+	binary.LittleEndian.PutUint64(record[13:], uint64(len(value)))
+	copy(record[walHeaderSize:], key)
+	copy(record[walHeaderSize+len(key):], value)
+	binary.LittleEndian.PutUint32(record, crc32.Checksum(record[4:], walTable))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+
+	if _, err := s.wal.Write(record); err != nil {
+		return fmt.Errorf("wal.Write: %w", err)
+	}
+	if err := s.wal.Sync(); err != nil {
+		return fmt.Errorf("wal.Sync: %w", err)
+	}
+	s.walSize += int64(len(record))
+
+	v := memValue{deleted: op == walDelete}
+	if !v.deleted {
+		v.value = record[walHeaderSize+len(key):]
+	}
+	s.mem[string(key)] = v
+	s.maybeCompact()
+	return nil
+}
+
+// maybeCompact starts a background compaction once the logs hold
+// CompactSize bytes.
+func (s *Store) maybeCompact() {
+	if s.opts.CompactSize > 0 && s.walSize >= s.opts.CompactSize {
+		select {
+		case s.trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// All returns an iterator over a snapshot of all live key-value pairs:
+// logged changes first, then the records of the base they do not replace.
+// The base is kept open until the iteration ends.
+func (s *Store) All() iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		s.mu.RLock()
+		if s.closed {
+			s.mu.RUnlock()
+			return
+		}
+		changes := make(map[string]memValue, len(s.mem)+len(s.imm))
+		for k, v := range s.imm {
+			changes[k] = v
+		}
+		for k, v := range s.mem {
+			changes[k] = v
+		}
+		base := s.base
+		if base != nil {
+			base.refs.Add(1)
+			defer base.release()
+		}
+		s.mu.RUnlock()
+
+		for _, k := range slices.Sorted(maps.Keys(changes)) {
+			if v := changes[k]; !v.deleted && !yield([]byte(k), v.value) {
+				return
+			}
+		}
+		if base == nil {
+			return
+		}
+		for key, value := range firstRecords(base.db) {
+			if _, ok := changes[string(key)]; ok {
+				continue
+			}
+			if !yield(key, value) {
+				return
+			}
+		}
+	}
+}
+
+// Compact writes the base and all logged changes into a new base database,
+// swaps it in and discards the write-ahead logs it contains. Puts and
+// deletes may proceed while the new base is built.
+func (s *Store) Compact() error {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrStoreClosed
+	}
+	if len(s.mem) == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+
+	// Rotate the log, so that the changes being compacted are exactly
+	// those in the logs up to and including compactedSeq.
+	wal, err := s.createWAL(s.walSeq + 1)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	oldWAL, compactedSeq := s.wal, s.walSeq
+	s.imm, s.mem = s.mem, make(map[string]memValue)
+	s.wal, s.walSeq, s.walSize = wal, s.walSeq+1, 0
+	base, imm := s.base, s.imm
+	s.mu.Unlock()
+
+	if err := oldWAL.Close(); err != nil {
+		return s.compactFailed(fmt.Errorf("wal.Close: %w", err))
+	}
+
+	db, err := s.buildBase(base, imm)
+	if err != nil {
+		return s.compactFailed(err)
+	}
+
+	ref := &reloadRef{db: db}
+	ref.refs.Store(1)
+	s.mu.Lock()
+	s.releaseBase()
+	s.base, s.imm = ref, nil
+	s.mu.Unlock()
+
+	return s.removeWALs(compactedSeq)
+}
+
+// compactFailed moves the changes being compacted back into the in-memory
+// table, below any newer ones. Their logs are kept for the next attempt.
+func (s *Store) compactFailed(err error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, v := range s.imm {
+		if _, ok := s.mem[k]; !ok {
+			s.mem[k] = v
+		}
+	}
+	s.imm = nil
+	return fmt.Errorf("compact: %w", err)
+}
+
+// buildBase writes base overlaid with changes into a new base database. Only
+// Compact replaces the base, so base stays open while it is read.
+func (s *Store) buildBase(base *reloadRef, changes map[string]memValue) (*MmapCDB, error) {
+	w, err := CreateAtomic(filepath.Join(s.dir, storeBaseName))
+	if err != nil {
+		return nil, err
+	}
+
+	if base != nil {
+		for key, value := range firstRecords(base.db) {
+			if _, ok := changes[string(key)]; ok {
+				continue
+			}
+			if err := w.Put(key, value); err != nil {
+				_ = w.Abort()
+				return nil, err
+			}
+		}
+	}
+	for _, k := range slices.Sorted(maps.Keys(changes)) {
+		if v := changes[k]; !v.deleted {
+			if err := w.Put([]byte(k), v.value); err != nil {
+				_ = w.Abort()
+				return nil, err
+			}
+		}
+	}
+
+	db, err := w.Freeze()
+	if err != nil {
+		_ = w.Abort()
+		return nil, err
+	}
+	return db.(*MmapCDB), nil
+}
+
+// compactLoop runs background compactions until the Store is closed.
+func (s *Store) compactLoop() {
+	defer s.wg.Done()
+
+	var tick <-chan time.Time
+	if s.opts.CompactInterval > 0 {
+		ticker := time.NewTicker(s.opts.CompactInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-tick:
+		case <-s.trigger:
+		}
+		// A failed compaction keeps all changes in the log and is retried
+		// on the next tick or trigger.
+		_ = s.Compact()
+	}
+}
+
+// Close stops background compaction, closes the log and releases the base,
+// which is closed once no iteration uses it.
+func (s *Store) Close() error {
+	s.mu.RLock()
+	closed := s.closed
+	s.mu.RUnlock()
+	if closed {
+		return ErrStoreClosed
+	}
+
+	s.closeOnce.Do(func() { close(s.done) })
+	s.wg.Wait()
+
+	// Wait for a compaction started through Compact to finish.
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	s.closed = true
+
+	s.releaseBase()
+	if err := s.wal.Close(); err != nil {
+		return fmt.Errorf("wal.Close: %w", err)
+	}
+	return nil
+}
+
+// releaseBase drops the Store's reference to its base, which is closed once
+// no iteration uses it.
+func (s *Store) releaseBase() {
+	if s.base != nil {
+		s.base.release()
+		s.base = nil
+	}
+}
+
+func (s *Store) walPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s%016x%s", walPrefix, seq, walSuffix))
+}
+
+// walSeqs returns the sequence numbers of all logs in the directory, in
+// order.
+func (s *Store) walSeqs() ([]uint64, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadDir(%q): %w", s.dir, err)
+	}
+
+	var seqs []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, walPrefix) || !strings.HasSuffix(name, walSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, walPrefix), walSuffix), 16, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	slices.Sort(seqs)
+	return seqs, nil
+}
+
+// createWAL creates a new, empty log and makes its directory entry durable.
+func (s *Store) createWAL(seq uint64) (*os.File, error) {
+	path := s.walPath(seq)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("os.OpenFile(%q): %w", path, err)
+	}
+	if err := syncDir(s.dir); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// removeWALs deletes all logs up to and including seq.
+func (s *Store) removeWALs(seq uint64) error {
+	seqs, err := s.walSeqs()
+	if err != nil {
+		return err
+	}
+	for _, n := range seqs {
+		if n > seq {
+			break
+		}
+		if err := os.Remove(s.walPath(n)); err != nil {
+			return fmt.Errorf("os.Remove: %w", err)
+		}
+	}
+	return nil
+}
+
+// replay applies the changes in log seq to the in-memory table. A torn or
+// corrupt record ends the log, as it can only be the result of a crash
+// while it was being appended.
+func (s *Store) replay(seq uint64) error {
+	path := s.walPath(seq)
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("os.Open(%q): %w", path, err)
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("file.Stat: %w", err)
+	}
+	remaining := uint64(stat.Size())
+	// Replayed logs count towards CompactSize until they are compacted.
+	s.walSize += stat.Size()
+
+	r := bufio.NewReader(f)
+	header := make([]byte, walHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil
+		}
+		remaining -= walHeaderSize
+		keyLength := binary.LittleEndian.Uint64(header[5:])
+		valueLength := binary.LittleEndian.Uint64(header[13:])
+		if keyLength > remaining || valueLength > remaining-keyLength {
+			return nil
+		}
+
+		body := make([]byte, keyLength+valueLength)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil
+		}
+		remaining -= keyLength + valueLength
+		crc := crc32.Update(crc32.Checksum(header[4:], walTable), walTable, body)
+		if crc != binary.LittleEndian.Uint32(header) {
+			return nil
+		}
+
+		key := string(body[:keyLength])
+		switch header[4] {
+		case walPut:
+			s.mem[key] = memValue{value: body[keyLength:]}
+		case walDelete:
+			s.mem[key] = memValue{deleted: true}
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package cdb_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/perbu/cdb"
+)
+
+func expectStoreValue(t *testing.T, s *cdb.Store, key, expected string) {
+	t.Helper()
+	value, err := s.Get([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected == "" {
+		if value != nil {
+			t.Errorf("%s: expected no value, got %q", key, value)
+		}
+		return
+	}
+	if string(value) != expected {
+		t.Errorf("%s: expected %q, got %q", key, expected, value)
+	}
+}
+
+func walFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := cdb.OpenStore(dir, cdb.StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, kv := range [][2]string{{"a", "1"}, {"b", "2"}, {"c", "3"}} {
+		if err := s.Put([]byte(kv[0]), []byte(kv[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	expectStoreValue(t, s, "a", "1")
+	expectStoreValue(t, s, "b", "")
+
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if len(walFiles(t, dir)) != 1 {
+		t.Errorf("expected only the active log after compaction, got %v", walFiles(t, dir))
+	}
+
+	// Changes on top of the compacted base.
+	if err := s.Put([]byte("a"), []byte("10")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete([]byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put([]byte("d"), []byte("4")); err != nil {
+		t.Fatal(err)
+	}
+	expectStoreValue(t, s, "a", "10")
+	expectStoreValue(t, s, "c", "")
+
+	if got, want := collectPairs(s.All()), []string{"a=10", "d=4"}; !slices.Equal(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get([]byte("a")); !errors.Is(err, cdb.ErrStoreClosed) {
+		t.Errorf("expected ErrStoreClosed, got %v", err)
+	}
+
+	// Reopening replays the log on top of the base.
+	s, err = cdb.OpenStore(dir, cdb.StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	expectStoreValue(t, s, "a", "10")
+	expectStoreValue(t, s, "b", "")
+	expectStoreValue(t, s, "c", "")
+	expectStoreValue(t, s, "d", "4")
+
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	base, err := cdb.Open(filepath.Join(dir, "data.cdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer base.Close()
+	if got, want := collectPairs(base.All()), []string{"a=10", "d=4"}; !slices.Equal(got, want) {
+		t.Errorf("expected compacted base %v, got %v", want, got)
+	}
+}
+
+func TestStoreTornLog(t *testing.T) {
+	dir := t.TempDir()
+	s, err := cdb.OpenStore(dir, cdb.StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put([]byte("kept"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put([]byte("torn"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash in the middle of appending the last record.
+	wals := walFiles(t, dir)
+	info, err := os.Stat(wals[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(wals[0], info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = cdb.OpenStore(dir, cdb.StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	expectStoreValue(t, s, "kept", "value")
+	expectStoreValue(t, s, "torn", "")
+
+	// New changes go to a fresh log and survive another reopen.
+	if err := s.Put([]byte("after"), []byte("crash")); err != nil {
+		t.Fatal(err)
+	}
+	expectStoreValue(t, s, "after", "crash")
+}
+
+func TestStoreBackgroundCompaction(t *testing.T) {
+	dir := t.TempDir()
+	s, err := cdb.OpenStore(dir, cdb.StoreOptions{CompactSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 200; i++ {
+		if err := s.Put([]byte("key"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "data.cdb")); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("background compaction did not run")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i := 0; i < 200; i++ {
+		n := strconv.Itoa(i)
+		expectStoreValue(t, s, "key"+n, "value"+n)
+	}
+}
+
+// openBases returns the number of open files of this process that are bases
+// in dir, including replaced ones.
+func openBases(t *testing.T, dir string) int {
+	t.Helper()
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("no /proc/self/fd:", err)
+	}
+	n := 0
+	for _, fd := range fds {
+		target, err := os.Readlink(filepath.Join("/proc/self/fd", fd.Name()))
+		if err == nil && strings.HasPrefix(target, filepath.Join(dir, "data.cdb")) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestStoreReleasesReplacedBases(t *testing.T) {
+	dir := t.TempDir()
+	s, err := cdb.OpenStore(dir, cdb.StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	put := func(key, value string) {
+		t.Helper()
+		if err := s.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	compact := func() {
+		t.Helper()
+		if err := s.Compact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	put("a", "1")
+	put("b", "2")
+	compact()
+	value, err := s.Get([]byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A running iteration keeps its base, and the values it yields,
+	// while the Store compacts.
+	var got []string
+	for key, v := range s.All() {
+		if len(got) == 0 {
+			for i := range 10 {
+				put("c", strconv.Itoa(i))
+				compact()
+			}
+			if n := openBases(t, dir); n != 2 {
+				t.Errorf("%d bases open during an iteration, want 2", n)
+			}
+		}
+		got = append(got, string(key)+"="+string(v))
+	}
+	if want := []string{"a=1", "b=2"}; !slices.Equal(got, want) {
+		t.Errorf("All during compactions = %q, want %q", got, want)
+	}
+
+	if n := openBases(t, dir); n != 1 {
+		t.Errorf("%d bases open after compactions, want 1", n)
+	}
+	// Values returned by Get outlive their base.
+	if string(value) != "1" {
+		t.Errorf("value from a replaced base = %q, want 1", value)
+	}
+	expectStoreValue(t, s, "c", "9")
+}
+
+func TestStoreView(t *testing.T) {
+	dir := t.TempDir()
+	s, err := cdb.OpenStore(dir, cdb.StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, kv := range [][2]string{{"a", "1"}, {"b", "2"}} {
+		if err := s.Put([]byte(kv[0]), []byte(kv[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.View(func(get func([]byte) ([]byte, error)) error {
+		a1, err := get([]byte("a"))
+		if err != nil {
+			return err
+		}
+		a2, err := get([]byte("a"))
+		if err != nil {
+			return err
+		}
+		// Base values are read in place.
+		if &a1[0] != &a2[0] {
+			t.Error("View copied a value from the base")
+		}
+
+		if err := s.Put([]byte("b"), []byte("3")); err != nil {
+			return err
+		}
+		if err := s.Compact(); err != nil {
+			return err
+		}
+		if n := openBases(t, dir); n != 2 {
+			t.Errorf("%d bases open during a view, want 2", n)
+		}
+		if b, err := get([]byte("b")); err != nil || string(b) != "3" {
+			t.Errorf("get(b) after a compaction = %q, %v, want 3", b, err)
+		}
+		if string(a1) != "1" {
+			t.Errorf("value from a replaced base = %q, want 1", a1)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := openBases(t, dir); n != 1 {
+		t.Errorf("%d bases open after a view, want 1", n)
+	}
+
+	a1, _ := s.Get([]byte("a"))
+	a2, _ := s.Get([]byte("a"))
+	if &a1[0] == &a2[0] {
+		t.Error("Get returned a value from the base in place")
+	}
+}
+
+func TestStoreCompactsReplayedLogs(t *testing.T) {
+	dir := t.TempDir()
+	s, err := cdb.OpenStore(dir, cdb.StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		if err := s.Put([]byte("key"+strconv.Itoa(i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The logs left behind already exceed CompactSize, so reopening
+	// compacts them without further writes.
+	s, err = cdb.OpenStore(dir, cdb.StoreOptions{CompactSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "data.cdb")); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("replayed logs were not compacted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	expectStoreValue(t, s, "key199", "value")
+}
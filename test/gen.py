@@ -1,5 +1,3 @@
-import cdblib
-
 entries = [
     (b'key', b'value'),                          # from your example
     (b'alpha', b'first'),
@@ -23,8 +21,11 @@ entries = [
     (b'utf8:key', 'norsk: \u00f8 \u00e6 \u00e5'.encode('utf-8')),  # UTF-8 value
 ]
 
-with open('test.cdb64', 'wb') as f:
-    with cdblib.Writer64(f) as writer:
-        for k, v in entries:
-            writer.put(k, v)
+if __name__ == '__main__':
+    import cdblib
+
+    with open('test.cdb64', 'wb') as f:
+        with cdblib.Writer64(f) as writer:
+            for k, v in entries:
+                writer.put(k, v)
 
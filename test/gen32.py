@@ -0,0 +1,45 @@
+# Writes test.cdb, a classic 32-bit cdb with the same entries as test.cdb64,
+# following djb's cdbmake algorithm so that it does not depend on this
+# package or on a particular library.
+import struct
+
+from gen import entries
+
+
+def cdb_hash(data):
+    h = 5381
+    for b in data:
+        h = (((h << 5) + h) & 0xffffffff) ^ b
+    return h
+
+
+def cdbmake(path, entries):
+    records = bytearray()
+    pointers = []
+    pos = 2048
+    for k, v in entries:
+        records += struct.pack('<LL', len(k), len(v)) + k + v
+        pointers.append((cdb_hash(k), pos))
+        pos += 8 + len(k) + len(v)
+
+    index = bytearray()
+    tables = bytearray()
+    for i in range(256):
+        bucket = [p for p in pointers if p[0] & 0xff == i]
+        slots = [(0, 0)] * (2 * len(bucket))
+        for h, p in bucket:
+            where = (h >> 8) % len(slots)
+            while slots[where][1] != 0:
+                where = (where + 1) % len(slots)
+            slots[where] = (h, p)
+        index += struct.pack('<LL', pos, len(slots))
+        for h, p in slots:
+            tables += struct.pack('<LL', h, p)
+        pos += 8 * len(slots)
+
+    with open(path, 'wb') as f:
+        f.write(index + records + tables)
+
+
+if __name__ == '__main__':
+    cdbmake('test.cdb', entries)
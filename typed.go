@@ -0,0 +1,118 @@
+package cdb
+
+import (
+	"fmt"
+	"iter"
+)
+
+// TypedReader reads a database whose keys and values are encoded with
+// codecs, so that callers work with K and V instead of byte slices.
+type TypedReader[K, V any] struct {
+	r      Reader
+	keys   Codec[K]
+	values Codec[V]
+}
+
+// NewTypedReader returns a TypedReader over r. Closing r is left to the
+// caller.
+func NewTypedReader[K, V any](r Reader, keys Codec[K], values Codec[V]) *TypedReader[K, V] {
+	return &TypedReader[K, V]{r: r, keys: keys, values: values}
+}
+
+// Reader returns the underlying Reader.
+func (t *TypedReader[K, V]) Reader() Reader {
+	return t.r
+}
+
+// Get returns the value of the first record with the given key, and whether
+// there is one.
+func (t *TypedReader[K, V]) Get(key K) (V, bool, error) {
+	var v V
+	k, err := t.keys.Append(nil, key)
+	if err != nil {
+		return v, false, fmt.Errorf("encode key: %w", err)
+	}
+	data, err := t.r.Get(k)
+	if err != nil || data == nil {
+		return v, false, err
+	}
+	if v, err = t.values.Decode(data); err != nil {
+		return v, false, fmt.Errorf("decode value of key %q: %w", k, err)
+	}
+	return v, true, nil
+}
+
+// TypedRecord is a decoded record yielded by TypedReader.All and
+// TypedReader.Range.
+type TypedRecord[K, V any] struct {
+	Key   K
+	Value V
+}
+
+// All returns an iterator over all records in write order, decoded. A
+// record whose key or value cannot be decoded is yielded with an empty
+// TypedRecord and its error, and ends the iteration.
+func (t *TypedReader[K, V]) All() iter.Seq2[TypedRecord[K, V], error] {
+	return t.decode(t.r.All())
+}
+
+// Range returns an iterator over the records whose encoded keys k satisfy
+// begin <= k < end, decoded, like All. See Range for the bounds.
+func (t *TypedReader[K, V]) Range(begin, end []byte) iter.Seq2[TypedRecord[K, V], error] {
+	return t.decode(Range(t.r, begin, end))
+}
+
+// decode decodes the records of seq, as described by All.
+func (t *TypedReader[K, V]) decode(seq iter.Seq2[[]byte, []byte]) iter.Seq2[TypedRecord[K, V], error] {
+	return func(yield func(TypedRecord[K, V], error) bool) {
+		for k, data := range seq {
+			var rec TypedRecord[K, V]
+			var err error
+			if rec.Key, err = t.keys.Decode(k); err != nil {
+				yield(TypedRecord[K, V]{}, fmt.Errorf("decode key %q: %w", k, err))
+				return
+			}
+			if rec.Value, err = t.values.Decode(data); err != nil {
+				yield(TypedRecord[K, V]{}, fmt.Errorf("decode value of key %q: %w", k, err))
+				return
+			}
+			if !yield(rec, nil) {
+				return
+			}
+		}
+	}
+}
+
+// TypedWriter adds records to a Writer, encoding keys and values with
+// codecs.
+type TypedWriter[K, V any] struct {
+	w      *Writer
+	keys   Codec[K]
+	values Codec[V]
+	buf    []byte
+}
+
+// NewTypedWriter returns a TypedWriter that adds records to w. Finishing or
+// closing w is left to the caller.
+func NewTypedWriter[K, V any](w *Writer, keys Codec[K], values Codec[V]) *TypedWriter[K, V] {
+	return &TypedWriter[K, V]{w: w, keys: keys, values: values}
+}
+
+// Writer returns the underlying Writer.
+func (t *TypedWriter[K, V]) Writer() *Writer {
+	return t.w
+}
+
+// Put encodes key and value and adds them to the database.
+func (t *TypedWriter[K, V]) Put(key K, value V) error {
+	buf, err := t.keys.Append(t.buf[:0], key)
+	if err != nil {
+		return fmt.Errorf("encode key: %w", err)
+	}
+	n := len(buf)
+	if buf, err = t.values.Append(buf, value); err != nil {
+		return fmt.Errorf("encode value: %w", err)
+	}
+	t.buf = buf
+	return t.w.Put(buf[:n], buf[n:])
+}
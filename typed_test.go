@@ -0,0 +1,179 @@
+package cdb_test
+
+import (
+	"bytes"
+	"math"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/perbu/cdb"
+)
+
+type user struct {
+	Name  string
+	Admin bool
+}
+
+func TestTyped(t *testing.T) {
+	b := cdb.NewBuilder()
+	w := cdb.NewTypedWriter(b.Writer, cdb.IntCodec[int64]{}, cdb.JSONCodec[user]{})
+	users := map[int64]user{-7: {"eve", false}, 1: {"alice", true}, 2: {"bob", false}}
+	for _, id := range []int64{1, 2, -7} {
+		if err := w.Put(id, users[id]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db, err := b.InMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := cdb.NewTypedReader(db, cdb.IntCodec[int64]{}, cdb.JSONCodec[user]{})
+	if u, ok, err := r.Get(2); err != nil || !ok || u != users[2] {
+		t.Errorf("Get(2) = %+v, %v, %v", u, ok, err)
+	}
+	if _, ok, err := r.Get(3); err != nil || ok {
+		t.Errorf("Get(3) = %v, %v; want not found", ok, err)
+	}
+	var ids []int64
+	for rec, err := range r.All() {
+		if err != nil {
+			t.Fatalf("All: %v", err)
+		}
+		if rec.Value != users[rec.Key] {
+			t.Errorf("All yielded %d: %+v, want %+v", rec.Key, rec.Value, users[rec.Key])
+		}
+		ids = append(ids, rec.Key)
+	}
+	if !slices.Equal(ids, []int64{1, 2, -7}) {
+		t.Errorf("All = %v", ids)
+	}
+
+	// A value that cannot be decoded is reported by Get and ends All.
+	bad := cdb.NewBuilder()
+	for _, kv := range [][2]string{{"a", `{"Name":"a"}`}, {"b", "not json"}, {"c", `{"Name":"c"}`}} {
+		if err := bad.Put([]byte(kv[0]), []byte(kv[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	badDB, err := bad.InMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := cdb.NewTypedReader(badDB, cdb.StringCodec{}, cdb.JSONCodec[user]{})
+	if _, _, err := br.Get("b"); err == nil {
+		t.Error("Get of an invalid value succeeded")
+	}
+	var keys []string
+	var decodeErr error
+	for rec, err := range br.All() {
+		if err != nil {
+			decodeErr = err
+			continue
+		}
+		keys = append(keys, rec.Key)
+	}
+	if decodeErr == nil || !slices.Equal(keys, []string{"a"}) {
+		t.Errorf("All over an invalid value = %q, %v", keys, decodeErr)
+	}
+}
+
+func TestIntCodecOrder(t *testing.T) {
+	checkOrder(t, cdb.IntCodec[int64]{}, []int64{math.MinInt64, -1 << 40, -256, -1, 0, 1, 255, 256, math.MaxInt64})
+	checkOrder(t, cdb.IntCodec[int8]{}, []int8{-128, -1, 0, 1, 127})
+	checkOrder(t, cdb.IntCodec[uint16]{}, []uint16{0, 1, 255, 256, 65535})
+	checkOrder(t, cdb.IntCodec[uint64]{}, []uint64{0, 1 << 63, math.MaxUint64})
+
+	if data, _ := (cdb.IntCodec[uint32]{}).Append(nil, 0x01020304); !bytes.Equal(data, []byte{1, 2, 3, 4}) {
+		t.Errorf("IntCodec[uint32] encodes 0x01020304 as %x", data)
+	}
+	if _, err := (cdb.IntCodec[int32]{}).Decode([]byte{1, 2}); err == nil {
+		t.Error("IntCodec[int32] decoded 2 bytes")
+	}
+}
+
+// checkOrder checks that the encodings of sorted values are sorted and
+// decode to the values.
+func checkOrder[T cdb.Integer](t *testing.T, codec cdb.IntCodec[T], values []T) {
+	t.Helper()
+	var prev []byte
+	for _, v := range values {
+		data, err := codec.Append(nil, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prev != nil && bytes.Compare(prev, data) >= 0 {
+			t.Errorf("encoding of %d (%x) does not sort after %x", v, data, prev)
+		}
+		if got, err := codec.Decode(data); err != nil || got != v {
+			t.Errorf("Decode(%x) = %d, %v; want %d", data, got, err, v)
+		}
+		prev = data
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	when := time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC)
+	roundTrip(t, cdb.BinaryCodec[time.Time, *time.Time]{}, when, func(a, b time.Time) bool { return a.Equal(b) })
+	roundTrip(t, cdb.GobCodec[user]{}, user{"gob", true}, func(a, b user) bool { return a == b })
+	roundTrip(t, cdb.StringCodec{}, "héllo", func(a, b string) bool { return a == b })
+
+	// Append appends to dst.
+	if data, _ := (cdb.GobCodec[int]{}).Append([]byte("prefix"), 42); !bytes.HasPrefix(data, []byte("prefix")) {
+		t.Errorf("GobCodec.Append lost dst: %q", data)
+	}
+	if _, err := (cdb.BinaryCodec[time.Time, *time.Time]{}).Decode([]byte("junk")); err == nil {
+		t.Error("BinaryCodec decoded junk")
+	}
+}
+
+func roundTrip[T any](t *testing.T, codec cdb.Codec[T], v T, equal func(a, b T) bool) {
+	t.Helper()
+	data, err := codec.Append(nil, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := codec.Decode(data)
+	if err != nil || !equal(got, v) {
+		t.Errorf("%T round trip of %v = %v, %v", codec, v, got, err)
+	}
+}
+
+func TestTypedRange(t *testing.T) {
+	b := cdb.NewBuilder()
+	w := cdb.NewTypedWriter(b.Writer, cdb.IntCodec[int32]{}, cdb.StringCodec{})
+	for _, n := range []int32{5, -3, 40, 0, 12, -100} {
+		if err := w.Put(n, strconv.Itoa(int(n))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db, err := b.InMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := cdb.NewTypedReader(db, cdb.IntCodec[int32]{}, cdb.StringCodec{})
+
+	begin, _ := (cdb.IntCodec[int32]{}).Append(nil, -3)
+	end, _ := (cdb.IntCodec[int32]{}).Append(nil, 12)
+	var got []int32
+	var iterErr error
+	for rec, err := range r.Range(begin, end) {
+		if err != nil {
+			iterErr = err
+			break
+		}
+		got = append(got, rec.Key)
+	}
+	if iterErr != nil || !slices.Equal(got, []int32{5, -3, 0}) {
+		t.Errorf("Range(-3, 12) = %v, %v; want [5 -3 0] in write order", got, iterErr)
+	}
+	got = got[:0]
+	for rec := range r.Range(end, nil) {
+		got = append(got, rec.Key)
+	}
+	if !slices.Equal(got, []int32{40, 12}) {
+		t.Errorf("Range(12, nil) = %v, want [40 12]", got)
+	}
+}
@@ -0,0 +1,217 @@
+package cdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrCorrupt is returned by Verify when the database is structurally invalid.
+var ErrCorrupt = errors.New("CDB database is corrupt")
+
+// Verify checks the structure of the database. See VerifyContext.
+func (cdb *MmapCDB) Verify() error {
+	return verify(context.Background(), cdb.format.layout(), cdb.data, nil)
+}
+
+// VerifyContext checks that the index, every record and every hash table
+// entry are within bounds, that every record can be found through the hash
+// tables and that every hash table entry refers to a record with a matching
+// hash. It reads the whole database, stops early when ctx is done and calls
+// progress, if not nil, as it goes. Structural problems are reported as
+// errors wrapping ErrCorrupt.
+func (cdb *MmapCDB) VerifyContext(ctx context.Context, progress func(Progress)) error {
+	return verify(ctx, cdb.format.layout(), cdb.data, progress)
+}
+
+// ScanContext calls fn for every record in write order, stopping at the first
+// error returned by fn or when ctx is done. Progress, if not nil, is called
+// every 65536 records and once at the end.
+func (cdb *MmapCDB) ScanContext(ctx context.Context, progress func(Progress), fn func(key, value []byte) error) error {
+	return scan(ctx, cdb.format.layout(), cdb.data, progress, fn)
+}
+
+// Verify checks the structure of the database. See VerifyContext.
+func (cdb *InMemoryCDB) Verify() error {
+	return verify(context.Background(), cdb.format.layout(), cdb.data, nil)
+}
+
+// VerifyContext checks that the index, every record and every hash table
+// entry are within bounds, that every record can be found through the hash
+// tables and that every hash table entry refers to a record with a matching
+// hash. It stops early when ctx is done and calls progress, if not nil, as
+// it goes. Structural problems are reported as errors wrapping ErrCorrupt.
+func (cdb *InMemoryCDB) VerifyContext(ctx context.Context, progress func(Progress)) error {
+	return verify(ctx, cdb.format.layout(), cdb.data, progress)
+}
+
+// ScanContext calls fn for every record in write order, stopping at the first
+// error returned by fn or when ctx is done. Progress, if not nil, is called
+// every 65536 records and once at the end.
+func (cdb *InMemoryCDB) ScanContext(ctx context.Context, progress func(Progress), fn func(key, value []byte) error) error {
+	return scan(ctx, cdb.format.layout(), cdb.data, progress, fn)
+}
+
+func corrupt(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrCorrupt, fmt.Sprintf(format, args...))
+}
+
+// scan walks the data section of data, calling fn for each record.
+func scan(ctx context.Context, l layout, data []byte, progress func(Progress), fn func(key, value []byte) error) error {
+	p := Progress{Phase: PhaseRecords, TotalBytes: uint64(len(data))}
+	err := walkRecords(ctx, l, data, &p, progress, func(_ uint64, key, value []byte) error {
+		return fn(key, value)
+	})
+	if err != nil {
+		return err
+	}
+
+	if progress != nil {
+		p.Phase = PhaseDone
+		progress(p)
+	}
+	return nil
+}
+
+// walkRecords calls fn with the offset, key and value of every record in the
+// data section, checking ctx and reporting p every progressInterval records.
+func walkRecords(ctx context.Context, l layout, data []byte, p *Progress, progress func(Progress), fn func(pos uint64, key, value []byte) error) error {
+	endPos := l.dataEnd(data)
+	pos := l.indexSize
+	for pos < endPos {
+		if p.Records%progressInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if progress != nil && p.Records > 0 {
+				progress(*p)
+			}
+		}
+
+		keyLength, valueLength := l.tuple(data, pos)
+		keyEnd := pos + l.tupleSize + keyLength
+		valueEnd := keyEnd + valueLength
+		if pos+l.tupleSize > endPos || keyEnd < pos || valueEnd < keyEnd || valueEnd > endPos {
+			return corrupt("record at offset %d extends past the data section", pos)
+		}
+
+		if err := fn(pos, data[pos+l.tupleSize:keyEnd], data[keyEnd:valueEnd]); err != nil {
+			return err
+		}
+
+		pos = valueEnd
+		p.Records++
+		p.Bytes = pos
+	}
+	return nil
+}
+
+// verify checks the structure of the database in data.
+func verify(ctx context.Context, l layout, data []byte, progress func(Progress)) error {
+	size := uint64(len(data))
+	endPos := l.dataEnd(data)
+	if endPos < l.indexSize {
+		return corrupt("hash table overlaps the index")
+	}
+
+	for i := 0; i < 256; i++ {
+		t := l.table(data, uint8(i))
+		if t.length == 0 {
+			continue
+		}
+		if t.offset < endPos || t.offset > size || t.length > (size-t.offset)/l.tupleSize {
+			return corrupt("hash table %d at offset %d with %d slots is out of bounds", i, t.offset, t.length)
+		}
+	}
+
+	// Every record must be reachable through its hash table.
+	p := Progress{Phase: PhaseRecords, TotalBytes: size}
+	err := walkRecords(ctx, l, data, &p, progress, func(pos uint64, key, _ []byte) error {
+		if !hasSlot(l, data, cdbHash(key), pos) {
+			return corrupt("record at offset %d is missing from its hash table", pos)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Every hash table entry must point at a record with a matching hash.
+	var entries uint64
+	p.Phase = PhaseTables
+	for i := 0; i < 256; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		t := l.table(data, uint8(i))
+		for slot := uint64(0); slot < t.length; slot++ {
+			hash, offset := l.tuple(data, t.offset+l.tupleSize*slot)
+			if offset == 0 {
+				continue
+			}
+			if hash > 0xffffffff || hash&0xff != uint64(i) {
+				return corrupt("hash table %d slot %d has hash %#x of another table", i, slot, hash)
+			}
+			if offset < l.indexSize || offset > endPos-l.tupleSize {
+				return corrupt("hash table %d slot %d points outside the data section", i, slot)
+			}
+			keyLength, _ := l.tuple(data, offset)
+			if keyLength > endPos-offset-l.tupleSize {
+				return corrupt("hash table %d slot %d points at an invalid record", i, slot)
+			}
+			if uint64(cdbHash(data[offset+l.tupleSize:offset+l.tupleSize+keyLength])) != hash {
+				return corrupt("hash table %d slot %d hash does not match its record", i, slot)
+			}
+			entries++
+		}
+
+		p.Tables = i + 1
+		if t.length > 0 {
+			p.Bytes = t.offset + l.tupleSize*t.length
+		}
+		if progress != nil {
+			progress(p)
+		}
+	}
+
+	if entries != p.Records {
+		return corrupt("%d hash table entries for %d records", entries, p.Records)
+	}
+
+	if progress != nil {
+		p.Phase = PhaseDone
+		p.Bytes = size
+		progress(p)
+	}
+	return nil
+}
+
+// hasSlot reports whether the hash table for hash has a slot pointing at
+// the record at offset, following the same probe sequence as Get.
+func hasSlot(l layout, data []byte, hash uint32, offset uint64) bool {
+	t := l.table(data, uint8(hash&0xff))
+	if t.length == 0 {
+		return false
+	}
+
+	startingSlot := t.startSlot(hash)
+	slot := startingSlot
+	for {
+		slotHash, slotOffset := l.tuple(data, t.offset+l.tupleSize*slot)
+		if slotOffset == 0 {
+			return false
+		}
+		if slotHash == uint64(hash) && slotOffset == offset {
+			return true
+		}
+
+		slot++
+		if slot == t.length {
+			slot = 0
+		}
+		if slot == startingSlot {
+			return false
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package cdb_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/perbu/cdb"
+)
+
+func buildVerifyDB(t *testing.T, n int) []byte {
+	builder := cdb.NewBuilder()
+	for i := 0; i < n; i++ {
+		if err := builder.Put([]byte("key"+strconv.Itoa(i)), []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := builder.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestVerify(t *testing.T) {
+	db, err := cdb.Open(testFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Verify(); err != nil {
+		t.Errorf("reference database: %v", err)
+	}
+
+	data := buildVerifyDB(t, 200000)
+	mem, err := cdb.NewInMemory(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var last cdb.Progress
+	var reports int
+	err = mem.VerifyContext(context.Background(), func(p cdb.Progress) {
+		if p.Bytes < last.Bytes {
+			t.Errorf("progress went backwards: %+v after %+v", p, last)
+		}
+		last = p
+		reports++
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Phase != cdb.PhaseDone || last.Records != 200000 || last.Tables != 256 || last.Bytes != uint64(len(data)) {
+		t.Errorf("unexpected final progress: %+v", last)
+	}
+	if reports < 256 {
+		t.Errorf("expected at least one report per table, got %d", reports)
+	}
+}
+
+func TestVerifyCorrupt(t *testing.T) {
+	data := buildVerifyDB(t, 100)
+
+	// Point the first non-empty table past the end of the file.
+	corrupted := append([]byte(nil), data...)
+	for i := 0; i < 256; i++ {
+		if binary.LittleEndian.Uint64(corrupted[i*16+8:]) > 0 {
+			binary.LittleEndian.PutUint64(corrupted[i*16+8:], 1<<40)
+			break
+		}
+	}
+	db, _ := cdb.NewInMemory(corrupted)
+	if err := db.Verify(); !errors.Is(err, cdb.ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt for out of bounds table, got %v", err)
+	}
+
+	// Change a key so that it no longer matches its hash table entry.
+	corrupted = append([]byte(nil), data...)
+	corrupted[4096+16] ^= 0xff
+	db, _ = cdb.NewInMemory(corrupted)
+	if err := db.Verify(); !errors.Is(err, cdb.ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt for modified key, got %v", err)
+	}
+}
+
+func TestVerifyCancelled(t *testing.T) {
+	db, err := cdb.NewInMemory(buildVerifyDB(t, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := db.VerifyContext(ctx, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestScanContext(t *testing.T) {
+	db, err := cdb.NewInMemory(buildVerifyDB(t, 150000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	var last cdb.Progress
+	err = db.ScanContext(context.Background(), func(p cdb.Progress) { last = p }, func(key, value []byte) error {
+		if string(key) != "key"+string(value) {
+			t.Fatalf("unexpected record %q => %q", key, value)
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 150000 || last.Phase != cdb.PhaseDone || last.Records != 150000 {
+		t.Errorf("scanned %d records, final progress %+v", count, last)
+	}
+
+	stop := errors.New("stop")
+	ctx, cancel := context.WithCancel(context.Background())
+	count = 0
+	err = db.ScanContext(ctx, nil, func(key, value []byte) error {
+		count++
+		if count == 10 {
+			cancel()
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	err = db.ScanContext(context.Background(), nil, func(key, value []byte) error { return stop })
+	if !errors.Is(err, stop) {
+		t.Errorf("expected callback error, got %v", err)
+	}
+}
@@ -2,16 +2,29 @@ package cdb
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/bits"
 	"os"
+	"runtime"
 	"sync"
+	"sync/atomic"
 )
 
 var ErrTooMuchData = errors.New("CDB files are limited to 8EB of data")
 
+// ErrFinalized is returned when records are added to a Writer whose
+// database has already been finalized, closed or aborted.
+var ErrFinalized = errors.New("CDB writer has been finalized")
+
+// ErrWriterClosed is returned when a Writer is used after Close, Freeze or
+// Abort.
+var ErrWriterClosed = errors.New("CDB writer is closed")
+
 const indexSize = 256 * 16
 
 type table struct {
@@ -21,59 +34,137 @@ type table struct {
 
 type index [256]table
 
+// startSlot returns the slot at which probing for the given hash begins.
+// Power-of-two tables are masked rather than reduced with a modulo.
+func (t table) startSlot(hash uint32) uint64 {
+	if t.length&(t.length-1) == 0 {
+		return (uint64(hash) >> 8) & (t.length - 1)
+	}
+	return (uint64(hash) >> 8) % t.length
+}
+
+// writerState tracks the lifecycle of a Writer. It moves forward only:
+// records are accepted while writing, the hash tables and index are written
+// once when finalized, and nothing is accepted once closed.
+type writerState int
+
+const (
+	stateWriting writerState = iota
+	stateFinalized
+	stateClosed
+)
+
 type entry struct {
 	hash   uint32
 	offset uint64
 }
 
-// Writer provides an API for creating a 64-bit CDB database record by record.
+// Writer provides an API for creating a CDB database record by record, in
+// the 64-bit layout or, when created with NewWriter32, the 32-bit one.
 //
 // Close or Freeze must be called to finalize the database, or the resulting
-// file will be invalid.
+// file will be invalid. Once finalized, Put returns ErrFinalized.
 type Writer struct {
-	writer       io.WriteSeeker
-	entries      [256][]entry
-	finalizeOnce sync.Once
+	// Concurrency is the number of hash tables built in parallel when the
+	// database is finalized. Zero means runtime.GOMAXPROCS(0). The output
+	// does not depend on it.
+	Concurrency int
+
+	// LoadFactor is the target fraction of occupied slots in each hash
+	// table, in the range [MinLoadFactor, 1]. Denser tables make the file
+	// smaller, sparser tables shorten probe chains, particularly for misses.
+	// Zero means 0.5, which is the traditional CDB layout. Put rejects a
+	// value out of range before writing anything.
+	LoadFactor float64
+
+	// PowerOfTwo rounds each hash table size up to the next power of two,
+	// which lets readers mask instead of taking a modulo.
+	PowerOfTwo bool
+
+	// OnProgress, if set, is called every 65536 records while records are
+	// added, after each hash table while the database is finalized, and once
+	// when it is done.
+	OnProgress func(Progress)
+
+	writer      io.WriteSeeker
+	format      Format
+	entries     [256][]entry
+	state       writerState
+	finalizeErr error
+
+	// file is set when the writer owns an *os.File. For CreateAtomic,
+	// target is the path file is renamed to once the database is complete.
+	file   *os.File
+	target string
 
 	bufferedWriter      *bufio.Writer
 	bufferedOffset      int64
 	estimatedFooterSize int64
+	records             uint64
+
+	progressMu sync.Mutex
+	tablesDone int
 }
 
 // Create opens a 64-bit CDB database at the given path. If the file exists, it will
-// be overwritten. The returned database is not safe for concurrent writes.
+// be overwritten. The returned database is not safe for concurrent writes;
+// wrap it in a ConcurrentWriter for that.
 func Create(path string) (*Writer, error) {
+	return create(path, Format64)
+}
+
+func create(path string, format Format) (*Writer, error) {
 	f, err := os.Create(path)
 	if err != nil {
 		return nil, fmt.Errorf("os.Create(%q): %w", path, err)
 	}
 
-	return NewWriter(f)
+	w, err := newWriter(f, format)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	w.file = f
+	return w, nil
 }
 
 // NewWriter opens a 64-bit CDB database for the given io.WriteSeeker.
 func NewWriter(writer io.WriteSeeker) (*Writer, error) {
-	// Leave 256 * 16 bytes for the index at the head of the file.
+	return newWriter(writer, Format64)
+}
+
+func newWriter(writer io.WriteSeeker, format Format) (*Writer, error) {
+	// Leave room for the index at the head of the file: 256 * 16 bytes, or
+	// 256 * 8 for the 32-bit format.
 	_, err := writer.Seek(0, io.SeekStart)
 	if err != nil {
 		return nil, fmt.Errorf("writer.Seek(0): %w", err)
 	}
 
-	_, err = writer.Write(make([]byte, indexSize))
+	size := format.layout().indexSize
+	_, err = writer.Write(make([]byte, size))
 	if err != nil {
 		return nil, fmt.Errorf("writer.Write(index): %w", err)
 	}
 
 	return &Writer{
 		writer:         writer,
+		format:         format,
 		bufferedWriter: bufio.NewWriterSize(writer, 65536),
-		bufferedOffset: indexSize,
+		bufferedOffset: int64(size),
 	}, nil
 }
 
 // Put adds a key/value pair to the database. If the amount of data written
 // would exceed the limit, Put returns ErrTooMuchData.
 func (cdb *Writer) Put(key, value []byte) error {
+	if cdb.state != stateWriting {
+		return ErrFinalized
+	}
+	if err := cdb.checkLoadFactor(); err != nil {
+		return err
+	}
+
 	/* The + 32 is a safety buffer to prevent edge cases where the calculation might be slightly off.
 	Let me break down the magic numbers:
 
@@ -92,23 +183,21 @@ func (cdb *Writer) Put(key, value []byte) error {
 	  - Additional hash table entries from collision handling
 	  - General safety margin to ensure we don't hit the exact limit
 	*/
-	entrySize := int64(16 + len(key) + len(value))
-	const maxInt64 = int64(^uint64(0) >> 1)
-	if (cdb.bufferedOffset + entrySize + cdb.estimatedFooterSize + 32) > maxInt64 {
-		return ErrTooMuchData
+	l := cdb.format.layout()
+	entrySize := int64(l.tupleSize) + int64(len(key)) + int64(len(value))
+	if entrySize > l.maxSize || (cdb.bufferedOffset+entrySize+cdb.estimatedFooterSize+32) > l.maxSize {
+		return l.tooMuch
 	}
 
-	// Record the entry in the hash table, to be written out at the end.
-	hash := cdbHash(key)
-	table := hash & 0xff
-
-	entry := entry{hash: hash, offset: uint64(cdb.bufferedOffset)}
-	cdb.entries[table] = append(cdb.entries[table], entry)
-
 	// Write the key length, then value length, then key, then value.
-	err := writeTuple64(cdb.bufferedWriter, uint64(len(key)), uint64(len(value)))
+	var err error
+	if cdb.format == Format32 {
+		err = writeTuple32(cdb.bufferedWriter, uint32(len(key)), uint32(len(value)))
+	} else {
+		err = writeTuple64(cdb.bufferedWriter, uint64(len(key)), uint64(len(value)))
+	}
 	if err != nil {
-		return fmt.Errorf("writeTuple64(key/value lengths): %w", err)
+		return fmt.Errorf("writeTuple(key/value lengths): %w", err)
 	}
 
 	_, err = cdb.bufferedWriter.Write(key)
@@ -121,7 +210,62 @@ func (cdb *Writer) Put(key, value []byte) error {
 		return fmt.Errorf("cdb.bufferedWriter.Write(value): %w", err)
 	}
 
+	// Record the entry in the hash table, to be written out at the end.
+	offset := cdb.bufferedOffset
 	cdb.bufferedOffset += entrySize
+	cdb.addEntry(entry{hash: cdbHash(key), offset: uint64(offset)})
+
+	return nil
+}
+
+// putRaw appends records that are already encoded in the data section
+// format. The offsets of entries are relative to the start of data, and
+// their hashes must be those of the records' keys.
+func (cdb *Writer) putRaw(data []byte, entries []entry) error {
+	if cdb.state != stateWriting {
+		return ErrFinalized
+	}
+	if cdb.format != Format64 {
+		// The records have to be re-encoded with 32-bit lengths.
+		for _, e := range entries {
+			keyLength, valueLength := readTupleMmap(data, e.offset)
+			keyEnd := e.offset + 16 + keyLength
+			if err := cdb.Put(data[e.offset+16:keyEnd], data[keyEnd:keyEnd+valueLength]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// See Put for the safety margin.
+	const maxInt64 = int64(^uint64(0) >> 1)
+	if (cdb.bufferedOffset + int64(len(data)) + cdb.estimatedFooterSize + 16*int64(len(entries)) + 32) > maxInt64 {
+		return ErrTooMuchData
+	}
+
+	_, err := cdb.bufferedWriter.Write(data)
+	if err != nil {
+		return fmt.Errorf("cdb.bufferedWriter.Write(records): %w", err)
+	}
+
+	start := uint64(cdb.bufferedOffset)
+	cdb.bufferedOffset += int64(len(data))
+	for _, e := range entries {
+		e.offset += start
+		cdb.addEntry(e)
+	}
+	return nil
+}
+
+// addEntry records a written record in its hash table.
+func (cdb *Writer) addEntry(e entry) {
+	table := e.hash & 0xff
+	cdb.entries[table] = append(cdb.entries[table], e)
+
+	cdb.records++
+	if cdb.records%progressInterval == 0 {
+		cdb.report(PhaseRecords)
+	}
 
 	// We approximate the footer size: 16 bytes per entry and 16 per table.
 	// This approximation becomes more accurate over time.
@@ -131,120 +275,230 @@ func (cdb *Writer) Put(key, value []byte) error {
 		// Reallocate hash tables
 		cdb.estimatedFooterSize += 16 * int64(totalEntries)
 	}
+}
+
+// PutContext is like Put, but returns the context's error without adding
+// the record if ctx is done.
+func (cdb *Writer) PutContext(ctx context.Context, key, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return cdb.Put(key, value)
+}
+
+// Finish finalizes the database without closing the underlying
+// io.WriteSeeker, which is left positioned at the end of the database. Close
+// or Freeze may still be called afterwards; Put returns ErrFinalized.
+func (cdb *Writer) Finish() error {
+	return cdb.FinishContext(context.Background())
+}
 
+// FinishContext is like Finish, but stops building hash tables when ctx is
+// done. A cancelled finalize leaves the database invalid; the context's
+// error is returned by every later attempt to finalize it, and Abort
+// discards it.
+func (cdb *Writer) FinishContext(ctx context.Context) error {
+	if cdb.state == stateClosed {
+		return ErrWriterClosed
+	}
+
+	_, err := cdb.finalize(ctx)
+	if err != nil {
+		return fmt.Errorf("finalize: %w", err)
+	}
+
+	_, err = cdb.writer.Seek(cdb.bufferedOffset, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("writer.Seek(end): %w", err)
+	}
 	return nil
 }
 
-// Close finalizes the database and closes the underlying io.WriteSeeker.
+// Close finalizes the database and closes the underlying io.WriteSeeker if it
+// implements io.Closer. For a writer created with CreateAtomic, the database
+// replaces the target path only once it is complete and synced. If Close
+// fails, Abort releases the destination.
 func (cdb *Writer) Close() error {
-	err := cdb.bufferedWriter.Flush()
-	if err != nil {
-		return fmt.Errorf("bufferedWriter.Flush: %w", err)
+	if cdb.state == stateClosed {
+		return ErrWriterClosed
 	}
 
-	_, err = cdb.finalize()
+	_, err := cdb.finalize(context.Background())
 	if err != nil {
 		return fmt.Errorf("finalize: %w", err)
 	}
 
+	if cdb.target != "" {
+		if err := cdb.commit(); err != nil {
+			return err
+		}
+	}
+
 	if closer, ok := cdb.writer.(io.Closer); ok {
 		if err := closer.Close(); err != nil {
 			return fmt.Errorf("writer.Close: %w", err)
 		}
-	} else {
-		return errors.New("brain damage: writer does not implement io.Closer")
 	}
+	cdb.state = stateClosed
 	return nil
 }
 
-// Freeze finalizes the database and returns an MmapCDB instance for reading.
-func (cdb *Writer) Freeze() (*MmapCDB, error) {
-	err := cdb.bufferedWriter.Flush()
-	if err != nil {
-		return nil, fmt.Errorf("bufferedWriter.Flush: %w", err)
+// Freeze finalizes the database and returns a Reader for it. A file
+// destination is memory-mapped, and the returned MmapCDB takes ownership of
+// the file. A Builder yields an InMemoryCDB over its buffer. Any other
+// destination must implement io.ReaderAt or io.Reader so the database can be
+// read back into memory, after which it is closed like with Close.
+func (cdb *Writer) Freeze() (Reader, error) {
+	if cdb.state == stateClosed {
+		return nil, ErrWriterClosed
 	}
 
-	_, err = cdb.finalize()
+	_, err := cdb.finalize(context.Background())
 	if err != nil {
 		return nil, fmt.Errorf("finalize: %w", err)
 	}
 
-	// Convert io.WriteSeeker to *os.File if possible
-	if file, ok := cdb.writer.(*os.File); ok {
-		return Mmap(file)
+	if cdb.target != "" {
+		if err := cdb.commit(); err != nil {
+			return nil, err
+		}
 	}
-	return nil, errors.New("brain damage: cannot create memory-mapped CDB from non-file WriteSeeker")
-}
 
-func (cdb *Writer) finalize() (index, error) {
-	var err error
-	cdb.finalizeOnce.Do(func() {
-		err = cdb.doFinalize()
-	})
+	switch dest := cdb.writer.(type) {
+	case *os.File:
+		cdb.state = stateClosed
+		db, err := mmapFormat(dest, cdb.format, false)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	case *memFile:
+		cdb.state = stateClosed
+		return newInMemoryFormat(dest.data, cdb.format, false)
+	}
 
-	// Return empty index since doFinalize already writes the index to file
-	return index{}, err
+	data, err := cdb.readBack()
+	if err != nil {
+		return nil, err
+	}
+	if err := cdb.Close(); err != nil {
+		return nil, err
+	}
+	return newInMemoryFormat(data, cdb.format, false)
 }
 
-func (cdb *Writer) doFinalize() error {
-	// Store table offsets as we write hash tables
-	var tableOffsets [256]uint64
+// readBack reads the finalized database from a destination that supports
+// reading.
+func (cdb *Writer) readBack() ([]byte, error) {
+	data := make([]byte, cdb.bufferedOffset)
+	switch dest := cdb.writer.(type) {
+	case io.ReaderAt:
+		n, err := dest.ReadAt(data, 0)
+		if n < len(data) {
+			return nil, fmt.Errorf("writer.ReadAt: %w", err)
+		}
+	case io.Reader:
+		if _, err := cdb.writer.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("writer.Seek(0): %w", err)
+		}
+		if _, err := io.ReadFull(dest, data); err != nil {
+			return nil, fmt.Errorf("io.ReadFull: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("cannot read back CDB from %T", cdb.writer)
+	}
+	return data, nil
+}
 
-	// Create hash tables and write them to the file
-	for i := 0; i < 256; i++ {
-		tableEntries := cdb.entries[i]
-		tableSize := uint64(len(tableEntries) << 1)
+// Abort discards the database. For a writer created with CreateAtomic the
+// temporary file is removed and the target is left untouched; for one
+// created with Create the partially written file is removed. Otherwise the
+// destination is closed if it implements io.Closer. Abort after Close or
+// Freeze returns ErrWriterClosed.
+func (cdb *Writer) Abort() error {
+	if cdb.state == stateClosed {
+		return ErrWriterClosed
+	}
+	cdb.state = stateClosed
 
-		if tableSize == 0 {
-			tableOffsets[i] = 0 // No table for this bucket
-			continue
+	var errs []error
+	if closer, ok := cdb.writer.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("writer.Close: %w", err))
 		}
+	}
+	if cdb.file != nil {
+		if err := os.Remove(cdb.file.Name()); err != nil {
+			errs = append(errs, fmt.Errorf("os.Remove(%q): %w", cdb.file.Name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
 
-		// Record where this table will be written
-		tableOffsets[i] = uint64(cdb.bufferedOffset)
+// finalize writes the hash tables and index the first time it is called and
+// returns the outcome of that attempt on every call.
+func (cdb *Writer) finalize(ctx context.Context) (index, error) {
+	if cdb.state == stateWriting {
+		cdb.state = stateFinalized
+		cdb.finalizeErr = cdb.doFinalize(ctx)
+		if cdb.finalizeErr == nil {
+			cdb.report(PhaseDone)
+		}
+	}
 
-		// Create hash table
-		hashTable := make([]entry, tableSize)
-		for _, entry := range tableEntries {
-			startingSlot := (uint64(entry.hash) >> 8) % tableSize
-			slot := startingSlot
+	// Return empty index since doFinalize already writes the index to file
+	return index{}, cdb.finalizeErr
+}
 
-			for {
-				if hashTable[slot].hash == 0 {
-					hashTable[slot] = entry
-					break
-				}
-				slot = (slot + 1) % tableSize
-				if slot == startingSlot {
-					return errors.New("hash table full")
-				}
-			}
-		}
+func (cdb *Writer) doFinalize(ctx context.Context) error {
+	// Table sizes are known up front, so every table's final offset can be
+	// computed before any of them is built.
+	if err := cdb.checkLoadFactor(); err != nil {
+		return err
+	}
 
-		// Write hash table
-		for _, entry := range hashTable {
-			err := writeTuple64(cdb.bufferedWriter, uint64(entry.hash), entry.offset)
-			if err != nil {
-				return fmt.Errorf("writeTuple64(hash table entry): %w", err)
+	l := cdb.format.layout()
+	var tableOffsets, tableSizes [256]uint64
+	offset := uint64(cdb.bufferedOffset)
+	for i := 0; i < 256; i++ {
+		tableSizes[i] = cdb.tableSize(len(cdb.entries[i]))
+		if tableSizes[i] == 0 {
+			// No table for this bucket. The 32-bit format points empty
+			// tables at the next one, like cdbmake does.
+			if cdb.format == Format32 {
+				tableOffsets[i] = offset
 			}
-			cdb.bufferedOffset += 16
+			continue
 		}
+		tableOffsets[i] = offset
+		offset += l.tupleSize * tableSizes[i]
+	}
+	if offset > uint64(l.maxSize) {
+		return l.tooMuch
 	}
 
-	// Flush the buffered writer before seeking
+	// Flush the data section before the tables are written behind it.
 	err := cdb.bufferedWriter.Flush()
 	if err != nil {
 		return fmt.Errorf("bufferedWriter.Flush: %w", err)
 	}
 
-	// Write index using actual table offsets
-	buf := make([]byte, indexSize)
-	for i := 0; i < 256; i++ {
-		tableEntries := cdb.entries[i]
-		tableSize := uint64(len(tableEntries) << 1)
+	cdb.report(PhaseTables)
+	if wa, ok := cdb.writer.(io.WriterAt); ok {
+		err = cdb.writeTablesAt(ctx, wa, &tableOffsets, &tableSizes)
+	} else {
+		err = cdb.writeTablesInOrder(ctx, &tableSizes)
+	}
+	if err != nil {
+		return err
+	}
+	cdb.bufferedOffset = int64(offset)
+	cdb.report(PhaseIndex)
 
-		binary.LittleEndian.PutUint64(buf[i*16:i*16+8], tableOffsets[i])
-		binary.LittleEndian.PutUint64(buf[i*16+8:i*16+16], tableSize)
+	// Write index using actual table offsets
+	buf := make([]byte, l.indexSize)
+	for i := uint64(0); i < 256; i++ {
+		l.putTuple(buf[i*l.tupleSize:], tableOffsets[i], tableSizes[i])
 	}
 
 	// Seek to beginning and write index
@@ -260,6 +514,212 @@ func (cdb *Writer) doFinalize() error {
 	return nil
 }
 
+// MinLoadFactor is the smallest LoadFactor a Writer accepts. Sparser tables
+// would mostly waste space.
+const MinLoadFactor = 0.05
+
+// checkLoadFactor reports an error if LoadFactor is out of range.
+func (cdb *Writer) checkLoadFactor() error {
+	if cdb.LoadFactor != 0 && !(cdb.LoadFactor >= MinLoadFactor && cdb.LoadFactor <= 1) {
+		return fmt.Errorf("load factor %v out of range [%v, 1]", cdb.LoadFactor, MinLoadFactor)
+	}
+	return nil
+}
+
+// tableSize returns the number of slots in a hash table holding n entries.
+func (cdb *Writer) tableSize(n int) uint64 {
+	if n == 0 {
+		return 0
+	}
+
+	size := uint64(n) << 1
+	if cdb.LoadFactor != 0 {
+		size = uint64(math.Ceil(float64(n) / cdb.LoadFactor))
+		if size < uint64(n) {
+			size = uint64(n)
+		}
+	}
+
+	if cdb.PowerOfTwo && size&(size-1) != 0 {
+		size = 1 << bits.Len64(size)
+	}
+	return size
+}
+
+// concurrency returns the number of hash tables built in parallel.
+func (cdb *Writer) concurrency() int {
+	if cdb.Concurrency > 0 {
+		return cdb.Concurrency
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// writeTablesAt builds the hash tables concurrently and writes each one
+// directly at its final offset.
+func (cdb *Writer) writeTablesAt(ctx context.Context, wa io.WriterAt, offsets, sizes *[256]uint64) error {
+	var (
+		wg       sync.WaitGroup
+		next     atomic.Int32
+		errOnce  sync.Once
+		firstErr error
+		failed   atomic.Bool
+	)
+	fail := func(err error) {
+		errOnce.Do(func() { firstErr = err })
+		failed.Store(true)
+	}
+
+	for w := 0; w < cdb.concurrency(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !failed.Load() {
+				i := int(next.Add(1) - 1)
+				if i >= 256 {
+					return
+				}
+				if err := ctx.Err(); err != nil {
+					fail(err)
+					return
+				}
+				if sizes[i] != 0 {
+					buf, err := buildTable(cdb.format.layout(), cdb.entries[i], sizes[i])
+					if err != nil {
+						fail(err)
+						return
+					}
+					if _, err := wa.WriteAt(buf, int64(offsets[i])); err != nil {
+						fail(fmt.Errorf("writer.WriteAt(hash table %d): %w", i, err))
+						return
+					}
+				}
+				cdb.tableDone()
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// writeTablesInOrder builds the hash tables concurrently and streams them to
+// the writer in table order. At most concurrency() built tables are held in
+// memory at any time.
+func (cdb *Writer) writeTablesInOrder(ctx context.Context, sizes *[256]uint64) error {
+	type result struct {
+		buf []byte
+		err error
+	}
+	var results [256]chan result
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+
+	// Tables are dispatched in order and a slot is only released once its
+	// table has been written, so the table the writer waits for is always
+	// either built or being built.
+	slots := make(chan struct{}, cdb.concurrency())
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for i := 0; i < 256; i++ {
+			if sizes[i] == 0 {
+				continue
+			}
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				return
+			}
+			go func(i int) {
+				buf, err := buildTable(cdb.format.layout(), cdb.entries[i], sizes[i])
+				results[i] <- result{buf: buf, err: err}
+			}(i)
+		}
+	}()
+
+	for i := 0; i < 256; i++ {
+		if sizes[i] == 0 {
+			cdb.tableDone()
+			continue
+		}
+
+		var res result
+		select {
+		case res = <-results[i]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if res.err != nil {
+			return res.err
+		}
+		if _, err := cdb.writer.Write(res.buf); err != nil {
+			return fmt.Errorf("writer.Write(hash table %d): %w", i, err)
+		}
+		<-slots
+		cdb.tableDone()
+	}
+	return nil
+}
+
+// tableDone records that another hash table has been written.
+func (cdb *Writer) tableDone() {
+	cdb.progressMu.Lock()
+	defer cdb.progressMu.Unlock()
+	cdb.tablesDone++
+	cdb.reportLocked(PhaseTables)
+}
+
+// report calls OnProgress, if set, with the writer's current progress.
+func (cdb *Writer) report(phase Phase) {
+	cdb.progressMu.Lock()
+	defer cdb.progressMu.Unlock()
+	cdb.reportLocked(phase)
+}
+
+func (cdb *Writer) reportLocked(phase Phase) {
+	if cdb.OnProgress == nil {
+		return
+	}
+	p := Progress{
+		Phase:   phase,
+		Records: cdb.records,
+		Bytes:   uint64(cdb.bufferedOffset),
+		Tables:  cdb.tablesDone,
+	}
+	if phase == PhaseDone {
+		p.TotalBytes = p.Bytes
+	}
+	cdb.OnProgress(p)
+}
+
+// buildTable lays out the given entries in a linear probing hash table of
+// tableSize slots and returns its on-disk encoding in layout l.
+func buildTable(l layout, entries []entry, tableSize uint64) ([]byte, error) {
+	hashTable := make([]entry, tableSize)
+	for _, entry := range entries {
+		startingSlot := table{length: tableSize}.startSlot(entry.hash)
+		slot := startingSlot
+
+		for {
+			// Records never start at offset zero, which holds the index.
+			if hashTable[slot].offset == 0 {
+				hashTable[slot] = entry
+				break
+			}
+			slot = (slot + 1) % tableSize
+			if slot == startingSlot {
+				return nil, errors.New("hash table full")
+			}
+		}
+	}
+
+	buf := make([]byte, l.tupleSize*tableSize)
+	for i, entry := range hashTable {
+		l.putTuple(buf[uint64(i)*l.tupleSize:], uint64(entry.hash), entry.offset)
+	}
+	return buf, nil
+}
+
 func writeTuple64(w io.Writer, first, second uint64) error {
 	tuple := make([]byte, 16)
 	binary.LittleEndian.PutUint64(tuple[:8], first)
@@ -271,3 +731,15 @@ func writeTuple64(w io.Writer, first, second uint64) error {
 	}
 	return nil
 }
+
+func writeTuple32(w io.Writer, first, second uint32) error {
+	tuple := make([]byte, 8)
+	binary.LittleEndian.PutUint32(tuple[:4], first)
+	binary.LittleEndian.PutUint32(tuple[4:], second)
+
+	_, err := w.Write(tuple)
+	if err != nil {
+		return fmt.Errorf("w.Write(tuple): %w", err)
+	}
+	return nil
+}
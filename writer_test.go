@@ -2,10 +2,19 @@ package cdb_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"math"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 	"testing/quick"
 	"time"
@@ -163,3 +172,350 @@ func BenchmarkPut(b *testing.B) {
 
 	benchmarkPut(b, writer)
 }
+
+// seekBuffer is an in-memory io.WriteSeeker that deliberately does not
+// implement io.WriterAt.
+type seekBuffer struct {
+	data []byte
+	pos  int
+}
+
+func (b *seekBuffer) Write(p []byte) (int, error) {
+	if end := b.pos + len(p); end > len(b.data) {
+		b.data = append(b.data, make([]byte, end-len(b.data))...)
+	}
+	n := copy(b.data[b.pos:], p)
+	b.pos += n
+	return n, nil
+}
+
+func (b *seekBuffer) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		b.pos = int(offset)
+	case io.SeekCurrent:
+		b.pos += int(offset)
+	case io.SeekEnd:
+		b.pos = len(b.data) + int(offset)
+	}
+	return int64(b.pos), nil
+}
+
+func buildWithConcurrency(t *testing.T, concurrency int, useFile bool) []byte {
+	var ws io.WriteSeeker
+	buf := &seekBuffer{}
+	ws = buf
+	if useFile {
+		f, err := os.CreateTemp("", "test-cdb")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		ws = f
+	}
+
+	writer, err := cdb.NewWriter(ws)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Concurrency = concurrency
+	for i := 0; i < 5000; i++ {
+		if err := writer.Put([]byte("key"+strconv.Itoa(i)), []byte(strconv.Itoa(i*i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !useFile {
+		if err := writer.Finish(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.data
+	}
+
+	if _, err := writer.Freeze(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(ws.(*os.File).Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// sequentialDigest is the SHA-256 of the database buildWithConcurrency
+// writes, as produced by the sequential finalize that predates Concurrency.
+const sequentialDigest = "6bb8aba712f39f134ad913a7d051d2153b6c757edb97d710e1dc528ed89a3b47"
+
+func TestParallelFinalizeIdenticalOutput(t *testing.T) {
+	expected := buildWithConcurrency(t, 1, false)
+	if digest := fmt.Sprintf("%x", sha256.Sum256(expected)); digest != sequentialDigest {
+		t.Errorf("output has SHA-256 %s, want %s from the sequential finalize", digest, sequentialDigest)
+	}
+	for _, concurrency := range []int{0, 2, 16} {
+		if got := buildWithConcurrency(t, concurrency, false); !bytes.Equal(expected, got) {
+			t.Errorf("in-order write with concurrency %d differs from sequential output", concurrency)
+		}
+		if got := buildWithConcurrency(t, concurrency, true); !bytes.Equal(expected, got) {
+			t.Errorf("positioned write with concurrency %d differs from sequential output", concurrency)
+		}
+	}
+
+	db, err := cdb.NewInMemory(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5000; i++ {
+		value, err := db.Get([]byte("key" + strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != strconv.Itoa(i*i) {
+			t.Fatalf("key%d: expected %d, got %q", i, i*i, value)
+		}
+	}
+}
+
+func buildWithLayout(t *testing.T, loadFactor float64, powerOfTwo bool) *cdb.InMemoryCDB {
+	buf := &seekBuffer{}
+	writer, err := cdb.NewWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.LoadFactor = loadFactor
+	writer.PowerOfTwo = powerOfTwo
+	for i := 0; i < 10000; i++ {
+		if err := writer.Put([]byte("key"+strconv.Itoa(i)), []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := cdb.NewInMemory(buf.data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10000; i++ {
+		value, err := db.Get([]byte("key" + strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != strconv.Itoa(i) {
+			t.Fatalf("key%d: expected %d, got %q", i, i, value)
+		}
+	}
+	if value, _ := db.Get([]byte("missing")); value != nil {
+		t.Errorf("expected nil for missing key, got %q", value)
+	}
+	return db
+}
+
+func TestLoadFactor(t *testing.T) {
+	sparse := buildWithLayout(t, 0, false).Stats()
+	if sparse.LoadFactor != 0.5 {
+		t.Errorf("default load factor: expected 0.5, got %v", sparse.LoadFactor)
+	}
+	if sparse.Records != 10000 {
+		t.Errorf("expected 10000 records, got %d", sparse.Records)
+	}
+
+	dense := buildWithLayout(t, 0.9, false).Stats()
+	if dense.LoadFactor < 0.85 || dense.LoadFactor > 0.9 {
+		t.Errorf("expected load factor close to 0.9, got %v", dense.LoadFactor)
+	}
+	if dense.Size >= sparse.Size {
+		t.Errorf("dense file (%d bytes) should be smaller than sparse file (%d bytes)", dense.Size, sparse.Size)
+	}
+	if dense.AvgMissProbe <= sparse.AvgMissProbe {
+		t.Errorf("dense tables should have longer miss probes: %v <= %v", dense.AvgMissProbe, sparse.AvgMissProbe)
+	}
+
+	full := buildWithLayout(t, 1, false).Stats()
+	if full.LoadFactor != 1 {
+		t.Errorf("expected full tables, got load factor %v", full.LoadFactor)
+	}
+
+	pow2 := buildWithLayout(t, 0.75, true).Stats()
+	if !pow2.PowerOfTwo {
+		t.Error("expected power-of-two tables")
+	}
+	if sparse.PowerOfTwo {
+		t.Error("default tables should not all be powers of two")
+	}
+}
+
+func TestLoadFactorOutOfRange(t *testing.T) {
+	writer, err := cdb.NewWriter(&seekBuffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Put rejects a bad load factor before writing, and the writer can
+	// be used once it is corrected.
+	for _, lf := range []float64{1.5, -1, 1e-300, math.NaN()} {
+		writer.LoadFactor = lf
+		if err := writer.Put([]byte("key"), []byte("value")); err == nil || !strings.Contains(err.Error(), "load factor") {
+			t.Errorf("Put with load factor %v: expected load factor error, got %v", lf, err)
+		}
+	}
+	writer.LoadFactor = cdb.MinLoadFactor
+	if err := writer.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A load factor changed after the last Put fails at Close.
+	writer.LoadFactor = 1.5
+	if err := writer.Close(); err == nil || !strings.Contains(err.Error(), "load factor") {
+		t.Errorf("expected load factor error, got %v", err)
+	}
+}
+
+func TestWriterProgress(t *testing.T) {
+	builder := cdb.NewBuilder()
+	var reports []cdb.Progress
+	builder.OnProgress = func(p cdb.Progress) { reports = append(reports, p) }
+
+	for i := 0; i < 200000; i++ {
+		if err := builder.Put([]byte("key"+strconv.Itoa(i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := builder.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	phases := map[cdb.Phase]int{}
+	for _, p := range reports {
+		phases[p.Phase]++
+	}
+	if phases[cdb.PhaseRecords] != 3 {
+		t.Errorf("expected 3 record reports, got %d", phases[cdb.PhaseRecords])
+	}
+	if phases[cdb.PhaseTables] < 256 {
+		t.Errorf("expected a report per table, got %d", phases[cdb.PhaseTables])
+	}
+	if phases[cdb.PhaseIndex] != 1 || phases[cdb.PhaseDone] != 1 {
+		t.Errorf("expected one index and one done report, got %v", phases)
+	}
+
+	last := reports[len(reports)-1]
+	if last.Phase != cdb.PhaseDone || last.Records != 200000 || last.Tables != 256 || last.TotalBytes != uint64(len(data)) {
+		t.Errorf("unexpected final progress: %+v", last)
+	}
+}
+
+func testWriterContext(t *testing.T, dest io.WriteSeeker) {
+	writer, err := cdb.NewWriter(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := writer.PutContext(ctx, []byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := writer.PutContext(ctx, []byte("key"), []byte("value")); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled from PutContext, got %v", err)
+	}
+	if err := writer.FinishContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled from FinishContext, got %v", err)
+	}
+	// The cancelled finalize sticks.
+	if err := writer.Finish(); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled from Finish after cancel, got %v", err)
+	}
+}
+
+func TestWriterContext(t *testing.T) {
+	testWriterContext(t, &seekBuffer{})
+
+	f, err := os.CreateTemp("", "test-cdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	testWriterContext(t, f)
+}
+
+// zeroHashKey is a key whose cdb hash is 0, which must not be mistaken for
+// an empty slot.
+const zeroHashKey = "\x8a\xa0>\x12 c"
+
+func TestZeroHashKey(t *testing.T) {
+	for _, format := range []cdb.Format{cdb.Format64, cdb.Format32} {
+		b := cdb.NewBuilder()
+		if format == cdb.Format32 {
+			b = cdb.NewBuilder32()
+		}
+		// Keys of the same table around the zero hash probe past its
+		// slot, or into it.
+		var keys []string
+		for i := 0; len(keys) < 50; i++ {
+			if key := strconv.Itoa(i); djbHash(key)&0xff == 0 {
+				keys = append(keys, key)
+			}
+		}
+		keys = append(keys[:25], append([]string{zeroHashKey}, keys[25:]...)...)
+		for _, key := range keys {
+			if err := b.Put([]byte(key), []byte("v"+key)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := b.Put([]byte(zeroHashKey), []byte("second")); err != nil {
+			t.Fatal(err)
+		}
+		data, err := b.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(t.TempDir(), "zero.cdb")
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		mmap, err := cdb.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer mmap.Close()
+		mem, err := cdb.NewInMemory(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, db := range []interface {
+			cdb.Reader
+			GetAll(key []byte) iter.Seq[[]byte]
+			Verify() error
+		}{mmap, mem} {
+			for _, key := range keys {
+				if value, err := db.Get([]byte(key)); err != nil || string(value) != "v"+key {
+					t.Errorf("%v %T: Get(%q) = %q, %v", format, db, key, value, err)
+				}
+			}
+			var values []string
+			for value := range db.GetAll([]byte(zeroHashKey)) {
+				values = append(values, string(value))
+			}
+			if want := []string{"v" + zeroHashKey, "second"}; !reflect.DeepEqual(values, want) {
+				t.Errorf("%v %T: GetAll of the zero-hash key = %q, want %q", format, db, values, want)
+			}
+			if err := db.Verify(); err != nil {
+				t.Errorf("%v %T: Verify: %v", format, db, err)
+			}
+		}
+	}
+}
+
+// djbHash is the hash of cdb, which picks the table of a key by its low
+// byte.
+func djbHash(key string) uint32 {
+	h := uint32(5381)
+	for i := 0; i < len(key); i++ {
+		h = h*33 ^ uint32(key[i])
+	}
+	return h
+}